@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Access log
+//
+// Each request is logged once it has been handled,
+// with the client address (as forwarded by a trusted
+// proxy), method, path, status code, response size and
+// duration, for auditing. The lines go to the same
+// output as the other logs, as logfmt key=value pairs
+// with -log-format text, or one JSON object per line
+// with -log-format json, which also applies to the
+// rest of the log.
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logFormatter returns the formatter for the given
+// log format, with or without timestamps.
+func logFormatter(format string, timestamps bool) (log.Formatter, error) {
+	switch format {
+	case logFormatText:
+		return &log.TextFormatter{
+			DisableTimestamp: !timestamps,
+			FullTimestamp:    true,
+			DisableSorting:   !timestamps,
+		}, nil
+	case logFormatJSON:
+		return &log.JSONFormatter{DisableTimestamp: !timestamps}, nil
+	}
+	return nil, fmt.Errorf("Invalid log format: %s (must be %s|%s)", format, logFormatText, logFormatJSON)
+}
+
+// newAccessLogger returns a logger for the access log,
+// writing to out.
+func newAccessLogger(out io.Writer, format string) (*log.Logger, error) {
+	formatter, err := logFormatter(format, true)
+	if err != nil {
+		return nil, err
+	}
+	logger := log.New()
+	logger.Out = out
+	logger.Formatter = formatter
+	return logger, nil
+}
+
+// NewAccessLogHandler wraps h, logging each request to
+// logger.
+func NewAccessLogHandler(h http.Handler, logger *log.Logger, proxies *proxyTrust) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		logger.WithFields(log.Fields{
+			"remote":   proxies.origin(r).ClientIP,
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"status":   rec.code,
+			"size":     rec.size,
+			"duration": time.Since(start).Seconds(),
+		}).Info("request")
+	})
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Adapter wraps a handler with some behaviour, such as
+// compression or instrumentation.
+type Adapter func(http.Handler) http.Handler
+
+// Adapt wraps h with each adapter in turn, so that the
+// last one sees requests first.
+func Adapt(h http.Handler, adapters ...Adapter) http.Handler {
+	for _, adapter := range adapters {
+		h = adapter(h)
+	}
+	return h
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// resourceActivity is the latest recorded operation
+// of a resource on a node.
+type resourceActivity struct {
+	Id         string    `json:"id"`
+	Node       string    `json:"node"`
+	Operation  string    `json:"operation"`
+	Running    bool      `json:"running"`
+	Failed     bool      `json:"failed"`
+	LastChange time.Time `json:"last_change"`
+}
+
+// handleApiResourceActivity
+//
+// Returns the most recent operation of each resource
+// on each node, from the operation history in the CIB
+// status. With changed_since=<RFC 3339 time>, only
+// resources with operations that ran or changed
+// result after that time are returned, newest first,
+// so that activity feeds can poll for what's new.
+func handleApiResourceActivity(w http.ResponseWriter, r *http.Request, cib_data string) bool {
+	var since time.Time
+	if v := r.URL.Query().Get("changed_since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			httpJSONError(w, fmt.Sprintf("Invalid changed_since: %v (must be RFC 3339).", v), http.StatusBadRequest)
+			return true
+		}
+		since = t
+	}
+
+	if cib_data == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+
+	status, err := parseCibStatusContext(r.Context(), cib_data)
+	if err != nil {
+		return parseFailed(w, err)
+	}
+
+	activity := []resourceActivity{}
+	for _, ns := range status.NodeStates {
+		node := ns.Uname
+		if node == "" {
+			node = ns.Id
+		}
+		for i := range ns.Resources {
+			rsc := &ns.Resources[i]
+			var latest *cibLrmRscOp
+			for j := range rsc.Ops {
+				if latest == nil || rsc.Ops[j].changed().After(latest.changed()) {
+					latest = &rsc.Ops[j]
+				}
+			}
+			if latest == nil || !latest.changed().After(since) {
+				continue
+			}
+			activity = append(activity, resourceActivity{
+				Id:         rsc.Id,
+				Node:       node,
+				Operation:  latest.Operation,
+				Running:    rsc.running(),
+				Failed:     latest.failed(),
+				LastChange: latest.changed(),
+			})
+		}
+	}
+	sort.SliceStable(activity, func(i, j int) bool {
+		return activity[i].LastChange.After(activity[j].LastChange)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+
+	jsonData, jsonError := json.Marshal(activity)
+	if jsonError != nil {
+		log.Error(jsonError)
+		return false
+	}
+
+	io.WriteString(w, string(jsonData)+"\n")
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+)
+
+// CIB as JSON
+//
+// /api/v1/cib.json returns the parsed CIB as a single
+// JSON object, for frontends that don't want to parse
+// the XML: the derived views (nodes, resources,
+// constraints, cluster and properties, with the same
+// structure as their own endpoints), plus node_status
+// and resource_status, the runtime state of each node
+// and primitive.
+
+// renderCache holds a document rendered from the
+// latest CIB.
+type renderCache struct {
+	lock sync.Mutex
+	hash string
+	data []byte
+}
+
+func (c *renderCache) get(xmldoc string, hash string, render func(string) ([]byte, error)) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.hash == hash && c.data != nil {
+		return c.data, nil
+	}
+	data, err := render(xmldoc)
+	if err != nil {
+		return nil, err
+	}
+	c.hash, c.data = hash, data
+	return data, nil
+}
+
+// renderCibJSON builds the JSON document for a CIB.
+func renderCibJSON(xmldoc string) ([]byte, error) {
+	doc := make(map[string]interface{}, len(derivedViews)+2)
+	for _, view := range derivedViews {
+		js, err := renderView(context.Background(), xmldoc, view)
+		if err != nil {
+			return nil, err
+		}
+		doc[view] = json.RawMessage(js)
+	}
+	status, err := parseCibStatus(xmldoc)
+	if err != nil {
+		return nil, err
+	}
+	doc["node_status"] = status.nodeStatuses()
+	doc["resource_status"] = status.resourceStatuses()
+	return json.Marshal(doc)
+}
+
+func (handler *routeHandler) serveCibJSON(w http.ResponseWriter, snap cibSnapshot) bool {
+	if snap.xmldoc == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	data, err := handler.cibJSON.get(snap.xmldoc, snap.hash, renderCibJSON)
+	if err != nil {
+		log.Errorf("Failed to render the CIB as JSON: %s", err)
+		httpJSONError(w, "Failed to render the CIB.", http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	w.Write([]byte("\n"))
+	return true
+}
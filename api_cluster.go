@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"encoding/xml"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net/http"
@@ -11,10 +10,9 @@ import (
 func handleApiCluster(w http.ResponseWriter, r *http.Request, cib_data string) bool {
 	// parse xml into Cib struct
 	var cib Cib
-	err := xml.Unmarshal([]byte(cib_data), &cib)
+	err := unmarshalCib(r.Context(), cib_data, &cib)
 	if err != nil {
-		log.Error(err)
-		return false
+		return parseFailed(w, err)
 	}
 
 	cib.Configuration.URLType = "cluster"
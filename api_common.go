@@ -1,9 +1,26 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
 
 //go:generate bash gen.sh
 
+// httpJSONError
+//
+// Like http.Error, but writes the message as a
+// JSON object so that API clients always get
+// something they can parse.
+func httpJSONError(w http.ResponseWriter, msg string, code int) {
+	body, _ := json.Marshal(map[string]string{"error": msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "%s\n", body)
+}
+
 func (c *Cib) MarshalJSON() ([]byte, error) {
 	var struct_interface interface{}
 
@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"encoding/xml"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
@@ -13,10 +12,9 @@ import (
 func handleApiConstraints(w http.ResponseWriter, r *http.Request, cib_data string) bool {
 	// parse xml into Cib struct
 	var cib Cib
-	err := xml.Unmarshal([]byte(cib_data), &cib)
+	err := unmarshalCib(r.Context(), cib_data, &cib)
 	if err != nil {
-		log.Error(err)
-		return false
+		return parseFailed(w, err)
 	}
 
 	cib.Configuration.URLType = "constraints"
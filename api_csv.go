@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CSV export
+//
+// /api/v1/nodes.csv and /api/v1/resources.csv return
+// the node and resource status as CSV with a header
+// row, for importing into spreadsheets.
+
+func writeCSV(w http.ResponseWriter, filename string, records [][]string) bool {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	out := csv.NewWriter(w)
+	if err := out.WriteAll(records); err != nil {
+		log.Error(err)
+	}
+	return true
+}
+
+// handleApiNodesCSV returns one row per node.
+func handleApiNodesCSV(w http.ResponseWriter, r *http.Request, cib_data string) bool {
+	if cib_data == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	status, err := parseCibStatusContext(r.Context(), cib_data)
+	if err != nil {
+		return parseFailed(w, err)
+	}
+	records := [][]string{{"name", "online", "standby", "maintenance"}}
+	for _, n := range status.nodeStatuses() {
+		records = append(records, []string{
+			n.Name,
+			strconv.FormatBool(n.Online),
+			strconv.FormatBool(n.Standby),
+			strconv.FormatBool(n.Maintenance),
+		})
+	}
+	return writeCSV(w, "nodes.csv", records)
+}
+
+// handleApiResourcesCSV returns one row per primitive,
+// with the nodes it is running on and its number of
+// failed operations.
+func handleApiResourcesCSV(w http.ResponseWriter, r *http.Request, cib_data string) bool {
+	if cib_data == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	status, err := parseCibStatusContext(r.Context(), cib_data)
+	if err != nil {
+		return parseFailed(w, err)
+	}
+
+	records := [][]string{{"id", "parent", "class", "provider", "type", "running_on", "failed_actions"}}
+	for _, rsc := range status.resourceStatuses() {
+		records = append(records, []string{
+			rsc.Id,
+			rsc.Parent,
+			rsc.Class,
+			rsc.Provider,
+			rsc.Type,
+			strings.Join(rsc.RunningOn, ","),
+			strconv.Itoa(rsc.FailedActions),
+		})
+	}
+	return writeCSV(w, "resources.csv", records)
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"encoding/xml"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
@@ -13,10 +12,9 @@ import (
 func handleApiNodes(w http.ResponseWriter, r *http.Request, cib_data string) bool {
 	// parse xml into Cib struct
 	var cib Cib
-	err := xml.Unmarshal([]byte(cib_data), &cib)
+	err := unmarshalCib(r.Context(), cib_data, &cib)
 	if err != nil {
-		log.Error(err)
-		return false
+		return parseFailed(w, err)
 	}
 
 	cib.Configuration.URLType = "nodes"
@@ -55,3 +53,72 @@ func handleApiNodes(w http.ResponseWriter, r *http.Request, cib_data string) boo
 	io.WriteString(w, string(jsonData)+"\n")
 	return true
 }
+
+// Node attributes
+//
+// /api/v1/nodes/{node}/attributes returns the instance
+// attributes (standby, maintenance and whatever else
+// was set with crm_attribute) and the utilization of a
+// node from the nodes section, as two JSON objects, for
+// a node detail panel. The node can be given by name
+// or id.
+
+type cibNodeAttributes struct {
+	Nodes []struct {
+		Id          string      `xml:"id,attr"`
+		Uname       string      `xml:"uname,attr"`
+		Attributes  []cibNvpair `xml:"instance_attributes>nvpair"`
+		Utilization []cibNvpair `xml:"utilization>nvpair"`
+	} `xml:"configuration>nodes>node"`
+}
+
+type nodeAttributes struct {
+	Node        string            `json:"node"`
+	Id          string            `json:"id"`
+	Attributes  map[string]string `json:"attributes"`
+	Utilization map[string]string `json:"utilization"`
+}
+
+func nvpairMap(pairs []cibNvpair) map[string]string {
+	m := make(map[string]string, len(pairs))
+	for _, p := range pairs {
+		m[p.Name] = p.Value
+	}
+	return m
+}
+
+func handleApiNodeAttributes(w http.ResponseWriter, r *http.Request, cib_data string, node string) bool {
+	if cib_data == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	var doc cibNodeAttributes
+	if err := unmarshalCib(r.Context(), cib_data, &doc); err != nil {
+		return parseFailed(w, err)
+	}
+	for _, n := range doc.Nodes {
+		if node != n.Uname && node != n.Id {
+			continue
+		}
+		name := n.Uname
+		if name == "" {
+			name = n.Id
+		}
+		data, err := json.Marshal(nodeAttributes{
+			Node:        name,
+			Id:          n.Id,
+			Attributes:  nvpairMap(n.Attributes),
+			Utilization: nvpairMap(n.Utilization),
+		})
+		if err != nil {
+			log.Error(err)
+			return false
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		w.Write([]byte("\n"))
+		return true
+	}
+	httpJSONError(w, fmt.Sprintf("No such node: %v.", node), http.StatusNotFound)
+	return true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// Overview
+//
+// /api/v1/overview answers the question most dashboard
+// tiles ask: are all nodes online and all resources
+// started? It returns the counts behind the answer in
+// a tiny JSON object, rendered once per CIB and served
+// from memory until the CIB changes, so that many
+// clients can poll it frequently.
+
+type overview struct {
+	Healthy          bool `json:"healthy"`
+	NodesOnline      int  `json:"nodes_online"`
+	NodesTotal       int  `json:"nodes_total"`
+	ResourcesStarted int  `json:"resources_started"`
+	ResourcesTotal   int  `json:"resources_total"`
+	Failures         int  `json:"failures"`
+}
+
+// renderOverview builds the overview of a CIB. The
+// cluster is healthy when all nodes are online and all
+// primitives are running; failed operations are
+// counted but don't make it unhealthy.
+func renderOverview(xmldoc string) ([]byte, error) {
+	status, err := parseCibStatus(xmldoc)
+	if err != nil {
+		return nil, err
+	}
+	var o overview
+	nodes := status.nodeStatuses()
+	o.NodesTotal = len(nodes)
+	for _, n := range nodes {
+		if n.Online {
+			o.NodesOnline++
+		}
+	}
+	o.ResourcesTotal, o.ResourcesStarted, o.Failures = status.resourceSummary()
+	o.Healthy = o.NodesOnline == o.NodesTotal && o.ResourcesStarted == o.ResourcesTotal
+	return json.Marshal(o)
+}
+
+func (handler *routeHandler) serveOverview(w http.ResponseWriter, snap cibSnapshot) bool {
+	if snap.xmldoc == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	data, err := handler.overview.get(snap.xmldoc, snap.hash, renderOverview)
+	if err != nil {
+		log.Errorf("Failed to render the overview: %s", err)
+		httpJSONError(w, "Failed to render the overview.", http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	w.Write([]byte("\n"))
+	return true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// handleApiProperties
+//
+// Returns the cluster properties (stonith-enabled,
+// no-quorum-policy, ...) as a single JSON object. When
+// a property is set in more than one property set, the
+// first set in the CIB wins, since that is usually
+// cib-bootstrap-options.
+func handleApiProperties(w http.ResponseWriter, r *http.Request, cib_data string) bool {
+	if cib_data == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+
+	jsonData, err := renderProperties(r.Context(), cib_data)
+	if err != nil {
+		return parseFailed(w, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, string(jsonData)+"\n")
+	return true
+}
+
+func renderProperties(ctx context.Context, cib_data string) ([]byte, error) {
+	// parse xml into Cib struct
+	var cib Cib
+	err := unmarshalCib(ctx, cib_data, &cib)
+	if err != nil {
+		return nil, err
+	}
+
+	properties := make(map[string]string)
+	if cib.Configuration != nil && cib.Configuration.CrmConfig != nil {
+		for _, set := range cib.Configuration.CrmConfig.ClusterPropertySet {
+			for _, nvpair := range set.Nvpair {
+				if _, ok := properties[nvpair.Name]; !ok && nvpair.Name != "" {
+					properties[nvpair.Name] = nvpair.Value
+				}
+			}
+		}
+	}
+	return json.Marshal(properties)
+}
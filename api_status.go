@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+)
+
+// Status summary
+//
+// /api/v1/status is the state of the cluster for a
+// status page, without the configuration: each node
+// with its online, standby and maintenance flags, and
+// each primitive with its role and the node it runs
+// on, from the status section. A clone or a resource
+// that is running on several nodes has one entry per
+// node, and a stopped one a single entry without a
+// node. A CIB without nodes or resources simply gives
+// empty lists. Like the overview, it is rendered once
+// per CIB.
+
+type statusSummary struct {
+	Nodes     []nodeStatus      `json:"nodes"`
+	Resources []resourceSummary `json:"resources"`
+}
+
+type resourceSummary struct {
+	Id   string `json:"id"`
+	Role string `json:"role"`
+	Node string `json:"node,omitempty"`
+}
+
+// renderStatusSummary builds the status summary of a
+// CIB.
+func renderStatusSummary(xmldoc string) ([]byte, error) {
+	status, err := parseCibStatus(xmldoc)
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[string]map[string]string)
+	for _, ns := range status.NodeStates {
+		node := ns.Uname
+		if node == "" {
+			node = ns.Id
+		}
+		for i := range ns.Resources {
+			rsc := &ns.Resources[i]
+			role := rsc.role()
+			if role == "" {
+				continue
+			}
+			id := rsc.primitiveId()
+			if roles[id] == nil {
+				roles[id] = make(map[string]string)
+			}
+			if roles[id][node] != rolePromoted {
+				roles[id][node] = role
+			}
+		}
+	}
+	summary := statusSummary{
+		Nodes:     status.nodeStatuses(),
+		Resources: []resourceSummary{},
+	}
+	status.Resources.walkPrimitives(func(p *cibPrimitive, parent string) {
+		nodes := make([]string, 0, len(roles[p.Id]))
+		for node := range roles[p.Id] {
+			nodes = append(nodes, node)
+		}
+		if len(nodes) == 0 {
+			summary.Resources = append(summary.Resources, resourceSummary{Id: p.Id, Role: roleStopped})
+			return
+		}
+		sort.Strings(nodes)
+		for _, node := range nodes {
+			summary.Resources = append(summary.Resources, resourceSummary{Id: p.Id, Role: roles[p.Id][node], Node: node})
+		}
+	})
+	return json.Marshal(summary)
+}
+
+func (handler *routeHandler) serveStatusSummary(w http.ResponseWriter, snap cibSnapshot) bool {
+	if snap.xmldoc == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	data, err := handler.status.get(snap.xmldoc, snap.hash, renderStatusSummary)
+	if err != nil {
+		log.Errorf("Failed to render the status summary: %s", err)
+		httpJSONError(w, "Failed to render the status summary.", http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	w.Write([]byte("\n"))
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ticketStatus is the state of a booth / geo-cluster
+// ticket. LastGranted is nil if the ticket has never
+// been granted.
+type ticketStatus struct {
+	Id          string     `json:"id"`
+	Granted     bool       `json:"granted"`
+	Standby     bool       `json:"standby"`
+	LastGranted *time.Time `json:"last_granted"`
+}
+
+func handleApiTickets(w http.ResponseWriter, r *http.Request, cib_data string) bool {
+	if cib_data == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+
+	status, err := parseCibStatusContext(r.Context(), cib_data)
+	if err != nil {
+		return parseFailed(w, err)
+	}
+
+	tickets := make([]ticketStatus, 0, len(status.Tickets))
+	for _, t := range status.Tickets {
+		ticket := ticketStatus{
+			Id:      t.Id,
+			Granted: cibBoolean(t.Granted),
+			Standby: cibBoolean(t.Standby),
+		}
+		// last-granted is in seconds since the epoch
+		if secs, err := strconv.ParseInt(t.LastGranted, 10, 64); err == nil && secs > 0 {
+			lastGranted := time.Unix(secs, 0).UTC()
+			ticket.LastGranted = &lastGranted
+		}
+		tickets = append(tickets, ticket)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	jsonData, jsonError := json.Marshal(tickets)
+	if jsonError != nil {
+		log.Error(jsonError)
+		return false
+	}
+
+	io.WriteString(w, string(jsonData)+"\n")
+	return true
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+)
+
+// Topology
+//
+// /api/v1/topology returns the relationships between
+// resources and nodes as a graph, in the nodes / links
+// form used by graph renderers such as d3-force. Graph
+// node ids are prefixed with resource/ or node/, since
+// a resource may have the same name as a cluster node.
+// The links are:
+//
+// colocation: from rsc to with-rsc, the resource it is
+// placed relative to. Within a sequential resource
+// set, each member is colocated with the one before
+// it, and the members of a set with those of the next
+// set.
+//
+// order: from first to then. Within a sequential
+// resource set, each member comes before the next
+// one, and the members of a set before those of the
+// next set.
+//
+// member: a resource to the group, clone or bundle
+// containing it.
+//
+// placement: a primitive to each node it is running
+// on.
+//
+// Links referring to resources that aren't configured
+// are left out.
+
+type topologyNode struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Kind   string `json:"kind,omitempty"`
+	Online *bool  `json:"online,omitempty"`
+}
+
+type topologyLink struct {
+	Source     string `json:"source"`
+	Target     string `json:"target"`
+	Type       string `json:"type"`
+	Constraint string `json:"constraint,omitempty"`
+	Score      string `json:"score,omitempty"`
+}
+
+type topology struct {
+	Nodes []topologyNode `json:"nodes"`
+	Links []topologyLink `json:"links"`
+}
+
+type cibConstraintsDoc struct {
+	Constraints Constraints `xml:"configuration>constraints"`
+}
+
+func resourceNodeId(id string) string  { return "resource/" + id }
+func clusterNodeId(name string) string { return "node/" + name }
+
+// addResources adds the resources of tree and the
+// member links to their container.
+func (t *topology) addResources(tree *cibResourceTree, kind string, known map[string]bool) {
+	if tree.Id != "" {
+		t.Nodes = append(t.Nodes, topologyNode{Id: resourceNodeId(tree.Id), Name: tree.Id, Type: "resource", Kind: kind})
+		known[tree.Id] = true
+	}
+	member := func(id string) {
+		if tree.Id != "" {
+			t.Links = append(t.Links, topologyLink{Source: resourceNodeId(id), Target: resourceNodeId(tree.Id), Type: "member"})
+		}
+	}
+	for _, p := range tree.Primitives {
+		t.Nodes = append(t.Nodes, topologyNode{Id: resourceNodeId(p.Id), Name: p.Id, Type: "resource", Kind: "primitive"})
+		known[p.Id] = true
+		member(p.Id)
+	}
+	children := []struct {
+		kind  string
+		trees []cibResourceTree
+	}{
+		{"group", tree.Groups},
+		{"clone", tree.Clones},
+		{"master", tree.Masters},
+		{"bundle", tree.Bundles},
+	}
+	for _, c := range children {
+		for i := range c.trees {
+			t.addResources(&c.trees[i], c.kind, known)
+			member(c.trees[i].Id)
+		}
+	}
+}
+
+// setLinks returns the links between the members of
+// the resource sets of a constraint.
+func setLinks(sets []*ResourceSet, linkType, id, score string) []topologyLink {
+	var links []topologyLink
+	link := func(source, target string) {
+		links = append(links, topologyLink{Source: source, Target: target, Type: linkType, Constraint: id, Score: score})
+	}
+	for i, set := range sets {
+		if set.Sequential != "false" {
+			for j := 1; j < len(set.ResourceRef); j++ {
+				if linkType == "order" {
+					link(set.ResourceRef[j-1].Id, set.ResourceRef[j].Id)
+				} else {
+					link(set.ResourceRef[j].Id, set.ResourceRef[j-1].Id)
+				}
+			}
+		}
+		if i+1 < len(sets) {
+			for _, a := range set.ResourceRef {
+				for _, b := range sets[i+1].ResourceRef {
+					link(a.Id, b.Id)
+				}
+			}
+		}
+	}
+	return links
+}
+
+func buildTopology(doc *cibStatusDoc, constraints *Constraints) *topology {
+	t := &topology{Nodes: []topologyNode{}, Links: []topologyLink{}}
+	known := make(map[string]bool)
+	t.addResources(&doc.Resources, "", known)
+
+	for _, n := range doc.nodeStatuses() {
+		online := n.Online
+		t.Nodes = append(t.Nodes, topologyNode{Id: clusterNodeId(n.Name), Name: n.Name, Type: "node", Online: &online})
+	}
+
+	var links []topologyLink
+	for _, c := range constraints.RscColocation {
+		if c.Rsc != "" {
+			links = append(links, topologyLink{Source: c.Rsc, Target: c.WithRsc, Type: "colocation", Constraint: c.Id, Score: c.Score})
+		}
+		links = append(links, setLinks(c.ResourceSet, "colocation", c.Id, c.Score)...)
+	}
+	for _, o := range constraints.RscOrder {
+		if o.First != "" {
+			links = append(links, topologyLink{Source: o.First, Target: o.Then, Type: "order", Constraint: o.Id, Score: o.Score})
+		}
+		links = append(links, setLinks(o.ResourceSet, "order", o.Id, o.Score)...)
+	}
+	for _, l := range links {
+		if known[l.Source] && known[l.Target] {
+			l.Source, l.Target = resourceNodeId(l.Source), resourceNodeId(l.Target)
+			t.Links = append(t.Links, l)
+		}
+	}
+
+	for _, ns := range doc.NodeStates {
+		node := ns.Uname
+		if node == "" {
+			node = ns.Id
+		}
+		for i := range ns.Resources {
+			rsc := &ns.Resources[i]
+			if id := rsc.primitiveId(); known[id] && rsc.running() {
+				t.Links = append(t.Links, topologyLink{Source: resourceNodeId(id), Target: clusterNodeId(node), Type: "placement"})
+			}
+		}
+	}
+	return t
+}
+
+func handleApiTopology(w http.ResponseWriter, r *http.Request, cib_data string) bool {
+	if cib_data == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+
+	status, err := parseCibStatusContext(r.Context(), cib_data)
+	if err != nil {
+		return parseFailed(w, err)
+	}
+	var doc cibConstraintsDoc
+	if err := unmarshalCib(r.Context(), cib_data, &doc); err != nil {
+		return parseFailed(w, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	jsonData, jsonError := json.Marshal(buildTopology(status, &doc.Constraints))
+	if jsonError != nil {
+		log.Error(jsonError)
+		return false
+	}
+
+	io.WriteString(w, string(jsonData)+"\n")
+	return true
+}
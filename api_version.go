@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"runtime"
+)
+
+// Version
+//
+// /api/v1/version reports the build of the server and
+// the schema versions of the CIB it is talking to, for
+// comparing deployments across a cluster. The cluster
+// fields are null until the first CIB has been read.
+
+// buildVersion is set at build time with
+// -ldflags "-X main.buildVersion=<version>".
+var buildVersion = "unknown"
+
+type versionInfo struct {
+	Version       string  `json:"version"`
+	GoVersion     string  `json:"go_version"`
+	ValidateWith  *string `json:"validate_with"`
+	CrmFeatureSet *string `json:"crm_feature_set"`
+}
+
+func handleApiVersion(w http.ResponseWriter, cib_data string) bool {
+	info := versionInfo{Version: buildVersion, GoVersion: runtime.Version()}
+	if cib_data != "" {
+		if v, ok := cibRootAttr(cib_data, "validate-with"); ok {
+			info.ValidateWith = &v
+		}
+		if v, ok := cibRootAttr(cib_data, "crm_feature_set"); ok {
+			info.CrmFeatureSet = &v
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	jsonData, jsonError := json.Marshal(info)
+	if jsonError != nil {
+		log.Error(jsonError)
+		return false
+	}
+
+	io.WriteString(w, string(jsonData)+"\n")
+	return true
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Negative auth cache
+//
+// Clients that keep retrying with the same bad
+// credentials would otherwise run hawk_chkpwd for
+// every attempt. Failed credentials are remembered for
+// a couple of seconds and rejected straight away
+// within that window. Credentials are keyed by an HMAC
+// with a per-process random key, so the cache never
+// holds anything that could be used to recover a
+// password, and the TTL is capped so that it can't be
+// turned into a lockout.
+
+const (
+	defaultAuthFailureTTL = 2
+	maxAuthFailureTTL     = 5 * time.Second
+)
+
+var authFailureCacheHits = newCounterVec("hawk_auth_failure_cache_hits_total",
+	"Authentication attempts rejected from the failed credentials cache.")
+
+type authFailureCache struct {
+	ttl      time.Duration
+	lock     sync.Mutex
+	key      []byte
+	failures map[string]time.Time
+}
+
+func newAuthFailureCache(ttl time.Duration) *authFailureCache {
+	if ttl > maxAuthFailureTTL {
+		ttl = maxAuthFailureTTL
+	}
+	key := randomKey()
+	if key == nil {
+		// without a secret key, don't cache at all
+		ttl = 0
+	}
+	return &authFailureCache{
+		ttl:      ttl,
+		key:      key,
+		failures: make(map[string]time.Time),
+	}
+}
+
+func (c *authFailureCache) credentialKey(user, pass string) string {
+	return credentialKey(c.key, user, pass)
+}
+
+// credentialKey returns the HMAC of the credentials
+// with key.
+func credentialKey(key []byte, user, pass string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(user))
+	mac.Write([]byte{0})
+	mac.Write([]byte(pass))
+	return string(mac.Sum(nil))
+}
+
+// randomKey returns a new secret key for credentialKey,
+// or nil if none could be generated.
+func randomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil
+	}
+	return key
+}
+
+// failed returns true if the credentials failed to
+// authenticate within the TTL.
+func (c *authFailureCache) failed(user, pass string) bool {
+	if c == nil || c.ttl <= 0 {
+		return false
+	}
+	k := c.credentialKey(user, pass)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expires, ok := c.failures[k]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(c.failures, k)
+		return false
+	}
+	authFailureCacheHits.inc()
+	return true
+}
+
+func (c *authFailureCache) add(user, pass string) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	k := c.credentialKey(user, pass)
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, expires := range c.failures {
+		if now.After(expires) {
+			delete(c.failures, key)
+		}
+	}
+	c.failures[k] = now.Add(c.ttl)
+}
+
+// Positive auth cache
+//
+// A dashboard polling the API with basic auth would
+// run hawk_chkpwd for every request. Credentials that
+// succeeded are remembered for auth_cache_ttl seconds
+// and accepted without checking them again, keyed the
+// same way as failures. A changed password or removed
+// user is only noticed once the entry expires, unless
+// an admin clears the user's entries with
+// POST /api/v1/admin/sessions/invalidate?user=<user>.
+
+const defaultAuthCacheTTL = 30
+
+var authCacheHits = newCounterVec("hawk_auth_cache_hits_total",
+	"Authentication attempts accepted from the successful credentials cache.")
+
+type authSuccessCache struct {
+	ttl       time.Duration
+	lock      sync.Mutex
+	key       []byte
+	successes map[string]time.Time
+	// users holds the keys of the entries of each user
+	users map[string]map[string]bool
+}
+
+func newAuthSuccessCache(ttl time.Duration) *authSuccessCache {
+	key := randomKey()
+	if key == nil {
+		ttl = 0
+	}
+	return &authSuccessCache{
+		ttl:       ttl,
+		key:       key,
+		successes: make(map[string]time.Time),
+		users:     make(map[string]map[string]bool),
+	}
+}
+
+// valid returns true if the credentials succeeded to
+// authenticate within the TTL.
+func (c *authSuccessCache) valid(user, pass string) bool {
+	if c == nil || c.ttl <= 0 {
+		return false
+	}
+	k := credentialKey(c.key, user, pass)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expires, ok := c.successes[k]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		c.remove(user, k)
+		return false
+	}
+	authCacheHits.inc()
+	return true
+}
+
+func (c *authSuccessCache) add(user, pass string) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	k := credentialKey(c.key, user, pass)
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for u, keys := range c.users {
+		for key := range keys {
+			if now.After(c.successes[key]) {
+				c.remove(u, key)
+			}
+		}
+	}
+	c.successes[k] = now.Add(c.ttl)
+	if c.users[user] == nil {
+		c.users[user] = make(map[string]bool)
+	}
+	c.users[user][k] = true
+}
+
+// remove drops the entry k of user. The lock must be
+// held.
+func (c *authSuccessCache) remove(user, k string) {
+	delete(c.successes, k)
+	delete(c.users[user], k)
+	if len(c.users[user]) == 0 {
+		delete(c.users, user)
+	}
+}
+
+// invalidate drops the entries of user, so that the
+// next request checks the credentials again, and
+// returns how many there were.
+func (c *authSuccessCache) invalidate(user string) int {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := len(c.users[user])
+	for k := range c.users[user] {
+		c.remove(user, k)
+	}
+	return n
+}
+
+// serveInvalidateSessions clears the cached
+// credentials of the user given as ?user=. Only admins
+// may use it.
+func (handler *routeHandler) serveInvalidateSessions(w http.ResponseWriter, r *http.Request, user string) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		httpJSONError(w, fmt.Sprintf("Method %s not allowed.", r.Method), http.StatusMethodNotAllowed)
+		return true
+	}
+	if !handler.auth.isAdmin(user) {
+		httpJSONError(w, "Admin access required.", http.StatusForbidden)
+		return true
+	}
+	target := r.URL.Query().Get("user")
+	if target == "" {
+		httpJSONError(w, "Missing user.", http.StatusBadRequest)
+		return true
+	}
+	data, err := json.Marshal(struct {
+		User    string `json:"user"`
+		Cleared int    `json:"cleared"`
+	}{target, handler.auth.successes.invalidate(target)})
+	if err != nil {
+		httpJSONError(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	io.WriteString(w, "\n")
+	return true
+}
+
+// checkBasicAuth checks the credentials with
+// hawk_chkpwd, unless they succeeded or failed very
+// recently. Timeouts aren't remembered as failures.
+func (auth *hawkAuth) checkBasicAuth(ctx context.Context, user, pass string) (bool, error) {
+	if auth.successes.valid(user, pass) {
+		return true, nil
+	}
+	if auth.failures.failed(user, pass) {
+		return false, nil
+	}
+	ctx, span := startSpan(ctx, "hawk_chkpwd")
+	ctx, cancel := auth.execContext(ctx)
+	valid, err := checkBasicAuth(ctx, user, pass)
+	cancel()
+	span.setAttr("auth.user", user)
+	span.setError(err)
+	span.finish()
+	if err != nil {
+		return false, err
+	}
+	if !valid {
+		auth.failures.add(user, pass)
+		return false, nil
+	}
+	auth.successes.add(user, pass)
+	return true, nil
+}
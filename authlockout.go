@@ -0,0 +1,176 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Failed authentication limits
+//
+// Each failed authentication attempt is counted against
+// the address of the client, as forwarded by a trusted
+// proxy. Once a client has failed auth_max_failures
+// times within auth_failure_window seconds, its
+// requests get 429 Too Many Requests without even
+// running hawk_chkpwd, until auth_lockout seconds have
+// passed. This keeps a single client from guessing
+// passwords or forking hawk_chkpwd without bounds. A
+// successful authentication clears the failures of the
+// client. Requests without any credentials aren't
+// counted as they don't run anything.
+//
+// It is off by default: a stale session cookie counts
+// as a failure on every request, so a dashboard left
+// polling with an expired session would lock out its
+// address within seconds, and with it every user
+// behind the same NAT or untrusted proxy.
+
+const (
+	defaultAuthMaxFailures   = 0
+	defaultAuthFailureWindow = 60
+	defaultAuthLockout       = 300
+)
+
+var authLockouts = newCounterVec("hawk_auth_lockouts_total",
+	"Clients locked out for failing authentication too many times.")
+
+type clientFailures struct {
+	count int
+	first time.Time
+	until time.Time
+}
+
+type clientAuthLimiter struct {
+	max      int
+	window   time.Duration
+	lockout  time.Duration
+	lock     sync.Mutex
+	failures map[string]*clientFailures
+	swept    time.Time
+	now      func() time.Time
+}
+
+// newClientAuthLimiter returns nil, limiting nothing,
+// if max is 0.
+func newClientAuthLimiter(max int, window, lockout time.Duration) *clientAuthLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &clientAuthLimiter{
+		max:      max,
+		window:   window,
+		lockout:  lockout,
+		failures: make(map[string]*clientFailures),
+		now:      time.Now,
+	}
+}
+
+// locked returns true and the time left if ip is
+// locked out.
+func (l *clientAuthLimiter) locked(ip string) (bool, time.Duration) {
+	if l == nil {
+		return false, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if f, ok := l.failures[ip]; ok {
+		if wait := f.until.Sub(l.now()); wait > 0 {
+			return true, wait
+		}
+	}
+	return false, 0
+}
+
+// fail counts a failed attempt from ip, locking it out
+// once it has failed too often.
+func (l *clientAuthLimiter) fail(ip string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	if now.Sub(l.swept) >= rateIdleSweep {
+		l.sweep(now)
+	}
+	f, ok := l.failures[ip]
+	if !ok || now.Sub(f.first) > l.window {
+		f = &clientFailures{first: now}
+		l.failures[ip] = f
+	}
+	f.count++
+	if f.count >= l.max && !f.until.After(now) {
+		f.until = now.Add(l.lockout)
+		authLockouts.inc()
+		log.Warnf("Locking out %s for %s after %d failed authentication attempts", ip, l.lockout, f.count)
+	}
+}
+
+// succeed forgets the failures of ip.
+func (l *clientAuthLimiter) succeed(ip string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.failures, ip)
+}
+
+// sweep forgets the clients whose window and lockout
+// are over. It must be called with the lock held.
+func (l *clientAuthLimiter) sweep(now time.Time) {
+	l.swept = now
+	for ip, f := range l.failures {
+		if now.Sub(f.first) > l.window && !f.until.After(now) {
+			delete(l.failures, ip)
+		}
+	}
+}
+
+// hasCredentials returns true if r carries basic auth,
+// a bearer token or a session cookie.
+func hasCredentials(r *http.Request) bool {
+	if _, _, ok := r.BasicAuth(); ok {
+		return true
+	}
+	if _, ok := bearerToken(r); ok {
+		return true
+	}
+	_, err := r.Cookie("hawk_remember_me_key")
+	return err == nil
+}
+
+// checkClientLockout responds with 429 and returns false
+// if the client of r is locked out.
+func (auth *hawkAuth) checkClientLockout(w http.ResponseWriter, r *http.Request) bool {
+	locked, wait := auth.lockouts.locked(auth.clientIP(r))
+	if !locked {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	httpJSONError(w, "Too many failed authentication attempts, try again later.", http.StatusTooManyRequests)
+	return false
+}
+
+// recordAuthResult updates the failures of the client
+// of r after an authentication attempt.
+func (auth *hawkAuth) recordAuthResult(r *http.Request, ok bool) {
+	if ok {
+		auth.lockouts.succeed(auth.clientIP(r))
+	} else if hasCredentials(r) {
+		auth.lockouts.fail(auth.clientIP(r))
+	}
+}
+
+// clientIP returns the address of the client of r,
+// taking forwarding headers from trusted proxies only.
+func (auth *hawkAuth) clientIP(r *http.Request) string {
+	if auth.proxies == nil {
+		return addrHost(r.RemoteAddr)
+	}
+	return auth.proxies.origin(r).ClientIP
+}
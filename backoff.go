@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff
+//
+// When Pacemaker is down on the whole cluster, the
+// servers on every node retry at once. The delay
+// between retries doubles from cibRetryBase up to
+// cibRetryMax, and is spread randomly over its upper
+// half so that the nodes drift apart.
+
+const (
+	cibRetryBase = time.Second
+	cibRetryMax  = time.Minute
+)
+
+type backoff struct {
+	base  time.Duration
+	max   time.Duration
+	delay time.Duration
+	rand  *rand.Rand
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	return &backoff{
+		base: base,
+		max:  max,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// next returns the delay before the next retry, between
+// half and all of the current delay, and doubles it.
+func (b *backoff) next() time.Duration {
+	if b.delay < b.base {
+		b.delay = b.base
+	}
+	delay := b.delay/2 + time.Duration(b.rand.Int63n(int64(b.delay/2)+1))
+	b.delay *= 2
+	if b.delay > b.max {
+		b.delay = b.max
+	}
+	return delay
+}
+
+// reset starts over from the base delay.
+func (b *backoff) reset() {
+	b.delay = 0
+}
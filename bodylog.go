@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Request body logging
+//
+// A debugging aid for diagnosing malformed client
+// requests: with -log-request-bodies, the start of
+// each request body is logged at debug level. Values
+// of fields that look like credentials are redacted,
+// but bodies can still contain sensitive data, so this
+// is off by default and should never be enabled in
+// production.
+
+const maxLoggedBodySize = 4096
+
+var (
+	sensitiveFields = `(?i:pass(?:wd|word)?|secret|token|key|auth|cookie|session)`
+	redactJSONKey   = regexp.MustCompile(`"[^"]*` + sensitiveFields + `[^"]*"\s*:\s*`)
+	redactForm      = regexp.MustCompile(`((?:^|&)[^=&]*` + sensitiveFields + `[^=&]*=)[^&]*`)
+)
+
+func redactBody(body []byte) []byte {
+	body = redactJSON(body)
+	return redactForm.ReplaceAll(body, []byte(`${1}[REDACTED]`))
+}
+
+// redactJSON replaces the value of each sensitive
+// field with "[REDACTED]", whatever its type. The body
+// may be cut off at maxLoggedBodySize, so a value
+// running to the end of it is redacted too.
+func redactJSON(body []byte) []byte {
+	var out []byte
+	for {
+		loc := redactJSONKey.FindIndex(body)
+		if loc == nil {
+			return append(out, body...)
+		}
+		out = append(out, body[:loc[1]]...)
+		body = body[loc[1]:]
+		if n := jsonValueLen(body); n > 0 {
+			out = append(out, `"[REDACTED]"`...)
+			body = body[n:]
+		}
+	}
+}
+
+// jsonValueLen returns the length of the JSON value at
+// the start of b, or of all of b if it is cut off.
+func jsonValueLen(b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	switch b[0] {
+	case '"':
+		for i := 1; i < len(b); i++ {
+			switch b[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1
+			}
+		}
+		return len(b)
+	case '{', '[':
+		depth := 0
+		inString := false
+		for i := 0; i < len(b); i++ {
+			switch c := b[i]; {
+			case inString && c == '\\':
+				i++
+			case c == '"':
+				inString = !inString
+			case inString:
+			case c == '{' || c == '[':
+				depth++
+			case c == '}' || c == ']':
+				if depth--; depth == 0 {
+					return i + 1
+				}
+			}
+		}
+		return len(b)
+	}
+	// a number or a literal
+	i := 0
+	for i < len(b) && strings.IndexByte(",}] \t\r\n", b[i]) < 0 {
+		i++
+	}
+	return i
+}
+
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+func NewBodyLogHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.ContentLength != 0 && log.GetLevel() >= log.DebugLevel {
+			head, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLoggedBodySize))
+			if err != nil {
+				log.Debugf("[body] %s %s: failed to read body: %s", r.Method, r.URL.Path, err)
+			}
+			truncated := ""
+			if r.ContentLength < 0 || r.ContentLength > int64(len(head)) {
+				truncated = " (truncated)"
+			}
+			log.Debugf("[body] %s %s%s: %s", r.Method, r.URL.Path, truncated, redactBody(head))
+			// hand the full body on to the real handler
+			r.Body = replayBody{
+				Reader: io.MultiReader(bytes.NewReader(head), r.Body),
+				Closer: r.Body,
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
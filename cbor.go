@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// CBOR
+//
+// For dashboards polling over slow links, the CIB can
+// be fetched as CBOR (RFC 8949) by asking for
+// application/cbor. The document is the one returned
+// by /api/v1/cib.json, which is much smaller than the
+// XML. Only the subset of CBOR needed to represent
+// JSON values is implemented.
+
+const cborContentType = "application/cbor"
+
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+)
+
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// encodeCBOR encodes a value as decoded by
+// encoding/json with UseNumber. Map keys are sorted so
+// that the encoding is deterministic.
+func encodeCBOR(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			if n >= 0 {
+				cborHead(buf, cborUint, uint64(n))
+			} else {
+				cborHead(buf, cborNegInt, uint64(-(n + 1)))
+			}
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xfb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		cborHead(buf, cborText, uint64(len(v)))
+		buf.WriteString(v)
+	case []interface{}:
+		cborHead(buf, cborArray, uint64(len(v)))
+		for _, item := range v {
+			if err := encodeCBOR(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		cborHead(buf, cborMap, uint64(len(v)))
+		for _, k := range keys {
+			cborHead(buf, cborText, uint64(len(k)))
+			buf.WriteString(k)
+			if err := encodeCBOR(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("can't encode %T as CBOR", value)
+	}
+	return nil
+}
+
+// acceptsCBOR returns true if the client asked for
+// CBOR explicitly; wildcards get the XML.
+func acceptsCBOR(r *http.Request) bool {
+	accepted, _ := parseEncodings(strings.ToLower(r.Header.Get("Accept")))
+	return accepted[cborContentType] > 0.0
+}
+
+// renderCBOR builds the CBOR document for a CIB.
+func renderCBOR(xmldoc string) ([]byte, error) {
+	js, err := renderCibJSON(xmldoc)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(js))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeCBOR(&buf, doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (handler *routeHandler) serveCibCBOR(w http.ResponseWriter, snap cibSnapshot) bool {
+	xmldoc, hash := snap.xmldoc, snap.hash
+	if xmldoc == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	data, err := handler.cbor.get(xmldoc, hash, renderCBOR)
+	if err != nil {
+		log.Errorf("Failed to encode CIB as CBOR: %s", err)
+		httpJSONError(w, "Failed to encode the CIB.", http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", cborContentType)
+	w.Header().Set("X-Cib-Hash", hash)
+	w.Write(data)
+	return true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Certificate reload
+//
+// Each listener presents its certificate through
+// tls.Config.GetCertificate, from a holder that is
+// swapped on SIGHUP with the pair found on disk, so
+// that certificates renewed by an ACME client are
+// picked up without a restart. If the new pair fails
+// to load, the error is reported and the old one kept.
+// The handshake happens once per connection, so the
+// connections already open, including streams, carry
+// on with the certificate they started with.
+
+type certHolder struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Value // *tls.Certificate
+}
+
+// newCertHolder loads the pair, retrying for up to
+// wait if it can't be loaded yet.
+func newCertHolder(certFile, keyFile string, wait time.Duration) (*certHolder, error) {
+	cert, err := loadKeyPair(certFile, keyFile, wait)
+	if err != nil {
+		return nil, err
+	}
+	h := &certHolder{certFile: certFile, keyFile: keyFile}
+	h.cert.Store(&cert)
+	return h, nil
+}
+
+func (h *certHolder) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return h.cert.Load().(*tls.Certificate), nil
+}
+
+// reload replaces the certificate with the pair on
+// disk, unless it fails to load.
+func (h *certHolder) reload() error {
+	cert, err := tls.LoadX509KeyPair(h.certFile, h.keyFile)
+	if err != nil {
+		return err
+	}
+	h.cert.Store(&cert)
+	return nil
+}
+
+// reloadCerts reloads each of the holders, and returns
+// the errors of those that failed.
+func reloadCerts(holders []*certHolder) error {
+	var failed []string
+	for _, h := range holders {
+		if err := h.reload(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", h.certFile, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("keeping the previous certificate (%s)", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CIB status parsing
+//
+// The generated structs in api_structs.go only cover
+// the configuration section. These are the minimal
+// structures needed to derive the runtime state of
+// the cluster from the status section.
+
+type cibNvpair struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type cibNodeConfig struct {
+	Id         string      `xml:"id,attr"`
+	Uname      string      `xml:"uname,attr"`
+	Attributes []cibNvpair `xml:"instance_attributes>nvpair"`
+}
+
+type cibNodeState struct {
+	Id         string           `xml:"id,attr"`
+	Uname      string           `xml:"uname,attr"`
+	InCcm      string           `xml:"in_ccm,attr"`
+	Crmd       string           `xml:"crmd,attr"`
+	Join       string           `xml:"join,attr"`
+	Attributes []cibNvpair      `xml:"transient_attributes>instance_attributes>nvpair"`
+	Resources  []cibLrmResource `xml:"lrm>lrm_resources>lrm_resource"`
+}
+
+// cibLrmResource is the operation history of a
+// resource on a node.
+type cibLrmResource struct {
+	Id  string        `xml:"id,attr"`
+	Ops []cibLrmRscOp `xml:"lrm_rsc_op"`
+}
+
+type cibLrmRscOp struct {
+	Operation     string `xml:"operation,attr"`
+	CallId        string `xml:"call-id,attr"`
+	RcCode        string `xml:"rc-code,attr"`
+	OpStatus      string `xml:"op-status,attr"`
+	TransitionKey string `xml:"transition-key,attr"`
+	LastRun       string `xml:"last-run,attr"`
+	LastRcChange  string `xml:"last-rc-change,attr"`
+}
+
+// changed returns the time the operation last ran or
+// changed its result, whichever is later.
+func (op *cibLrmRscOp) changed() time.Time {
+	var latest int64
+	for _, v := range []string{op.LastRun, op.LastRcChange} {
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil && secs > latest {
+			latest = secs
+		}
+	}
+	if latest == 0 {
+		return time.Time{}
+	}
+	return time.Unix(latest, 0).UTC()
+}
+
+type cibPrimitive struct {
+	Id       string `xml:"id,attr"`
+	Class    string `xml:"class,attr"`
+	Provider string `xml:"provider,attr"`
+	Type     string `xml:"type,attr"`
+}
+
+// cibResourceTree holds the configured primitives,
+// including those inside groups, clones and bundles.
+type cibResourceTree struct {
+	Id         string            `xml:"id,attr"`
+	Primitives []cibPrimitive    `xml:"primitive"`
+	Groups     []cibResourceTree `xml:"group"`
+	Clones     []cibResourceTree `xml:"clone"`
+	Masters    []cibResourceTree `xml:"master"`
+	Bundles    []cibResourceTree `xml:"bundle"`
+}
+
+type cibTicketState struct {
+	Id          string `xml:"id,attr"`
+	Granted     string `xml:"granted,attr"`
+	Standby     string `xml:"standby,attr"`
+	LastGranted string `xml:"last-granted,attr"`
+}
+
+type cibStatusDoc struct {
+	XMLName    xml.Name         `xml:"cib"`
+	Nodes      []cibNodeConfig  `xml:"configuration>nodes>node"`
+	Resources  cibResourceTree  `xml:"configuration>resources"`
+	NodeStates []cibNodeState   `xml:"status>node_state"`
+	Tickets    []cibTicketState `xml:"status>tickets>ticket_state"`
+}
+
+var cibRejected = newCounterVec("hawk_cib_rejected_documents_total",
+	"CIB documents rejected for not looking like a CIB.")
+
+// checkCibDocument detects documents that the CIB
+// query returns in an error state instead of a real
+// CIB: anything without a <cib> root element holding a
+// <configuration> section.
+func checkCibDocument(cib_data string) error {
+	decoder := xml.NewDecoder(strings.NewReader(cib_data))
+	depth := 0
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			if depth == 0 {
+				return fmt.Errorf("no <cib> root element (%v)", err)
+			}
+			return fmt.Errorf("no <configuration> section (%v)", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 && t.Name.Local != "cib" {
+				return fmt.Errorf("root element is <%s>, not <cib>", t.Name.Local)
+			}
+			if depth == 1 && t.Name.Local == "configuration" {
+				return nil
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				return fmt.Errorf("no <configuration> section")
+			}
+		}
+	}
+}
+
+// parseCibStatusContext is parseCibStatus, traced as
+// part of the request in ctx.
+func parseCibStatusContext(ctx context.Context, cib_data string) (*cibStatusDoc, error) {
+	var doc cibStatusDoc
+	if err := unmarshalCib(ctx, cib_data, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func parseCibStatus(cib_data string) (*cibStatusDoc, error) {
+	var doc cibStatusDoc
+	err := xml.Unmarshal([]byte(cib_data), &doc)
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// cibBoolean interprets a Pacemaker boolean value.
+func cibBoolean(value string) bool {
+	switch strings.ToLower(value) {
+	case "true", "on", "yes", "y", "1":
+		return true
+	}
+	return false
+}
+
+// cibMember interprets the in_ccm and crmd values,
+// which newer Pacemaker versions write as the time
+// the node joined rather than as a boolean.
+func cibMember(value string, member string) bool {
+	if value == member || cibBoolean(value) {
+		return true
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	return err == nil && n > 0
+}
+
+func nvpairValue(pairs []cibNvpair, name string) (string, bool) {
+	for _, p := range pairs {
+		if p.Name == name {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// hawkSessions returns the hawk sessions of each user
+// found in the transient node attributes, where attrd
+// stores them unless they are private.
+func (doc *cibStatusDoc) hawkSessions() map[string][]string {
+	sessions := make(map[string][]string)
+	for _, ns := range doc.NodeStates {
+		for _, p := range ns.Attributes {
+			if user := strings.TrimPrefix(p.Name, "hawk_session_"); user != p.Name && user != "" {
+				sessions[user] = append(sessions[user], p.Value)
+			}
+		}
+	}
+	return sessions
+}
+
+// nodeStatus is the runtime state of a cluster node.
+type nodeStatus struct {
+	Name        string `json:"name"`
+	Online      bool   `json:"online"`
+	Standby     bool   `json:"standby"`
+	Maintenance bool   `json:"maintenance"`
+	// Removed is set in change events for nodes which
+	// are no longer part of the CIB.
+	Removed bool `json:"removed,omitempty"`
+}
+
+// nodeStatuses returns the state of each configured
+// or known node, sorted by name. Transient attributes
+// in the status section override the configured ones.
+func (doc *cibStatusDoc) nodeStatuses() []nodeStatus {
+	nodes := make(map[string]*nodeStatus)
+	var names []string
+	get := func(id, uname string) *nodeStatus {
+		name := uname
+		if name == "" {
+			name = id
+		}
+		n, ok := nodes[name]
+		if !ok {
+			n = &nodeStatus{Name: name}
+			nodes[name] = n
+			names = append(names, name)
+		}
+		return n
+	}
+	for _, nc := range doc.Nodes {
+		n := get(nc.Id, nc.Uname)
+		if v, ok := nvpairValue(nc.Attributes, "standby"); ok {
+			n.Standby = cibBoolean(v)
+		}
+		if v, ok := nvpairValue(nc.Attributes, "maintenance"); ok {
+			n.Maintenance = cibBoolean(v)
+		}
+	}
+	for _, ns := range doc.NodeStates {
+		n := get(ns.Id, ns.Uname)
+		n.Online = cibMember(ns.InCcm, "true") && cibMember(ns.Crmd, "online") && ns.Join == "member"
+		if v, ok := nvpairValue(ns.Attributes, "standby"); ok {
+			n.Standby = cibBoolean(v)
+		}
+		if v, ok := nvpairValue(ns.Attributes, "maintenance"); ok {
+			n.Maintenance = cibBoolean(v)
+		}
+	}
+	sort.Strings(names)
+	statuses := make([]nodeStatus, 0, len(names))
+	for _, name := range names {
+		statuses = append(statuses, *nodes[name])
+	}
+	return statuses
+}
+
+// diffNodeStatuses returns the nodes whose state
+// differs between before and after, including nodes
+// that were removed.
+func diffNodeStatuses(before, after []nodeStatus) []nodeStatus {
+	old := make(map[string]nodeStatus, len(before))
+	for _, n := range before {
+		old[n.Name] = n
+	}
+	var changes []nodeStatus
+	for _, n := range after {
+		if prev, ok := old[n.Name]; !ok || prev != n {
+			changes = append(changes, n)
+		}
+		delete(old, n.Name)
+	}
+	for _, n := range before {
+		if _, ok := old[n.Name]; ok {
+			changes = append(changes, nodeStatus{Name: n.Name, Removed: true})
+		}
+	}
+	return changes
+}
+
+func (tree *cibResourceTree) primitiveIds(ids []string) []string {
+	for _, p := range tree.Primitives {
+		ids = append(ids, p.Id)
+	}
+	for _, children := range [][]cibResourceTree{tree.Groups, tree.Clones, tree.Masters, tree.Bundles} {
+		for i := range children {
+			ids = children[i].primitiveIds(ids)
+		}
+	}
+	return ids
+}
+
+// walkPrimitives calls fn for each primitive with the
+// id of the group, clone or bundle containing it, in
+// document order within each level.
+func (tree *cibResourceTree) walkPrimitives(fn func(p *cibPrimitive, parent string)) {
+	for i := range tree.Primitives {
+		fn(&tree.Primitives[i], tree.Id)
+	}
+	for _, children := range [][]cibResourceTree{tree.Groups, tree.Clones, tree.Masters, tree.Bundles} {
+		for i := range children {
+			children[i].walkPrimitives(fn)
+		}
+	}
+}
+
+// expectedRc returns the rc-code the operation was
+// expected to return, from its transition key
+// (action:transition:target-rc:uuid).
+func (op *cibLrmRscOp) expectedRc() string {
+	parts := strings.Split(op.TransitionKey, ":")
+	if len(parts) < 3 {
+		return "0"
+	}
+	return parts[2]
+}
+
+// failed returns true if the operation didn't
+// complete with the expected result. Pending
+// operations (op-status -1) haven't failed yet.
+func (op *cibLrmRscOp) failed() bool {
+	switch op.OpStatus {
+	case "-1":
+		return false
+	case "", "0":
+		return op.RcCode != op.expectedRc()
+	}
+	return true
+}
+
+// lastOp returns the operation with the highest call
+// id, or nil if there is none.
+func (rsc *cibLrmResource) lastOp() *cibLrmRscOp {
+	var last *cibLrmRscOp
+	lastCall := int64(-1)
+	for i := range rsc.Ops {
+		call, err := strconv.ParseInt(rsc.Ops[i].CallId, 10, 64)
+		if err == nil && call > lastCall {
+			last, lastCall = &rsc.Ops[i], call
+		}
+	}
+	return last
+}
+
+const (
+	roleStarted  = "Started"
+	rolePromoted = "Promoted"
+	roleStopped  = "Stopped"
+)
+
+// role returns the role the last recorded operation
+// left the resource in on the node, or "" if it isn't
+// running there.
+func (rsc *cibLrmResource) role() string {
+	last := rsc.lastOp()
+	if last == nil || (last.OpStatus != "" && last.OpStatus != "0") {
+		return ""
+	}
+	switch last.Operation {
+	case "stop", "migrate_to":
+		return ""
+	case "monitor":
+		// 0 is running, 8 is running as master
+		switch last.RcCode {
+		case "0":
+			return roleStarted
+		case "8":
+			return rolePromoted
+		}
+		return ""
+	}
+	if last.RcCode != "0" {
+		return ""
+	}
+	if last.Operation == "promote" {
+		return rolePromoted
+	}
+	return roleStarted
+}
+
+// running returns true if the last recorded
+// operation left the resource running on the node.
+func (rsc *cibLrmResource) running() bool {
+	return rsc.role() != ""
+}
+
+// primitiveId returns the id of the configured
+// primitive. Clone instances are recorded as rsc:N.
+func (rsc *cibLrmResource) primitiveId() string {
+	if colon := strings.LastIndex(rsc.Id, ":"); colon > 0 {
+		return rsc.Id[:colon]
+	}
+	return rsc.Id
+}
+
+// resourceSummary returns the number of configured
+// primitives, how many of them are running on some
+// node, and the number of failed operations.
+func (doc *cibStatusDoc) resourceSummary() (total, started, failed int) {
+	ids := doc.Resources.primitiveIds(nil)
+	running := make(map[string]bool)
+	for _, ns := range doc.NodeStates {
+		for i := range ns.Resources {
+			rsc := &ns.Resources[i]
+			for j := range rsc.Ops {
+				if rsc.Ops[j].failed() {
+					failed++
+				}
+			}
+			if rsc.running() {
+				running[rsc.primitiveId()] = true
+			}
+		}
+	}
+	for _, id := range ids {
+		if running[id] {
+			started++
+		}
+	}
+	return len(ids), started, failed
+}
+
+// resourceStatus is the runtime state of a primitive.
+type resourceStatus struct {
+	Id            string   `json:"id"`
+	Parent        string   `json:"parent"`
+	Class         string   `json:"class"`
+	Provider      string   `json:"provider"`
+	Type          string   `json:"type"`
+	RunningOn     []string `json:"running_on"`
+	FailedActions int      `json:"failed_actions"`
+}
+
+// resourceStatuses returns the state of each configured
+// primitive: where it is running, and its number of
+// failed operations.
+func (doc *cibStatusDoc) resourceStatuses() []resourceStatus {
+	runningOn := make(map[string][]string)
+	failed := make(map[string]int)
+	for _, ns := range doc.NodeStates {
+		node := ns.Uname
+		if node == "" {
+			node = ns.Id
+		}
+		for i := range ns.Resources {
+			rsc := &ns.Resources[i]
+			id := rsc.primitiveId()
+			for j := range rsc.Ops {
+				if rsc.Ops[j].failed() {
+					failed[id]++
+				}
+			}
+			if rsc.running() {
+				runningOn[id] = append(runningOn[id], node)
+			}
+		}
+	}
+	statuses := []resourceStatus{}
+	doc.Resources.walkPrimitives(func(p *cibPrimitive, parent string) {
+		nodes := runningOn[p.Id]
+		if nodes == nil {
+			nodes = []string{}
+		}
+		statuses = append(statuses, resourceStatus{
+			Id:            p.Id,
+			Parent:        parent,
+			Class:         p.Class,
+			Provider:      p.Provider,
+			Type:          p.Type,
+			RunningOn:     nodes,
+			FailedActions: failed[p.Id],
+		})
+	})
+	return statuses
+}
+
+var (
+	clusterNodes = newGaugeVec("hawk_cluster_nodes_total",
+		"Number of nodes in the cluster.")
+	clusterNodesOnline = newGaugeVec("hawk_cluster_nodes_online",
+		"Number of online cluster nodes.")
+	clusterResources = newGaugeVec("hawk_resources_total",
+		"Number of configured primitive resources.")
+	clusterResourcesStarted = newGaugeVec("hawk_resources_started",
+		"Number of primitive resources running on at least one node.")
+	clusterFailedActions = newGaugeVec("hawk_failed_actions_total",
+		"Number of failed resource operations in the CIB status.")
+)
+
+// updateClusterGauges sets the cluster state gauges
+// from a new CIB.
+func updateClusterGauges(doc *cibStatusDoc, nodes []nodeStatus) {
+	online := 0
+	for _, n := range nodes {
+		if n.Online {
+			online++
+		}
+	}
+	total, started, failed := doc.resourceSummary()
+	clusterNodes.set(float64(len(nodes)))
+	clusterNodesOnline.set(float64(online))
+	clusterResources.set(float64(total))
+	clusterResourcesStarted.set(float64(started))
+	clusterFailedActions.set(float64(failed))
+}
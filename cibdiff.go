@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// CIB diff
+//
+// POST /api/v1/cib/diff compares a CIB supplied by the
+// client with the live one, so that reconciliation
+// tools can check whether a proposed change matches
+// the current state. Elements are matched by the path
+// of id attributes leading to them (for example
+// node_state[1]/lrm[1]/lrm_resource[rsc1]), since
+// the same id can appear in several sections, and
+// compared by their attributes. Elements without an id
+// are only compared through their descendants.
+
+const maxDiffBodySize = 16 << 20
+
+type cibElement struct {
+	Element string `json:"element"`
+	Path    string `json:"path"`
+	attrs   map[string]string
+}
+
+type cibAttrChange struct {
+	Name   string  `json:"name"`
+	Client *string `json:"client"`
+	Server *string `json:"server"`
+}
+
+type cibChange struct {
+	Element    string          `json:"element"`
+	Path       string          `json:"path"`
+	Attributes []cibAttrChange `json:"attributes"`
+}
+
+type cibDiff struct {
+	Identical bool         `json:"identical"`
+	Added     []cibElement `json:"added"`
+	Removed   []cibElement `json:"removed"`
+	Changed   []cibChange  `json:"changed"`
+}
+
+// indexCibElements maps the path of each element with
+// an id to the element.
+func indexCibElements(r io.Reader) (map[string]*cibElement, error) {
+	elements := make(map[string]*cibElement)
+	decoder := xml.NewDecoder(r)
+	var stack []string
+	root := true
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if root && t.Name.Local != "cib" {
+				return nil, fmt.Errorf("root element is <%s>, not <cib>", t.Name.Local)
+			}
+			root = false
+			parent := ""
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+			}
+			path := parent
+			attrs := make(map[string]string, len(t.Attr))
+			id := ""
+			for _, a := range t.Attr {
+				attrs[a.Name.Local] = a.Value
+				if a.Name.Local == "id" {
+					id = a.Value
+				}
+			}
+			if id != "" {
+				path = fmt.Sprintf("%s[%s]", t.Name.Local, id)
+				if parent != "" {
+					path = parent + "/" + path
+				}
+				elements[path] = &cibElement{Element: t.Name.Local, Path: path, attrs: attrs}
+			}
+			stack = append(stack, path)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if root {
+		return nil, fmt.Errorf("no <cib> root element")
+	}
+	return elements, nil
+}
+
+// diffCibs returns what differs in server compared to
+// client.
+func diffCibs(client, server string) (*cibDiff, error) {
+	before, err := indexCibElements(strings.NewReader(client))
+	if err != nil {
+		return nil, err
+	}
+	after, err := indexCibElements(strings.NewReader(server))
+	if err != nil {
+		return nil, err
+	}
+	diff := &cibDiff{
+		Added:   []cibElement{},
+		Removed: []cibElement{},
+		Changed: []cibChange{},
+	}
+	for _, path := range sortedElementPaths(after) {
+		elem := after[path]
+		old, ok := before[path]
+		if !ok {
+			diff.Added = append(diff.Added, *elem)
+			continue
+		}
+		if changes := diffAttrs(old.attrs, elem.attrs); len(changes) > 0 {
+			diff.Changed = append(diff.Changed, cibChange{Element: elem.Element, Path: path, Attributes: changes})
+		}
+	}
+	for _, path := range sortedElementPaths(before) {
+		if _, ok := after[path]; !ok {
+			diff.Removed = append(diff.Removed, *before[path])
+		}
+	}
+	diff.Identical = len(diff.Added) == 0 && len(diff.Removed) == 0 && len(diff.Changed) == 0
+	return diff, nil
+}
+
+func sortedElementPaths(elements map[string]*cibElement) []string {
+	paths := make([]string, 0, len(elements))
+	for p := range elements {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func diffAttrs(client, server map[string]string) []cibAttrChange {
+	var names []string
+	for name := range client {
+		names = append(names, name)
+	}
+	for name := range server {
+		if _, ok := client[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var changes []cibAttrChange
+	for _, name := range names {
+		c, inClient := client[name]
+		s, inServer := server[name]
+		if inClient && inServer && c == s {
+			continue
+		}
+		change := cibAttrChange{Name: name}
+		if inClient {
+			change.Client = &c
+		}
+		if inServer {
+			change.Server = &s
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// serveCibDiff compares the CIB in the request body
+// with the current one. Only admins may use it.
+func (handler *routeHandler) serveCibDiff(w http.ResponseWriter, r *http.Request, user string) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		httpJSONError(w, fmt.Sprintf("Method %s not allowed.", r.Method), http.StatusMethodNotAllowed)
+		return true
+	}
+	if !handler.auth.isAdmin(user) {
+		httpJSONError(w, "Admin access required.", http.StatusForbidden)
+		return true
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxDiffBodySize))
+	if err != nil {
+		httpJSONError(w, fmt.Sprintf("Request body too large (at most %d bytes).", maxDiffBodySize), http.StatusRequestEntityTooLarge)
+		return true
+	}
+	xmldoc := handler.cib.Get()
+	if xmldoc == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	diff, err := diffCibs(string(body), xmldoc)
+	if err != nil {
+		httpJSONError(w, fmt.Sprintf("Invalid CIB: %v.", err), http.StatusBadRequest)
+		return true
+	}
+	data, err := json.Marshal(diff)
+	if err != nil {
+		httpJSONError(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	io.WriteString(w, "\n")
+	return true
+}
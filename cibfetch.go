@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"github.com/krig/go-pacemaker"
+	log "github.com/sirupsen/logrus"
+	"runtime/debug"
+	"time"
+)
+
+// CIB fetcher
+//
+// The fetcher connects to Pacemaker, queries the CIB
+// and subscribes to its updates, and starts over
+// whenever any of these fail. The pacemaker calls go
+// through cibConn, as Pacemaker may hand back an error
+// along with no document, or an update without one,
+// while it is flapping. Those are logged and retried.
+// A panic in the fetcher is recovered and the loop
+// restarted after a pause, rather than taking the
+// whole server down, and so is one in the update
+// callback, which forces a reconnect.
+
+var errNoCibDocument = errors.New("no CIB document")
+
+// cibDoc is a CIB document from Pacemaker.
+type cibDoc interface {
+	ToString() string
+	Version() *pacemaker.CibVersion
+}
+
+// cibConn is the connection to Pacemaker used by the
+// fetcher.
+type cibConn interface {
+	Query() (cibDoc, error)
+	// Subscribe calls fn for each CIB event, with a nil
+	// document for events that don't carry one.
+	Subscribe(fn func(event pacemaker.CibEvent, doc cibDoc)) error
+	Close()
+}
+
+// pacemakerConn is a cibConn to the local Pacemaker.
+type pacemakerConn struct {
+	cib *pacemaker.Cib
+}
+
+func openPacemakerConn() (cibConn, error) {
+	cib, err := pacemaker.OpenCib()
+	if err != nil {
+		return nil, err
+	}
+	if cib == nil {
+		return nil, errors.New("no CIB connection")
+	}
+	return &pacemakerConn{cib: cib}, nil
+}
+
+func (c *pacemakerConn) Query() (cibDoc, error) {
+	doc, err := c.cib.Query()
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, errNoCibDocument
+	}
+	return doc, nil
+}
+
+func (c *pacemakerConn) Subscribe(fn func(event pacemaker.CibEvent, doc cibDoc)) error {
+	_, err := c.cib.Subscribe(func(event pacemaker.CibEvent, doc *pacemaker.CibDocument) {
+		// don't pass on a typed nil
+		if doc == nil {
+			fn(event, nil)
+		} else {
+			fn(event, doc)
+		}
+	})
+	return err
+}
+
+func (c *pacemakerConn) Close() {
+	c.cib.Close()
+}
+
+// runFetcher runs the fetcher until the AsyncCib is
+// stopped, restarting it if it panics.
+func (acib *AsyncCib) runFetcher() {
+	for acib.fetchCib() {
+		if !acib.pause() {
+			return
+		}
+	}
+}
+
+// pause waits before retrying, and returns false if
+// the fetcher is stopped meanwhile.
+func (acib *AsyncCib) pause() bool {
+	select {
+	case <-acib.stop:
+		return false
+	case <-time.After(acib.retry.next()):
+		return true
+	}
+}
+
+// fetchCib keeps the CIB up to date until the AsyncCib
+// is stopped, and returns false then. It returns true
+// if it panicked.
+func (acib *AsyncCib) fetchCib() (panicked bool) {
+	var cib cibConn
+	defer func() {
+		if cib != nil {
+			cib.Close()
+		}
+		if r := recover(); r != nil {
+			cibFetchErrors.inc("panic")
+			log.Errorf("CIB fetcher panicked, restarting: %v\n%s", r, debug.Stack())
+			panicked = true
+		}
+	}()
+	open := acib.open
+	if open == nil {
+		open = openPacemakerConn
+	}
+	for {
+		var err error
+		cib, err = open()
+		if err != nil {
+			cib = nil
+			cibFetchErrors.inc("connect")
+			acib.errlog.Warnf("Failed to connect to Pacemaker: %s", err)
+			if !acib.pause() {
+				return false
+			}
+			continue
+		}
+		for cib != nil {
+			cibxml, err := cib.Query()
+			if err == nil && cibxml == nil {
+				err = errNoCibDocument
+			}
+			if err != nil {
+				cibFetchErrors.inc("query")
+				acib.errlog.Errorf("Failed to query CIB: %s", err)
+				// reconnect, the connection is likely gone
+				cib.Close()
+				cib = nil
+				if !acib.pause() {
+					return false
+				}
+				continue
+			}
+			if !acib.notifyNewCib(cibxml) {
+				// keep the last good CIB and query again
+				if !acib.pause() {
+					return false
+				}
+				continue
+			}
+
+			waiter := make(chan int, 1)
+			lost := func() {
+				select {
+				case waiter <- 1:
+				default:
+				}
+			}
+			err = cib.Subscribe(func(event pacemaker.CibEvent, doc cibDoc) {
+				defer func() {
+					if r := recover(); r != nil {
+						cibFetchErrors.inc("panic")
+						log.Errorf("CIB update panicked, reconnecting: %v\n%s", r, debug.Stack())
+						lost()
+					}
+				}()
+				if event != pacemaker.UpdateEvent {
+					log.Warnf("lost connection: %s\n", event)
+					lost()
+				} else if doc == nil {
+					cibFetchErrors.inc("update")
+					acib.errlog.Warnf("Ignoring CIB update without a document")
+				} else {
+					acib.notifyNewCib(doc)
+				}
+			})
+			if err != nil {
+				cibFetchErrors.inc("subscribe")
+				acib.errlog.Infof("Failed to subscribe: %s", err)
+				if !acib.pause() {
+					return false
+				}
+				continue
+			}
+			acib.retry.reset()
+			select {
+			case <-waiter:
+				// reconnect rather than reuse the lost connection
+				cib.Close()
+				cib = nil
+			case <-acib.stop:
+				return false
+			}
+		}
+	}
+}
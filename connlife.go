@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Connection lifetime
+//
+// Behind a load balancer, keep-alive connections stay
+// on the node they were first balanced to, even when
+// it is being drained. With max_connection_lifetime
+// set, a connection older than the limit is closed as
+// soon as it is idle, so that the client reconnects
+// and is balanced again. Requests in progress are
+// never interrupted: a streaming connection stays
+// active and is only closed once the stream ends and
+// the connection goes back to idle.
+
+var connLifetimeClosed = newCounterVec("hawk_connections_lifetime_closed_total",
+	"Keep-alive connections closed for exceeding the maximum lifetime.")
+
+type trackedConn struct {
+	created time.Time
+	idle    bool
+}
+
+type connLifetime struct {
+	max   time.Duration
+	lock  sync.Mutex
+	conns map[net.Conn]*trackedConn
+	now   func() time.Time
+}
+
+func newConnLifetime(max time.Duration) *connLifetime {
+	return &connLifetime{
+		max:   max,
+		conns: make(map[net.Conn]*trackedConn),
+		now:   time.Now,
+	}
+}
+
+// connState is installed as http.Server.ConnState.
+func (t *connLifetime) connState(c net.Conn, state http.ConnState) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch state {
+	case http.StateNew:
+		t.conns[c] = &trackedConn{created: t.now()}
+	case http.StateActive:
+		if tc, ok := t.conns[c]; ok {
+			tc.idle = false
+		}
+	case http.StateIdle:
+		if tc, ok := t.conns[c]; ok {
+			tc.idle = true
+			t.expire(c, tc)
+		}
+	case http.StateHijacked, http.StateClosed:
+		delete(t.conns, c)
+	}
+}
+
+// expire closes c if it is idle and too old. It must
+// be called with the lock held.
+func (t *connLifetime) expire(c net.Conn, tc *trackedConn) {
+	if tc.idle && t.now().Sub(tc.created) >= t.max {
+		delete(t.conns, c)
+		c.Close()
+		connLifetimeClosed.inc()
+	}
+}
+
+// sweep closes the idle connections that have exceeded
+// the lifetime since their last request.
+func (t *connLifetime) sweep() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for c, tc := range t.conns {
+		t.expire(c, tc)
+	}
+}
+
+// run sweeps the connections periodically, until done
+// is closed.
+func (t *connLifetime) run(done chan struct{}) {
+	interval := t.max / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			t.sweep()
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CORS
+//
+// With cors_origins set, frontends served from those
+// origins may call the API from the browser, with
+// cookies. Requests under /api/ from an allowed origin
+// get the Access-Control-Allow-* headers echoing their
+// origin, and preflight OPTIONS requests are answered
+// here, before authentication, since browsers send
+// them without credentials. Other origins simply get
+// no CORS headers, so that the browser blocks them.
+// Paths outside of /api/ are left alone.
+
+const (
+	corsAllowMethods  = "GET, POST, PUT, DELETE, OPTIONS"
+	corsAllowHeaders  = "Origin, Content-Type, Accept, Authorization, X-CSRF-Token, X-Requested-With"
+	corsExposeHeaders = "ETag, X-Cib-Hash, X-Cib-Num-Updates, X-Cib-Version, X-Cib-Epoch, X-Cib-Updated, Retry-After"
+	corsMaxAge        = "600"
+)
+
+// normalizeOrigin checks that origin is a scheme and
+// host, and returns it in lower case without a
+// trailing slash.
+func normalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return "", fmt.Errorf("Invalid CORS origin: %q (must be scheme://host[:port])", origin)
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+type corsHandler struct {
+	handler http.Handler
+	origins map[string]bool
+}
+
+// parseCORSOrigins returns the set of allowed origins.
+func parseCORSOrigins(origins []string) (map[string]bool, error) {
+	allowed := make(map[string]bool)
+	for _, o := range origins {
+		origin, err := normalizeOrigin(o)
+		if err != nil {
+			return nil, err
+		}
+		allowed[origin] = true
+	}
+	return allowed, nil
+}
+
+// NewCORSHandler wraps h, allowing the API to be
+// called from the origins returned by parseCORSOrigins.
+func NewCORSHandler(h http.Handler, origins map[string]bool) http.Handler {
+	return &corsHandler{handler: h, origins: origins}
+}
+
+func (handler *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isAPIPath(r.URL.Path) {
+		handler.handler.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	allowed := false
+	if origin != "" {
+		if o, err := normalizeOrigin(origin); err == nil {
+			allowed = handler.origins[o]
+		}
+	}
+	if allowed {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if allowed {
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+	}
+	handler.handler.ServeHTTP(w, r)
+}
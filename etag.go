@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CIB ETags
+//
+// The CIB endpoints send an ETag made from the hash of
+// the CIB, which AsyncCib computes once per update, and
+// the representation (XML, CBOR, a schema conversion or
+// an XPath query), so that pollers sending it back in
+// If-None-Match get an empty 304 Not Modified until the
+// CIB changes instead of downloading it again. The gzip
+// handler weakens the ETag of the responses it
+// compresses, and If-None-Match uses the weak
+// comparison anyway, so the same ETag matches whether
+// or not the client asked for gzip.
+
+// cibETag returns the ETag of the given representation
+// of the CIB with hash, or "" if there is no CIB.
+func cibETag(hash, variant string) string {
+	if hash == "" {
+		return ""
+	}
+	return fmt.Sprintf(`"%s-%s"`, hash, variant)
+}
+
+// etagMatch returns true if the If-None-Match header
+// value matches etag, using the weak comparison.
+func etagMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkETag sets the ETag header, and responds with 304
+// Not Modified and returns true if the request has a
+// matching If-None-Match.
+func checkETag(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatch(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// etagSafe returns true if s can go in an ETag as it
+// is.
+func etagSafe(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Reverse proxy awareness
+//
+// When Hawk sits behind a reverse proxy, the peer
+// address of the connection is the proxy, and the
+// scheme and host the client used are passed along in
+// the Forwarded header (RFC 7239) or the older
+// X-Forwarded-For/-Proto/-Host family. Since anyone
+// can send these headers, they are only honoured when
+// the immediate peer is one of the configured trusted
+// proxies.
+
+type proxyTrust struct {
+	nets []*net.IPNet
+}
+
+// newProxyTrust parses a list of IP addresses and/or
+// CIDR ranges. A nil or empty list trusts nobody.
+func newProxyTrust(proxies []string) (*proxyTrust, error) {
+	trust := &proxyTrust{}
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		trust.nets = append(trust.nets, ipnet)
+	}
+	return trust, nil
+}
+
+func (t *proxyTrust) trustsIP(ip net.IP) bool {
+	if t == nil || ip == nil {
+		return false
+	}
+	for _, n := range t.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trusts returns true if the given host or host:port
+// address belongs to a trusted proxy.
+func (t *proxyTrust) trusts(addr string) bool {
+	return t.trustsIP(net.ParseIP(addrHost(addr)))
+}
+
+// forwardedElement is a single hop of a Forwarded
+// header, or the equivalent X-Forwarded-* values.
+type forwardedElement struct {
+	For   string
+	Proto string
+	Host  string
+}
+
+// parseForwarded parses the value of a Forwarded
+// header into its comma-separated elements. Unknown
+// parameters are ignored, and quoted values are
+// unquoted.
+func parseForwarded(header string) []forwardedElement {
+	var elements []forwardedElement
+	for _, elem := range splitQuoted(header, ',') {
+		var fe forwardedElement
+		for _, pair := range splitQuoted(elem, ';') {
+			eq := strings.Index(pair, "=")
+			if eq < 0 {
+				continue
+			}
+			key := strings.ToLower(strings.TrimSpace(pair[:eq]))
+			value := unquote(strings.TrimSpace(pair[eq+1:]))
+			switch key {
+			case "for":
+				fe.For = addrHost(value)
+			case "proto":
+				fe.Proto = strings.ToLower(value)
+			case "host":
+				fe.Host = value
+			}
+		}
+		elements = append(elements, fe)
+	}
+	return elements
+}
+
+// splitQuoted splits s on sep, ignoring separators
+// inside double quotes.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+		s = strings.Replace(s, "\\\"", "\"", -1)
+		s = strings.Replace(s, "\\\\", "\\", -1)
+	}
+	return s
+}
+
+// addrHost removes an optional port and IPv6
+// brackets from an address.
+func addrHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// xForwardedElements builds the equivalent of a
+// Forwarded header from the X-Forwarded-* family.
+// Only X-Forwarded-For can list several hops, so
+// proto and host apply to whichever hop is chosen.
+func xForwardedElements(r *http.Request) []forwardedElement {
+	var elements []forwardedElement
+	for _, xff := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(xff, ",") {
+			elements = append(elements, forwardedElement{For: addrHost(strings.TrimSpace(hop))})
+		}
+	}
+	proto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto")))
+	host := strings.TrimSpace(r.Header.Get("X-Forwarded-Host"))
+	if len(elements) == 0 && (proto != "" || host != "") {
+		elements = append(elements, forwardedElement{})
+	}
+	for i := range elements {
+		elements[i].Proto = proto
+		elements[i].Host = host
+	}
+	return elements
+}
+
+// requestOrigin describes where a request really
+// came from, after taking trusted proxies into
+// account.
+type requestOrigin struct {
+	ClientIP string
+	Proto    string
+	Host     string
+	// Proxied is true when the values were taken
+	// from forwarding headers.
+	Proxied bool
+}
+
+// origin returns the client address, scheme and host
+// of the request. The precedence is:
+//
+//   - Forwarding headers are only read from trusted
+//     peers, and ignored from anyone else.
+//   - The Forwarded header is preferred over
+//     X-Forwarded-*, which are not looked at if it's
+//     present.
+//   - A value passed by the proxy overrides what the
+//     connection says, even if they conflict (a proxy
+//     talking TLS to us but saying the client used
+//     http), since the proxy knows how the client
+//     connected. Conflicts are logged.
+//   - Without forwarding headers, the connection
+//     itself is used.
+//
+// Hops are walked from the right, skipping trusted
+// proxies, so that a client can't inject a fake
+// address at the start of the list.
+func (t *proxyTrust) origin(r *http.Request) requestOrigin {
+	o := requestOrigin{
+		ClientIP: addrHost(r.RemoteAddr),
+		Proto:    "http",
+		Host:     r.Host,
+	}
+	if r.TLS != nil {
+		o.Proto = "https"
+	}
+	if !t.trusts(r.RemoteAddr) {
+		return o
+	}
+
+	var elements []forwardedElement
+	if fwd := r.Header["Forwarded"]; len(fwd) > 0 {
+		elements = parseForwarded(strings.Join(fwd, ","))
+	} else {
+		elements = xForwardedElements(r)
+	}
+	if len(elements) == 0 {
+		return o
+	}
+
+	hop := elements[0]
+	for i := len(elements) - 1; i >= 0; i-- {
+		hop = elements[i]
+		if !t.trusts(hop.For) {
+			break
+		}
+	}
+	o.Proxied = true
+	if hop.For != "" {
+		o.ClientIP = hop.For
+	}
+	if hop.Proto != "" {
+		if r.TLS != nil && hop.Proto != "https" {
+			log.Printf("Proxy %s forwarded proto %s over a TLS connection, trusting the proxy", r.RemoteAddr, hop.Proto)
+		}
+		o.Proto = hop.Proto
+	}
+	if hop.Host != "" {
+		o.Host = hop.Host
+	}
+	return o
+}
+
+// checkProxied is used in strict mode, to reject
+// requests that bypassed the proxies: those from an
+// untrusted peer, and those from a trusted proxy
+// without any forwarding headers.
+func (t *proxyTrust) checkProxied(r *http.Request) error {
+	if !t.trusts(r.RemoteAddr) {
+		return fmt.Errorf("direct connection from untrusted peer %s", r.RemoteAddr)
+	}
+	if len(r.Header["Forwarded"]) == 0 && len(r.Header["X-Forwarded-For"]) == 0 && len(r.Header["X-Forwarded-Proto"]) == 0 {
+		return fmt.Errorf("no forwarding headers from proxy %s", r.RemoteAddr)
+	}
+	return nil
+}
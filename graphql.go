@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// GraphQL
+//
+// A minimal, query-only GraphQL endpoint over the
+// derived API views, so that a client can fetch
+// exactly the parts of the nodes, resources,
+// constraints and cluster configuration it needs in
+// a single request. The schema follows the JSON of the
+// regular endpoints, with dashes in attribute names
+// written as underscores (id_ref for id-ref).
+//
+// Supported: anonymous and named queries, nested
+// selection sets and field aliases. Not supported:
+// mutations, subscriptions, arguments, variables and
+// fragments. An object field without a selection set
+// returns the whole object.
+
+var graphqlRoots = map[string]string{
+	"nodes":       "nodes",
+	"resources":   "resources",
+	"constraints": "constraints",
+	"cluster":     "cluster",
+}
+
+type gqlField struct {
+	alias      string
+	name       string
+	selections []gqlField
+}
+
+type gqlParser struct {
+	src string
+	pos int
+}
+
+func (p *gqlParser) skipIgnored() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		} else if c == ',' || unicode.IsSpace(rune(c)) {
+			p.pos++
+		} else {
+			return
+		}
+	}
+}
+
+func (p *gqlParser) peek() byte {
+	p.skipIgnored()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *gqlParser) expect(c byte) error {
+	if p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+func (p *gqlParser) name() (string, error) {
+	p.skipIgnored()
+	start := p.pos
+	for p.pos < len(p.src) && isNameChar(p.src[p.pos], p.pos == start) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a name")
+	}
+	return p.src[start:p.pos], nil
+}
+
+// parseDocument parses a single query operation.
+func (p *gqlParser) parseDocument() ([]gqlField, error) {
+	if p.peek() != '{' {
+		op, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if op != "query" {
+			return nil, fmt.Errorf("%s operations are not supported", op)
+		}
+		if isNameChar(p.peek(), true) {
+			if _, err := p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if p.peek() == '(' {
+			return nil, fmt.Errorf("variables are not supported")
+		}
+	}
+	fields, err := p.parseSelectionSet()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != 0 {
+		return nil, p.errorf("only a single operation is supported")
+	}
+	return fields, nil
+}
+
+func (p *gqlParser) parseSelectionSet() ([]gqlField, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	var fields []gqlField
+	for p.peek() != '}' {
+		if p.peek() == 0 {
+			return nil, p.errorf("unexpected end of query")
+		}
+		if strings.HasPrefix(p.src[p.pos:], "...") {
+			return nil, fmt.Errorf("fragments are not supported")
+		}
+		f, err := p.parseField()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	p.pos++
+	return fields, nil
+}
+
+func (p *gqlParser) parseField() (gqlField, error) {
+	var f gqlField
+	name, err := p.name()
+	if err != nil {
+		return f, err
+	}
+	f.alias, f.name = name, name
+	if p.peek() == ':' {
+		p.pos++
+		if f.name, err = p.name(); err != nil {
+			return f, err
+		}
+	}
+	switch p.peek() {
+	case '(':
+		return f, fmt.Errorf("arguments are not supported (field %s)", f.name)
+	case '@':
+		return f, fmt.Errorf("directives are not supported (field %s)", f.name)
+	case '{':
+		f.selections, err = p.parseSelectionSet()
+	}
+	return f, err
+}
+
+// lookupField finds a GraphQL field name in a JSON
+// object, mapping underscores to dashes if needed.
+func lookupField(obj map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := obj[name]; ok {
+		return v, true
+	}
+	v, ok := obj[strings.Replace(name, "_", "-", -1)]
+	return v, ok
+}
+
+// project applies a selection set to decoded JSON.
+// Fields that exist in the schema but aren't set in
+// this CIB (omitted from the JSON) resolve to null.
+func project(value interface{}, selections []gqlField, path string) (interface{}, error) {
+	if len(selections) == 0 {
+		return value, nil
+	}
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		result := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			projected, err := project(item, selections, path)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, projected)
+		}
+		return result, nil
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(selections))
+		for _, sel := range selections {
+			if sel.name == "__typename" {
+				result[sel.alias] = path
+				continue
+			}
+			field, _ := lookupField(v, sel.name)
+			projected, err := project(field, sel.selections, path+"."+sel.name)
+			if err != nil {
+				return nil, err
+			}
+			result[sel.alias] = projected
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("field %s is a scalar and can't have a selection set", path)
+}
+
+type graphqlRequest struct {
+	Query string `json:"query"`
+}
+
+func writeGraphQL(w http.ResponseWriter, code int, result map[string]interface{}) {
+	data, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
+
+func graphqlError(w http.ResponseWriter, code int, err error) {
+	writeGraphQL(w, code, map[string]interface{}{
+		"errors": []map[string]string{{"message": err.Error()}},
+	})
+}
+
+// serveGraphQL accepts the query either as a JSON
+// POST body or in the query parameter of a GET.
+func (handler *routeHandler) serveGraphQL(w http.ResponseWriter, r *http.Request) bool {
+	var req graphqlRequest
+	switch r.Method {
+	case "GET":
+		req.Query = r.URL.Query().Get("query")
+	case "POST":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			graphqlError(w, http.StatusBadRequest, err)
+			return true
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			graphqlError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+			return true
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		graphqlError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return true
+	}
+
+	parser := &gqlParser{src: req.Query}
+	fields, err := parser.parseDocument()
+	if err != nil {
+		graphqlError(w, http.StatusBadRequest, err)
+		return true
+	}
+	// every field is resolved from the same CIB, the
+	// one pinned with ?snapshot= if given
+	snap, ok := handler.pinnedCib(w, r)
+	if !ok {
+		return true
+	}
+
+	data := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		if f.name == "__typename" {
+			data[f.alias] = "Query"
+			continue
+		}
+		view, ok := graphqlRoots[f.name]
+		if !ok {
+			graphqlError(w, http.StatusBadRequest, fmt.Errorf("unknown field %s on Query", f.name))
+			return true
+		}
+		raw, err := handler.view(r.Context(), view, snap)
+		if err != nil {
+			graphqlError(w, http.StatusServiceUnavailable, err)
+			return true
+		}
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			graphqlError(w, http.StatusInternalServerError, err)
+			return true
+		}
+		if data[f.alias], err = project(value, f.selections, f.name); err != nil {
+			graphqlError(w, http.StatusBadRequest, err)
+			return true
+		}
+	}
+	writeGraphQL(w, http.StatusOK, map[string]interface{}{"data": data})
+	return true
+}
@@ -23,15 +23,21 @@ import (
 
 const (
 	// Only enable gzip compression if we have at least
-	// minSize bytes of data to compress
-	minSize = 512
+	// defaultMinSize bytes of data to compress
+	defaultMinSize = 1024
 )
 
 type GzipResponseWriter struct {
 	http.ResponseWriter
-	writer *gzip.Writer
-	code   int
-	buf    []byte
+	writer  *gzip.Writer
+	minSize int
+	level   int
+	code    int
+	buf     []byte
+	// plain is set once the response has been flushed
+	// before compression was started, after which
+	// writes go straight to the client.
+	plain bool
 }
 
 type codings map[string]float64
@@ -46,13 +52,42 @@ func (w *GzipResponseWriter) Write(b []byte) (int, error) {
 		n, err := w.writer.Write(b)
 		return n, err
 	}
+	if w.plain {
+		return w.ResponseWriter.Write(b)
+	}
+
+	// formats that are compressed already wouldn't
+	// shrink any further
+	if w.buf == nil && w.Header().Get("Content-Encoding") == "" && compressedType(w.Header().Get("Content-Type")) {
+		if err := w.startPlain(); err != nil {
+			return 0, err
+		}
+		return w.ResponseWriter.Write(b)
+	}
+
+	// if the handler told us the size, there is no
+	// need to buffer to make the decision
+	if w.buf == nil && w.Header().Get("Content-Encoding") == "" {
+		if cl, err := strconv.Atoi(w.Header().Get("Content-Length")); err == nil {
+			if cl < w.minSize {
+				if err := w.startPlain(); err != nil {
+					return 0, err
+				}
+				return w.ResponseWriter.Write(b)
+			}
+			if err := w.startGzip(); err != nil {
+				return 0, err
+			}
+			return w.writer.Write(b)
+		}
+	}
 
 	// save the data to be written later
 	w.buf = append(w.buf, b...)
 
 	// only enable compression if write is >= minSize
 	// and compression isn't already enabled
-	if w.Header().Get("Content-Encoding") == "" && len(w.buf) >= minSize {
+	if w.Header().Get("Content-Encoding") == "" && len(w.buf) >= w.minSize {
 		err := w.startGzip()
 		if err != nil {
 			return 0, err
@@ -67,6 +102,11 @@ func (w *GzipResponseWriter) startGzip() error {
 	// will fail to set the Content-Length header since its already set
 	// See: https://github.com/golang/go/issues/14975.
 	w.Header().Del("Content-Length")
+	// the compressed body isn't byte for byte the one a
+	// strong ETag stands for
+	if etag := w.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		w.Header().Set("ETag", "W/"+etag)
+	}
 	if w.code != 0 {
 		w.ResponseWriter.WriteHeader(w.code)
 	}
@@ -74,7 +114,11 @@ func (w *GzipResponseWriter) startGzip() error {
 	// Bytes written during ServeHTTP are redirected to this gzip writer
 	// before being written to the underlying response.
 	if w.writer == nil {
-		w.writer = gzip.NewWriter(nil)
+		gz, err := gzip.NewWriterLevel(nil, w.level)
+		if err != nil {
+			return err
+		}
+		w.writer = gz
 	}
 	w.writer.Reset(w.ResponseWriter)
 
@@ -91,24 +135,41 @@ func (w *GzipResponseWriter) startGzip() error {
 	return err
 }
 
+// startPlain writes out the saved response code and
+// buffered data uncompressed.
+func (w *GzipResponseWriter) startPlain() error {
+	w.plain = true
+	if w.code != 0 {
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+	if w.buf != nil {
+		_, err := w.ResponseWriter.Write(w.buf)
+		w.buf = nil
+		return err
+	}
+	return nil
+}
+
 func (w *GzipResponseWriter) WriteHeader(code int) {
+	if w.plain {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
 	// Just save the response code until close / actual write.
 	w.code = code
 }
 
 // Close the writer but keep it around for reuse.
 func (w *GzipResponseWriter) Close() error {
+	if w.plain {
+		return nil
+	}
 	if w.writer == nil {
 		// Gzip not trigged yet, write out regular response.
-		if w.code != 0 {
-			w.ResponseWriter.WriteHeader(w.code)
-		}
-		if w.buf != nil {
-			_, writeErr := w.ResponseWriter.Write(w.buf)
-			// Returns the error if any at write.
-			if writeErr != nil {
-				return fmt.Errorf("gziphandler: write to regular responseWriter at close gets error: %q", writeErr.Error())
-			}
+		writeErr := w.startPlain()
+		// Returns the error if any at write.
+		if writeErr != nil {
+			return fmt.Errorf("gziphandler: write to regular responseWriter at close gets error: %q", writeErr.Error())
 		}
 		return nil
 	}
@@ -119,9 +180,16 @@ func (w *GzipResponseWriter) Close() error {
 // Flush flushes the underlying *gzip.Writer and then the underlying
 // http.ResponseWriter if it is an http.Flusher. This makes GzipResponseWriter
 // an http.Flusher.
+//
+// Flushing before compression has started means the
+// handler is streaming, so the response is sent
+// uncompressed from then on rather than being held
+// back until minSize bytes have been written.
 func (w *GzipResponseWriter) Flush() {
 	if w.writer != nil {
 		w.writer.Flush()
+	} else if !w.plain {
+		w.startPlain()
 	}
 	if fw, ok := w.ResponseWriter.(http.Flusher); ok {
 		fw.Flush()
@@ -140,13 +208,25 @@ func (w *GzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 // verify Hijacker interface implementation
 var _ http.Hijacker = &GzipResponseWriter{}
 
-func NewGzipHandler(h http.Handler) http.Handler {
+// NewGzipHandler wraps h with gzip compression of
+// responses of at least minSize bytes, at the given
+// compression level. Smaller responses are sent as
+// they are, since compressing them costs more than it
+// saves, and so are responses in formats that are
+// compressed already. A minSize of 0 or less uses
+// defaultMinSize.
+func NewGzipHandler(h http.Handler, minSize, level int) http.Handler {
+	if minSize <= 0 {
+		minSize = defaultMinSize
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Accept-Encoding")
 
 		if acceptsGzip(r) {
 			gw := &GzipResponseWriter{
 				ResponseWriter: w,
+				minSize:        minSize,
+				level:          level,
 			}
 			defer gw.Close()
 
@@ -157,6 +237,38 @@ func NewGzipHandler(h http.Handler) http.Handler {
 	})
 }
 
+// checkGzipLevel returns an error unless level is
+// gzip.DefaultCompression or between gzip.BestSpeed
+// and gzip.BestCompression.
+func checkGzipLevel(level int) error {
+	if level != gzip.DefaultCompression && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+		return fmt.Errorf("Invalid gzip level %d (must be %d to %d, or %d for the default)", level, gzip.BestSpeed, gzip.BestCompression, gzip.DefaultCompression)
+	}
+	return nil
+}
+
+// compressedType returns true for the content types
+// of formats that are already compressed.
+func compressedType(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"),
+		strings.HasPrefix(mediaType, "audio/"),
+		strings.HasPrefix(mediaType, "video/"),
+		strings.HasPrefix(mediaType, "font/woff"):
+		return true
+	}
+	switch mediaType {
+	case "application/gzip", "application/x-gzip", "application/zip",
+		"application/x-bzip2", "application/x-xz", "application/zstd",
+		"application/font-woff":
+		return true
+	}
+	return false
+}
+
 // acceptsGzip returns true if the given HTTP request indicates that it will
 // accept a gzipped response.
 func acceptsGzip(r *http.Request) bool {
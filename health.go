@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// Health checks
+//
+// /health and /ready are probes for load balancers and
+// service managers, served without authentication.
+// /health answers 200 as long as the process is up.
+// /ready answers 200 once a CIB has been fetched from
+// Pacemaker, and 503 until then. Both only look at
+// in-memory state, so they can be polled every second.
+
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, "ok\n")
+}
+
+func (handler *routeHandler) serveReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if !handler.cib.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "no CIB yet\n")
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
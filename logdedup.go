@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// dedupLogger
+//
+// Collapses repeated identical log messages. The first
+// occurrence of a message is logged as usual; further
+// occurrences within the window are only counted, and
+// summarized when the window ends. During a sustained
+// failure this logs one line plus one summary per
+// window instead of a line every few seconds.
+//
+// A nil *dedupLogger or a zero window logs every
+// message.
+
+type dedupLogger struct {
+	window  time.Duration
+	lock    sync.Mutex
+	repeats map[string]int
+}
+
+func newDedupLogger(window time.Duration) *dedupLogger {
+	return &dedupLogger{
+		window:  window,
+		repeats: make(map[string]int),
+	}
+}
+
+func (d *dedupLogger) logf(level log.Level, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if d == nil || d.window <= 0 {
+		log.StandardLogger().Log(level, msg)
+		return
+	}
+
+	d.lock.Lock()
+	if _, seen := d.repeats[msg]; seen {
+		d.repeats[msg]++
+		d.lock.Unlock()
+		return
+	}
+	d.repeats[msg] = 0
+	d.lock.Unlock()
+
+	log.StandardLogger().Log(level, msg)
+	time.AfterFunc(d.window, func() {
+		d.lock.Lock()
+		n := d.repeats[msg]
+		delete(d.repeats, msg)
+		d.lock.Unlock()
+		if n > 0 {
+			log.StandardLogger().Logf(level, "%s (occurred %d times in the last %v)", msg, n+1, d.window)
+		}
+	})
+}
+
+func (d *dedupLogger) Errorf(format string, args ...interface{}) {
+	d.logf(log.ErrorLevel, format, args...)
+}
+
+func (d *dedupLogger) Warnf(format string, args ...interface{}) {
+	d.logf(log.WarnLevel, format, args...)
+}
+
+func (d *dedupLogger) Infof(format string, args ...interface{}) {
+	d.logf(log.InfoLevel, format, args...)
+}
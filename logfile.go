@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// logFile
+//
+// An io.Writer for the --logfile option that can be
+// reopened in place, so that the server keeps logging
+// to the right file after an external logrotate has
+// renamed it. Writes and the reopen are serialized
+// under the same lock, so no line is lost or split
+// between the old and the new file.
+
+type logFile struct {
+	path string
+	lock sync.Mutex
+	file *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{
+		path: path,
+		file: file,
+	}, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Write(p)
+}
+
+// Reopen opens the log file path again and swaps it
+// in. If the file can't be opened, logging continues
+// to the old file. Nothing is done while the path
+// still refers to the open file, so that reopening
+// repeatedly is harmless.
+func (l *logFile) Reopen() error {
+	l.lock.Lock()
+	current, err := l.file.Stat()
+	l.lock.Unlock()
+	if info, err2 := os.Stat(l.path); err == nil && err2 == nil && os.SameFile(current, info) {
+		return nil
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	old := l.file
+	l.file = file
+	l.lock.Unlock()
+	return old.Close()
+}
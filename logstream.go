@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log streaming
+//
+// All log output passes through a logBuffer, which
+// keeps the most recent lines in memory and copies
+// each new line to the clients connected to
+// /api/v1/admin/logs/stream. Nothing on the path from
+// Write to the stream may log: the line would be
+// delivered back to the stream and generate another.
+// Subscribers that can't keep up lose lines rather
+// than blocking the logger.
+
+const (
+	logBufferLines    = 500
+	maxLogSubscribers = 4
+)
+
+var errTooManyLogSubscribers = errors.New("Too many log stream subscribers.")
+
+type logBuffer struct {
+	out   io.Writer
+	lock  sync.Mutex
+	lines []string
+	next  int
+	subs  map[chan string]bool
+}
+
+func newLogBuffer(out io.Writer) *logBuffer {
+	return &logBuffer{
+		out:  out,
+		subs: make(map[chan string]bool),
+	}
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	n, err := b.out.Write(p)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		b.add(line)
+	}
+	return n, err
+}
+
+// add must be called with the lock held.
+func (b *logBuffer) add(line string) {
+	if len(b.lines) < logBufferLines {
+		b.lines = append(b.lines, line)
+	} else {
+		b.lines[b.next] = line
+		b.next = (b.next + 1) % logBufferLines
+	}
+	for ch := range b.subs {
+		select {
+		case ch <- line:
+		default:
+			streamDropped.inc("logs")
+		}
+	}
+}
+
+// subscribe returns a channel receiving new log
+// lines, and the lines currently in the buffer.
+func (b *logBuffer) subscribe() (chan string, []string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.subs) >= maxLogSubscribers {
+		return nil, nil, errTooManyLogSubscribers
+	}
+	ch := make(chan string, logBufferLines)
+	b.subs[ch] = true
+	backlog := make([]string, 0, len(b.lines))
+	backlog = append(backlog, b.lines[b.next:]...)
+	backlog = append(backlog, b.lines[:b.next]...)
+	return ch, backlog, nil
+}
+
+func (b *logBuffer) unsubscribe(ch chan string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.subs, ch)
+}
+
+// serveLogStream sends the buffered log lines followed
+// by new ones as "log" events. Only admins may use it.
+func (handler *routeHandler) serveLogStream(w http.ResponseWriter, r *http.Request, user string) bool {
+	if !handler.auth.isAdmin(user) {
+		httpJSONError(w, "Admin access required.", http.StatusForbidden)
+		return true
+	}
+	if handler.logs == nil {
+		httpJSONError(w, "Log streaming is not available.", http.StatusServiceUnavailable)
+		return true
+	}
+	lines, backlog, err := handler.logs.subscribe()
+	if err != nil {
+		httpJSONError(w, err.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	defer handler.logs.unsubscribe(lines)
+
+	flusher, ok := startEventStream(w)
+	if !ok {
+		return true
+	}
+	streamClients.add(1, "logs")
+	defer streamClients.add(-1, "logs")
+	for _, line := range backlog {
+		if writeEvent(w, flusher, "log", line) != nil {
+			return true
+		}
+	}
+
+	keepalive := time.NewTicker(sseKeepAlive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return true
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return true
+			}
+			flusher.Flush()
+		case line := <-lines:
+			if writeEvent(w, flusher, "log", line) != nil {
+				return true
+			}
+		}
+	}
+}
@@ -1,18 +1,22 @@
 package main
 
 import (
+	"compress/gzip"
 	"flag"
 	"fmt"
 	"github.com/krig/go-pacemaker"
 	log "github.com/sirupsen/logrus"
 	"io"
+	stdlog "log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,54 +33,81 @@ import (
 type AsyncCib struct {
 	xmldoc   string
 	version  *pacemaker.CibVersion
+	updated  time.Time
+	hash     string
 	lock     sync.Mutex
 	notifier chan chan string
+	// onUpdate, if set, is called with each new CIB
+	// document and its hash before any waiters are
+	// notified.
+	onUpdate func(xmldoc string, hash string)
+	// node states from the last CIB, and the
+	// subscribers to changes in them
+	nodes    []nodeStatus
+	nodeSubs map[chan nodeStatus]bool
+	// hawk sessions from the last CIB, for the cib
+	// cookie fallback
+	sessions map[string][]string
+	// subscribers to new CIB documents
+	cibSubs map[chan cibSnapshot]bool
+	// per-subscriber buffer and what to do when it
+	// fills up
+	streams streamPolicy
+	// errlog collapses the repeated errors logged
+	// while Pacemaker is unavailable
+	errlog *dedupLogger
+	// the most recent CIBs, for requests pinned to a
+	// snapshot
+	snapshots [cibSnapshots]cibSnapshot
+	next      int
+	// closed by Stop to end the fetcher
+	stop     chan struct{}
+	stopOnce sync.Once
+	// open connects to Pacemaker, openPacemakerConn if
+	// nil
+	open func() (cibConn, error)
+	// retry is the delay between attempts to fetch the
+	// CIB
+	retry *backoff
+}
+
+// cibSnapshots is the number of recent CIBs kept for
+// requests with ?snapshot=<hash>.
+const cibSnapshots = 8
+
+// cibSnapshot is a CIB version kept to serve requests
+// pinned to it.
+type cibSnapshot struct {
+	xmldoc  string
+	hash    string
+	version *pacemaker.CibVersion
+	updated time.Time
 }
 
 func (acib *AsyncCib) Start() {
 	if acib.notifier == nil {
 		acib.notifier = make(chan chan string)
 	}
-	cibFetcher := func() {
-		for {
-			cib, err := pacemaker.OpenCib()
-			if err != nil {
-				log.Warnf("Failed to connect to Pacemaker: %s", err)
-				time.Sleep(5 * time.Second)
-			}
-			for cib != nil {
-				func() {
-					cibxml, err := cib.Query()
-					if err != nil {
-						log.Errorf("Failed to query CIB: %s", err)
-					} else {
-						acib.notifyNewCib(cibxml)
-					}
-				}()
-
-				waiter := make(chan int)
-				_, err = cib.Subscribe(func(event pacemaker.CibEvent, doc *pacemaker.CibDocument) {
-					if event == pacemaker.UpdateEvent {
-						acib.notifyNewCib(doc)
-					} else {
-						log.Warnf("lost connection: %s\n", event)
-						waiter <- 1
-					}
-				})
-				if err != nil {
-					log.Infof("Failed to subscribe, rechecking every 5 seconds")
-					time.Sleep(5 * time.Second)
-				} else {
-					<-waiter
-				}
-			}
-		}
+	if acib.stop == nil {
+		acib.stop = make(chan struct{})
 	}
-
-	go cibFetcher()
+	if acib.retry == nil {
+		acib.retry = newBackoff(cibRetryBase, cibRetryMax)
+	}
+	go acib.runFetcher()
 	go pacemaker.Mainloop()
 }
 
+// Stop stops fetching the CIB and closes the connection
+// to Pacemaker. The last CIB stays available.
+func (acib *AsyncCib) Stop() {
+	acib.stopOnce.Do(func() {
+		if acib.stop != nil {
+			close(acib.stop)
+		}
+	})
+}
+
 func (acib *AsyncCib) Wait(timeout int, defval string) string {
 	requestChan := make(chan string)
 	select {
@@ -93,30 +124,245 @@ func (acib *AsyncCib) Get() string {
 	return acib.xmldoc
 }
 
+// Sessions returns the hawk sessions of user in the
+// last CIB.
+func (acib *AsyncCib) Sessions(user string) []string {
+	acib.lock.Lock()
+	defer acib.lock.Unlock()
+	return acib.sessions[user]
+}
+
 func (acib *AsyncCib) Version() *pacemaker.CibVersion {
 	acib.lock.Lock()
 	defer acib.lock.Unlock()
 	return acib.version
 }
 
-func (acib *AsyncCib) notifyNewCib(cibxml *pacemaker.CibDocument) {
+// Ready returns true once a CIB has been fetched.
+func (acib *AsyncCib) Ready() bool {
+	acib.lock.Lock()
+	defer acib.lock.Unlock()
+	return acib.xmldoc != ""
+}
+
+// Snapshot returns the current CIB along with its
+// hash.
+func (acib *AsyncCib) Snapshot() (string, string) {
+	acib.lock.Lock()
+	defer acib.lock.Unlock()
+	return acib.xmldoc, acib.hash
+}
+
+// Current returns the current CIB and its metadata,
+// read consistently.
+func (acib *AsyncCib) Current() cibSnapshot {
+	acib.lock.Lock()
+	defer acib.lock.Unlock()
+	return cibSnapshot{xmldoc: acib.xmldoc, hash: acib.hash, version: acib.version, updated: acib.updated}
+}
+
+// Pinned returns the recent CIB with the given hash, if
+// it is still kept.
+func (acib *AsyncCib) Pinned(hash string) (cibSnapshot, bool) {
+	acib.lock.Lock()
+	defer acib.lock.Unlock()
+	for _, snap := range acib.snapshots {
+		if snap.hash == hash && snap.xmldoc != "" {
+			return snap, true
+		}
+	}
+	return cibSnapshot{}, false
+}
+
+// Hash returns the hash of the current CIB, used by
+// long polling clients to tell whether it changed.
+func (acib *AsyncCib) Hash() string {
+	acib.lock.Lock()
+	defer acib.lock.Unlock()
+	return acib.hash
+}
+
+// Updated returns the time the current CIB was
+// received.
+func (acib *AsyncCib) Updated() time.Time {
+	acib.lock.Lock()
+	defer acib.lock.Unlock()
+	return acib.updated
+}
+
+// notifyNewCib replaces the current CIB, unless the
+// document is an error rather than a CIB, in which case
+// it returns false.
+func (acib *AsyncCib) notifyNewCib(cibxml cibDoc) bool {
+	if cibxml == nil {
+		return false
+	}
 	text := cibxml.ToString()
+	if err := checkCibDocument(text); err != nil {
+		cibRejected.inc()
+		acib.errlog.Warnf("Ignoring invalid CIB document: %s", err)
+		return false
+	}
 	version := cibxml.Version()
 	log.Infof("[CIB]: %v", version)
-	acib.lock.Lock()
-	acib.xmldoc = text
-	acib.version = version
-	acib.lock.Unlock()
+	var nodes []nodeStatus
+	var sessions map[string][]string
+	if status, err := parseCibStatus(text); err != nil {
+		log.Warnf("Failed to parse CIB status: %s", err)
+	} else {
+		nodes = status.nodeStatuses()
+		sessions = status.hawkSessions()
+		updateClusterGauges(status, nodes)
+	}
+	hash := cibHash(text)
+	acib.store(text, hash, version, nodes, sessions)
+	if acib.onUpdate != nil {
+		acib.onUpdate(text, hash)
+	}
 	// Notify anyone waiting
 Loop:
 	for {
 		select {
 		case clientchan := <-acib.notifier:
-			clientchan <- version.String()
+			if version != nil {
+				clientchan <- version.String()
+			} else {
+				clientchan <- ""
+			}
 		default:
 			break Loop
 		}
 	}
+	return true
+}
+
+// store makes text the current CIB and notifies the
+// subscribers. The lock is released with defer, so
+// that a panic recovered by the fetcher doesn't leave
+// it held.
+func (acib *AsyncCib) store(text string, hash string, version *pacemaker.CibVersion, nodes []nodeStatus, sessions map[string][]string) {
+	acib.lock.Lock()
+	defer acib.lock.Unlock()
+	acib.xmldoc = text
+	acib.version = version
+	acib.updated = time.Now()
+	atomic.StoreInt64(&lastCibUpdate, acib.updated.UnixNano())
+	acib.hash = hash
+	acib.sessions = sessions
+	acib.snapshots[acib.next] = cibSnapshot{xmldoc: text, hash: acib.hash, version: version, updated: acib.updated}
+	acib.next = (acib.next + 1) % cibSnapshots
+	acib.notifyNodeChanges(nodes)
+	acib.notifyCibSubscribers()
+}
+
+// SubscribeNodes returns a channel which receives the
+// state of each node whenever it changes, along with
+// the current state of all nodes.
+func (acib *AsyncCib) SubscribeNodes() (chan nodeStatus, []nodeStatus) {
+	acib.lock.Lock()
+	defer acib.lock.Unlock()
+	if acib.nodeSubs == nil {
+		acib.nodeSubs = make(map[chan nodeStatus]bool)
+	}
+	ch := make(chan nodeStatus, acib.streams.bufferSize())
+	acib.nodeSubs[ch] = true
+	current := make([]nodeStatus, len(acib.nodes))
+	copy(current, acib.nodes)
+	return ch, current
+}
+
+func (acib *AsyncCib) UnsubscribeNodes(ch chan nodeStatus) {
+	acib.lock.Lock()
+	defer acib.lock.Unlock()
+	delete(acib.nodeSubs, ch)
+}
+
+// Subscribe returns a channel which receives each new
+// CIB, along with the current one.
+func (acib *AsyncCib) Subscribe() (chan cibSnapshot, cibSnapshot) {
+	acib.lock.Lock()
+	defer acib.lock.Unlock()
+	if acib.cibSubs == nil {
+		acib.cibSubs = make(map[chan cibSnapshot]bool)
+	}
+	ch := make(chan cibSnapshot, acib.streams.bufferSize())
+	acib.cibSubs[ch] = true
+	return ch, cibSnapshot{xmldoc: acib.xmldoc, hash: acib.hash, version: acib.version, updated: acib.updated}
+}
+
+func (acib *AsyncCib) Unsubscribe(ch chan cibSnapshot) {
+	acib.lock.Lock()
+	defer acib.lock.Unlock()
+	delete(acib.cibSubs, ch)
+}
+
+// notifyCibSubscribers must be called with the lock
+// held. A subscriber that isn't keeping up is handled
+// according to the stream policy, as for the node
+// changes.
+func (acib *AsyncCib) notifyCibSubscribers() {
+	snap := cibSnapshot{xmldoc: acib.xmldoc, hash: acib.hash, version: acib.version, updated: acib.updated}
+	for ch := range acib.cibSubs {
+		select {
+		case ch <- snap:
+			continue
+		default:
+		}
+		if acib.streams.Disconnect {
+			log.Warnf("CIB subscriber is too slow, disconnecting")
+			streamDisconnects.inc("cib")
+			close(ch)
+			delete(acib.cibSubs, ch)
+			continue
+		}
+		// drop the oldest CIB to make room
+		select {
+		case <-ch:
+			streamDropped.inc("cib")
+		default:
+		}
+		select {
+		case ch <- snap:
+		default:
+			streamDropped.inc("cib")
+		}
+	}
+}
+
+// notifyNodeChanges must be called with the lock held.
+// A subscriber that isn't keeping up is handled
+// according to the stream policy rather than stalling
+// the CIB fetcher.
+func (acib *AsyncCib) notifyNodeChanges(nodes []nodeStatus) {
+	changes := diffNodeStatuses(acib.nodes, nodes)
+	acib.nodes = nodes
+	for _, change := range changes {
+		for ch := range acib.nodeSubs {
+			select {
+			case ch <- change:
+				continue
+			default:
+			}
+			if acib.streams.Disconnect {
+				log.Warnf("Node status subscriber is too slow, disconnecting")
+				streamDisconnects.inc("nodes")
+				close(ch)
+				delete(acib.nodeSubs, ch)
+				continue
+			}
+			// drop the oldest event to make room
+			select {
+			case <-ch:
+				streamDropped.inc("nodes")
+			default:
+			}
+			select {
+			case ch <- change:
+			default:
+				streamDropped.inc("nodes")
+			}
+		}
+	}
 }
 
 type Config struct {
@@ -125,7 +371,255 @@ type Config struct {
 	Key      string        `json:"key"`
 	Cert     string        `json:"cert"`
 	LogLevel string        `json:"loglevel"`
+	LogFile  string        `json:"logfile"`
 	Route    []ConfigRoute `json:"route"`
+	// LogRepeatWindow is the number of seconds during
+	// which repeated identical fetch errors are collapsed
+	// into a single summary. Zero disables this.
+	LogRepeatWindow int `json:"log_repeat_window"`
+	// ParseWorkers bounds the number of goroutines used
+	// to render the derived views after a CIB update.
+	// Zero means GOMAXPROCS.
+	ParseWorkers int `json:"parse_workers"`
+	// StreamBuffer is the number of events buffered for
+	// each streaming client.
+	StreamBuffer int `json:"stream_buffer"`
+	// StreamPolicy says what happens when a streaming
+	// client's buffer is full: drop-oldest or disconnect.
+	StreamPolicy string `json:"stream_policy"`
+	// GzipMinSize is the smallest response, in bytes,
+	// that is compressed.
+	GzipMinSize int `json:"gzip_min_size"`
+	// GzipLevel is the gzip compression level, from 1
+	// (fastest) to 9 (smallest), or -1 for the default.
+	GzipLevel int `json:"gzip_level"`
+	// Hostname is used to build redirect URLs for
+	// clients that don't send a Host header.
+	Hostname string `json:"hostname"`
+	// TrustedProxies lists the addresses or CIDR ranges
+	// whose forwarding headers are believed.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// ProxyStrict rejects requests that don't come
+	// through one of the TrustedProxies.
+	ProxyStrict bool `json:"proxy_strict"`
+	// TrustAuthHeader accepts the user identity passed
+	// by a trusted proxy in X-Authenticated-User.
+	TrustAuthHeader bool `json:"trust_auth_header"`
+	// LogRequestBodies logs the start of each request
+	// body at debug level, with credentials redacted.
+	LogRequestBodies bool `json:"log_request_bodies"`
+	// Listeners overrides listen and port to serve
+	// the API on several addresses.
+	Listeners []ConfigListener `json:"listeners"`
+	// Socket, SocketMode and PlainHTTP set up the
+	// default listener on a Unix domain socket, as in
+	// ConfigListener.
+	Socket     string `json:"socket"`
+	SocketMode string `json:"socket_mode"`
+	PlainHTTP  bool   `json:"plain_http"`
+	// WaitForCert is the number of seconds to keep
+	// retrying if the certificate can't be loaded.
+	WaitForCert int `json:"wait_for_cert"`
+	// NoRootHandler disables the routes for "/", so
+	// that only explicitly routed paths are served.
+	NoRootHandler bool `json:"no_root_handler"`
+	// AllowAmbiguousRequests disables the rejection of
+	// requests with an ambiguous body length.
+	AllowAmbiguousRequests bool `json:"allow_ambiguous_requests"`
+	// CacheTTL keeps the named views, in seconds,
+	// across CIB updates.
+	CacheTTL map[string]int `json:"cache_ttl"`
+	// AuthFailureTTL is the number of seconds failed
+	// credentials are rejected without checking them
+	// again, at most 5.
+	AuthFailureTTL int `json:"auth_failure_ttl"`
+	// AuthCacheTTL is the number of seconds successful
+	// credentials are accepted without checking them
+	// again (0 = off).
+	AuthCacheTTL int `json:"auth_cache_ttl"`
+	// AuthMaxFailures is the number of failed
+	// authentication attempts after which a client
+	// address is locked out for AuthLockout seconds, if
+	// they happen within AuthFailureWindow seconds (0 =
+	// never).
+	AuthMaxFailures   int `json:"auth_max_failures"`
+	AuthFailureWindow int `json:"auth_failure_window"`
+	AuthLockout       int `json:"auth_lockout"`
+	// AuthExecTimeout is the number of seconds after
+	// which hawk_chkpwd and attrd_updater are killed.
+	AuthExecTimeout int `json:"auth_exec_timeout"`
+	// AdminUsers may access the /admin endpoints.
+	AdminUsers []string `json:"admin_users"`
+	// SSRIndex renders the index of file routes from
+	// their index.tmpl with a summary of the cluster.
+	SSRIndex bool `json:"ssr_index"`
+	// MaxConnLifetime is the number of seconds after
+	// which idle keep-alive connections are closed
+	// (0 = never).
+	MaxConnLifetime int `json:"max_connection_lifetime"`
+	// PeekTimeout is the number of seconds a client
+	// has to send its first bytes, which are read to
+	// tell TLS from HTTP (0 = no limit).
+	PeekTimeout int `json:"peek_timeout"`
+	// OtelEndpoint is the OTLP/HTTP collector to export
+	// request traces to, such as http://localhost:4318.
+	OtelEndpoint string `json:"otel_endpoint"`
+	// CookieFallback is what to do with session
+	// cookies when attrd_updater is missing: basic
+	// (the default), reject or cib.
+	CookieFallback string `json:"cookie_fallback"`
+	// ParseConcurrency is the number of requests that
+	// may parse the CIB at the same time (0 =
+	// GOMAXPROCS), and ParseQueue the number that may
+	// wait for their turn.
+	ParseConcurrency int `json:"parse_concurrency"`
+	ParseQueue       int `json:"parse_queue"`
+	// ShutdownTimeout is the number of seconds to wait
+	// for requests in progress on SIGINT or SIGTERM.
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// UserRateLimit and AdminRateLimit limit the
+	// requests of each authenticated user, with the
+	// admin limit applying to the admin_users.
+	UserRateLimit  ConfigRateLimit `json:"user_rate_limit"`
+	AdminRateLimit ConfigRateLimit `json:"admin_rate_limit"`
+	// TLSMinVersion is the oldest TLS version accepted:
+	// 1.0, 1.1, 1.2 (the default) or 1.3.
+	TLSMinVersion string `json:"tls_min_version"`
+	// TLSCiphers are the names of the cipher suites to
+	// accept for TLS 1.2 and older, by default those
+	// considered secure by Go.
+	TLSCiphers []string `json:"tls_ciphers"`
+	// LogFormat is the format of the log and access
+	// log: text (the default) or json.
+	LogFormat string `json:"log_format"`
+	// CORSOrigins are the origins, such as
+	// https://dashboard.example.com, allowed to call the
+	// API from a browser.
+	CORSOrigins []string `json:"cors_origins"`
+	// DocRoot is a directory of static files to serve
+	// at /, after the configured routes.
+	DocRoot string `json:"docroot"`
+	// TokenFile lists the bearer tokens accepted by the
+	// API, one per line.
+	TokenFile string `json:"token_file"`
+}
+
+// ConfigListener is an address to serve on, with its
+// own TLS settings and access policy. Key and cert
+// default to the global ones.
+type ConfigListener struct {
+	Listen string `json:"listen"`
+	Port   int    `json:"port"`
+	Key    string `json:"key"`
+	Cert   string `json:"cert"`
+	// ClientCA enables mutual TLS: clients must
+	// present a certificate signed by one of these CAs.
+	ClientCA string `json:"client_ca"`
+	// Auth is the authentication policy: hawk (the
+	// default), basic or client-cert.
+	Auth string `json:"auth"`
+	// ReadOnly rejects anything but GET and HEAD.
+	ReadOnly bool `json:"read_only"`
+	// Paths limits the listener to these URL path
+	// prefixes. Empty serves everything.
+	Paths []string `json:"paths"`
+	// Socket is the path of a Unix domain socket to
+	// serve on instead of listen and port, created with
+	// SocketMode (octal, 0660 by default).
+	Socket     string `json:"socket"`
+	SocketMode string `json:"socket_mode"`
+	// PlainHTTP serves HTTP without TLS or redirect,
+	// only on a socket.
+	PlainHTTP bool `json:"plain_http"`
+}
+
+// addr returns the address to bind. IPv6 addresses may
+// be given with or without brackets.
+func (l *ConfigListener) addr() string {
+	if l.Socket != "" {
+		return "unix:" + l.Socket
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(l.Listen, "["), "]")
+	return net.JoinHostPort(host, strconv.Itoa(l.Port))
+}
+
+// url describes the listener bound to addr for the
+// startup message.
+func (l *ConfigListener) url(addr net.Addr) string {
+	scheme := "https"
+	if l.PlainHTTP {
+		scheme = "http"
+	}
+	if addr.Network() == "unix" {
+		return scheme + "+unix://" + addr.String()
+	}
+	return scheme + "://" + addr.String()
+}
+
+func (l *ConfigListener) servesPath(path string) bool {
+	if len(l.Paths) == 0 {
+		return true
+	}
+	for _, p := range l.Paths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerConfig returns the listeners to serve on,
+// with defaults filled in and policies checked.
+func listenerConfig(config *Config) ([]ConfigListener, error) {
+	listeners := config.Listeners
+	if len(listeners) == 0 {
+		listeners = []ConfigListener{{
+			Listen:     config.Listen,
+			Port:       config.Port,
+			Socket:     config.Socket,
+			SocketMode: config.SocketMode,
+			PlainHTTP:  config.PlainHTTP,
+		}}
+	}
+	for i := range listeners {
+		l := &listeners[i]
+		if l.Listen == "" {
+			l.Listen = "0.0.0.0"
+		}
+		if l.Socket != "" {
+			if l.SocketMode == "" {
+				l.SocketMode = defaultSocketMode
+			}
+			if _, err := parseSocketMode(l.SocketMode); err != nil {
+				return nil, fmt.Errorf("listener %s: %s", l.addr(), err)
+			}
+		} else if l.PlainHTTP {
+			return nil, fmt.Errorf("listener %s: plain_http requires a socket", l.addr())
+		} else if l.Port == 0 {
+			return nil, fmt.Errorf("listener %d: no port set", i)
+		}
+		if l.PlainHTTP && l.ClientCA != "" {
+			return nil, fmt.Errorf("listener %s: client_ca requires TLS", l.addr())
+		}
+		if l.Key == "" {
+			l.Key = config.Key
+		}
+		if l.Cert == "" {
+			l.Cert = config.Cert
+		}
+		switch l.Auth {
+		case "":
+			l.Auth = authHawk
+		case authHawk, authBasic:
+		case authClientCert:
+			if l.ClientCA == "" {
+				return nil, fmt.Errorf("listener %s: auth %s requires client_ca", l.addr(), l.Auth)
+			}
+		default:
+			return nil, fmt.Errorf("listener %s: unknown auth policy %q", l.addr(), l.Auth)
+		}
+	}
+	return listeners, nil
 }
 
 type ConfigRoute struct {
@@ -136,23 +630,59 @@ type ConfigRoute struct {
 
 type routeHandler struct {
 	cib      AsyncCib
+	views    *viewCache
+	schemas  schemaCache
+	cbor     renderCache
+	cibJSON  renderCache
+	overview renderCache
+	status   renderCache
+	xpath    xmlTreeCache
+	index    indexCache
+	auth     hawkAuth
+	logs     *logBuffer
 	config   *Config
 	proxies  map[*ConfigRoute]*ReverseProxy
 	proxymux sync.Mutex
 }
 
-func NewRouteHandler(config *Config) *routeHandler {
-	return &routeHandler{
+func NewRouteHandler(config *Config, ttls map[string]time.Duration) *routeHandler {
+	handler := &routeHandler{
+		views:   newViewCache(config.ParseWorkers, ttls),
 		config:  config,
 		proxies: make(map[*ConfigRoute]*ReverseProxy),
 	}
+	handler.cib.onUpdate = handler.views.update
+	handler.auth.sessions = handler.cib.Sessions
+	return handler
 }
 
 func (handler *routeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/metrics" {
+		metrics.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == "/health" {
+		serveHealth(w, r)
+		return
+	}
+	if r.URL.Path == "/ready" {
+		handler.serveReady(w, r)
+		return
+	}
+	apiPath := isAPIPath(r.URL.Path)
 	for _, route := range handler.config.Route {
 		if !strings.HasPrefix(r.URL.Path, route.Path) {
 			continue
 		}
+		// Paths under /api/ are never handed to the catch-all
+		// file or proxy routes, so that API clients get a JSON
+		// error rather than the dashboard HTML.
+		if apiPath && route.Handler != "api/v1" {
+			continue
+		}
+		if route.Path == "/" && handler.config.NoRootHandler {
+			continue
+		}
 		if route.Handler == "api/v1" {
 			if handler.serveAPI(w, r, &route) {
 				return
@@ -171,10 +701,23 @@ func (handler *routeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
+	if apiPath {
+		httpJSONError(w, fmt.Sprintf("No route for %v.", r.URL.Path), http.StatusNotFound)
+		return
+	}
+	if handler.config.NoRootHandler {
+		http.NotFound(w, r)
+		return
+	}
 	http.Error(w, fmt.Sprintf("Unmatched request: %v.", r.URL.Path), 500)
 	return
 }
 
+// isAPIPath returns true for any request path under /api/.
+func isAPIPath(path string) bool {
+	return path == "/api" || strings.HasPrefix(path, "/api/")
+}
+
 func (handler *routeHandler) proxyForRoute(route *ConfigRoute) *ReverseProxy {
 	handler.proxymux.Lock()
 	proxy, ok := handler.proxies[route]
@@ -197,36 +740,282 @@ func (handler *routeHandler) proxyForRoute(route *ConfigRoute) *ReverseProxy {
 
 func (handler *routeHandler) serveAPI(w http.ResponseWriter, r *http.Request, route *ConfigRoute) bool {
 	log.Debugf("[api/v1] %v", r.URL.Path)
-	if !checkHawkAuthMethods(r) {
+	if !handler.auth.checkClientLockout(w, r) {
+		authAttempts.inc("locked")
+		return true
+	}
+	user, ok, err := handler.auth.checkHawkAuthMethods(r)
+	if err == errAuthTimeout {
+		authAttempts.inc("timeout")
+		httpJSONError(w, err.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	handler.auth.recordAuthResult(r, ok)
+	if !ok {
+		authAttempts.inc("failure")
 		http.Error(w, "Unauthorized request.", 401)
 		return true
 	}
+	authAttempts.inc("success")
+	if !handler.auth.checkRateLimit(w, user) {
+		return true
+	}
+	if r.URL.Path == route.Path+"/graphql" {
+		return handler.serveGraphQL(w, r)
+	}
+	if r.URL.Path == route.Path+"/cib/diff" {
+		return handler.serveCibDiff(w, r, user)
+	}
+	if r.URL.Path == route.Path+"/admin/sessions/invalidate" {
+		return handler.serveInvalidateSessions(w, r, user)
+	}
 	if r.Method == "GET" {
+		snap, ok := handler.pinnedCib(w, r)
+		if !ok {
+			return true
+		}
+		if handler.checkNumUpdates(w, r, snap) {
+			return true
+		}
 		prefix := route.Path + "/configuration/"
-		match, _ := regexp.MatchString(prefix + "nodes(/?|/[a-zA-Z0-9]+/?)$", r.URL.Path)
+		match, _ := regexp.MatchString(prefix+"(nodes|resources|cluster|constraints)/?$", r.URL.Path)
+		if match && handler.serveCachedView(w, r, prefix, snap.hash) {
+			return true
+		}
+		match, _ = regexp.MatchString(prefix+"nodes(/?|/[a-zA-Z0-9]+/?)$", r.URL.Path)
 		if match {
-			return handleApiNodes(w, r, handler.cib.Get())
+			return handleApiNodes(w, r, snap.xmldoc)
 		}
-		match, _ = regexp.MatchString(prefix + "resources(/?|/[a-zA-Z0-9]+/?)$", r.URL.Path)
+		match, _ = regexp.MatchString(prefix+"resources(/?|/[a-zA-Z0-9]+/?)$", r.URL.Path)
 		if match {
-			return handleApiResources(w, r, handler.cib.Get())
+			return handleApiResources(w, r, snap.xmldoc)
 		}
-		match, _ = regexp.MatchString(prefix + "cluster/?$", r.URL.Path)
+		match, _ = regexp.MatchString(prefix+"cluster/?$", r.URL.Path)
 		if match {
-			return handleApiCluster(w, r, handler.cib.Get())
+			return handleApiCluster(w, r, snap.xmldoc)
 		}
-		match, _ = regexp.MatchString(prefix + "constraints(/?|/[a-zA-Z0-9]+/?)$", r.URL.Path)
+		match, _ = regexp.MatchString(prefix+"constraints(/?|/[a-zA-Z0-9]+/?)$", r.URL.Path)
 		if match {
-			return handleApiConstraints(w, r, handler.cib.Get())
+			return handleApiConstraints(w, r, snap.xmldoc)
+		}
+		if r.URL.Path == route.Path+"/properties" {
+			if handler.serveView(w, r, "properties", snap.hash) {
+				return true
+			}
+			return handleApiProperties(w, r, snap.xmldoc)
+		}
+		if r.URL.Path == route.Path+"/resources" {
+			return handleApiResourceActivity(w, r, snap.xmldoc)
+		}
+		if r.URL.Path == route.Path+"/nodes.csv" {
+			return handleApiNodesCSV(w, r, snap.xmldoc)
+		}
+		if r.URL.Path == route.Path+"/resources.csv" {
+			return handleApiResourcesCSV(w, r, snap.xmldoc)
+		}
+		if r.URL.Path == route.Path+"/cib.json" {
+			return handler.serveCibJSON(w, snap)
+		}
+		if r.URL.Path == route.Path+"/version" {
+			return handleApiVersion(w, snap.xmldoc)
+		}
+		if r.URL.Path == route.Path+"/overview" {
+			return handler.serveOverview(w, snap)
+		}
+		if r.URL.Path == route.Path+"/status" {
+			return handler.serveStatusSummary(w, snap)
+		}
+		if r.URL.Path == route.Path+"/topology" {
+			return handleApiTopology(w, r, snap.xmldoc)
+		}
+		if r.URL.Path == route.Path+"/tickets" {
+			return handleApiTickets(w, r, snap.xmldoc)
+		}
+		if node := strings.TrimPrefix(r.URL.Path, route.Path+"/nodes/"); node != r.URL.Path && strings.HasSuffix(node, "/attributes") {
+			return handleApiNodeAttributes(w, r, snap.xmldoc, strings.TrimSuffix(node, "/attributes"))
+		}
+		if r.URL.Path == route.Path+"/nodes/stream" {
+			return handler.serveNodeStream(w, r)
+		}
+		if r.URL.Path == route.Path+"/cib/stream" {
+			return handler.serveCibStream(w, r)
 		}
-		if strings.HasPrefix(r.URL.Path, prefix + "cib.xml") {
-			xmldoc := handler.cib.Get()
+		if r.URL.Path == route.Path+"/cib/poll" {
+			return handler.servePoll(w, r)
+		}
+		if r.URL.Path == route.Path+"/admin/logs/stream" {
+			return handler.serveLogStream(w, r, user)
+		}
+		if r.URL.Path == route.Path+"/cib" || strings.HasPrefix(r.URL.Path, prefix+"cib.xml") {
+			schema := r.URL.Query().Get("schema")
+			if expr := r.URL.Query().Get("xpath"); expr != "" {
+				if schema != "" {
+					httpJSONError(w, "xpath and schema can't be combined.", http.StatusBadRequest)
+					return true
+				}
+				if checkETag(w, r, cibETag(snap.hash, "xpath-"+cibHash(expr)[:16])) {
+					return true
+				}
+				return handler.serveCibXPath(w, r, snap, expr)
+			}
+			w.Header().Add("Vary", "Accept")
+			variant := "xml"
+			if schema != "" {
+				variant = "schema-" + schema
+			} else if acceptsCBOR(r) {
+				variant = "cbor"
+			}
+			if etagSafe(variant) && checkETag(w, r, cibETag(snap.hash, variant)) {
+				return true
+			}
+			if variant == "cbor" {
+				return handler.serveCibCBOR(w, snap)
+			}
+			xmldoc := snap.xmldoc
+			if schema != "" {
+				converted, err := handler.schemas.convert(r.Context(), xmldoc, snap.hash, schema)
+				if err == errSchemaUnsupported {
+					httpJSONError(w, fmt.Sprintf("Can't convert the CIB to schema %v.", schema), http.StatusConflict)
+					return true
+				}
+				if err == errParseQueueFull {
+					return parseFailed(w, err)
+				}
+				if err != nil {
+					log.Errorf("Failed to convert CIB to schema %v: %s", schema, err)
+					httpJSONError(w, fmt.Sprintf("Failed to convert the CIB to schema %v.", schema), http.StatusInternalServerError)
+					return true
+				}
+				xmldoc = converted
+			}
 			w.Header().Set("Content-Type", "application/xml")
+			w.Header().Set("Trailer", strings.Join(cibTrailers, ", "))
 			io.WriteString(w, xmldoc)
+			handler.writeCibTrailers(w, snap.version, snap.updated)
 			return true
 		}
 	}
-	http.Error(w, fmt.Sprintf("[api/v1]: No route for %v.", r.URL.Path), 500)
+	httpJSONError(w, fmt.Sprintf("[api/v1]: No route for %v.", r.URL.Path), http.StatusNotFound)
+	return true
+}
+
+// pinnedCib returns the CIB to serve a GET request
+// from: the one named by ?snapshot=<hash> if given,
+// otherwise the current one, and sets X-Cib-Hash so
+// that clients can pin their next requests to it. If
+// the snapshot is no longer kept, it responds with 409
+// Conflict and returns false.
+func (handler *routeHandler) pinnedCib(w http.ResponseWriter, r *http.Request) (snap cibSnapshot, ok bool) {
+	snap = handler.cib.Current()
+	if hash := r.URL.Query().Get("snapshot"); hash != "" && hash != snap.hash {
+		snap, ok = handler.cib.Pinned(hash)
+		if !ok {
+			httpJSONError(w, fmt.Sprintf("Snapshot %v is no longer available.", hash), http.StatusConflict)
+			return snap, false
+		}
+	}
+	if snap.hash != "" {
+		w.Header().Set("X-Cib-Hash", snap.hash)
+	}
+	return snap, true
+}
+
+// cibTrailers are sent after the body of cib.xml, so
+// that clients streaming a large CIB get its metadata
+// without buffering it or making another request.
+var cibTrailers = []string{"X-Cib-Epoch", "X-Cib-Updated", "X-Cluster-Name"}
+
+// writeCibTrailers sets the trailer values. They use
+// http.TrailerPrefix, so that they end up in the
+// trailer even if the gzip handler buffered the whole
+// body and hasn't sent the headers yet.
+func (handler *routeHandler) writeCibTrailers(w http.ResponseWriter, ver *pacemaker.CibVersion, updated time.Time) {
+	if ver != nil {
+		w.Header().Set(http.TrailerPrefix+"X-Cib-Epoch", strconv.Itoa(int(ver.Epoch)))
+	}
+	if !updated.IsZero() {
+		w.Header().Set(http.TrailerPrefix+"X-Cib-Updated", updated.UTC().Format(time.RFC3339))
+	}
+	if name := handler.clusterName(); name != "" {
+		w.Header().Set(http.TrailerPrefix+"X-Cluster-Name", name)
+	}
+}
+
+// checkNumUpdates sets the X-Cib-Num-Updates and
+// X-Cib-Version headers from the CIB of snap, and
+// handles the since_num_updates conditional: if that
+// CIB has the given admin_epoch and epoch, and its
+// num_updates counter isn't greater than the given
+// one, it responds with 304 Not Modified and returns
+// true. The whole version is compared as Pacemaker
+// resets num_updates whenever the epoch changes.
+func (handler *routeHandler) checkNumUpdates(w http.ResponseWriter, r *http.Request, snap cibSnapshot) bool {
+	ver := snap.version
+	if ver != nil {
+		w.Header().Set("X-Cib-Num-Updates", strconv.Itoa(int(ver.NumUpdates)))
+		w.Header().Set("X-Cib-Version", formatCibVersion(ver))
+	}
+	since := r.URL.Query().Get("since_num_updates")
+	if since == "" {
+		return false
+	}
+	client, err := parseCibVersion(since)
+	if err != nil {
+		httpJSONError(w, fmt.Sprintf("Invalid since_num_updates: %v (must be num_updates, or admin_epoch.epoch.num_updates as in X-Cib-Version).", since), http.StatusBadRequest)
+		return true
+	}
+	if client.AdminEpoch < 0 && ver != nil {
+		// a bare counter is taken to be of the current
+		// epoch
+		client.AdminEpoch, client.Epoch = ver.AdminEpoch, ver.Epoch
+	}
+	if ver != nil && ver.AdminEpoch == client.AdminEpoch && ver.Epoch == client.Epoch && ver.NumUpdates <= client.NumUpdates {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// formatCibVersion returns the version as
+// admin_epoch.epoch.num_updates.
+func formatCibVersion(ver *pacemaker.CibVersion) string {
+	return fmt.Sprintf("%d.%d.%d", ver.AdminEpoch, ver.Epoch, ver.NumUpdates)
+}
+
+// parseCibVersion parses a version returned by
+// formatCibVersion, or a bare num_updates counter, for
+// which AdminEpoch and Epoch are -1.
+func parseCibVersion(s string) (*pacemaker.CibVersion, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 1 && len(parts) != 3 {
+		return nil, fmt.Errorf("invalid CIB version %q", s)
+	}
+	n := [3]int32{-1, -1, -1}
+	for i, part := range parts {
+		v, err := strconv.ParseInt(part, 10, 32)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid CIB version %q", s)
+		}
+		n[3-len(parts)+i] = int32(v)
+	}
+	return &pacemaker.CibVersion{AdminEpoch: n[0], Epoch: n[1], NumUpdates: n[2]}, nil
+}
+
+// serveCachedView serves one of the section listings
+// from the view cache, returning false if the view
+// hasn't been rendered from the CIB with hash.
+func (handler *routeHandler) serveCachedView(w http.ResponseWriter, r *http.Request, prefix string, hash string) bool {
+	return handler.serveView(w, r, strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/"), hash)
+}
+
+func (handler *routeHandler) serveView(w http.ResponseWriter, r *http.Request, view string, hash string) bool {
+	data, ok := handler.views.getCib(r.Context(), view, hash)
+	if !ok {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	io.WriteString(w, "\n")
 	return true
 }
 
@@ -276,23 +1065,26 @@ func (handler *routeHandler) serveMonitor(w http.ResponseWriter, r *http.Request
 }
 
 func (handler *routeHandler) serveFile(w http.ResponseWriter, r *http.Request, route *ConfigRoute) bool {
-	filename := path.Clean(fmt.Sprintf("%v%v", *route.Target, r.URL.Path))
-	info, err := os.Stat(filename)
-	if !os.IsNotExist(err) && !info.IsDir() {
-		log.Debugf("[file] %s", filename)
-		e := fmt.Sprintf(`W/"%x-%x"`, info.ModTime().Unix(), info.Size())
-		if match := r.Header.Get("If-None-Match"); match != "" {
-			if strings.Contains(match, e) {
-				w.WriteHeader(http.StatusNotModified)
-				return true
-			}
-		}
-		w.Header().Set("Cache-Control", "public, max-age=2592000")
-		w.Header().Set("ETag", e)
-		http.ServeFile(w, r, filename)
+	if handler.config.SSRIndex && isIndexPath(route, r.URL.Path) && handler.serveIndex(w, r, route) {
 		return true
 	}
-	return false
+	f, info := openStatic(*route.Target, r.URL.Path)
+	if f == nil {
+		return false
+	}
+	defer f.Close()
+	log.Debugf("[file] %s%s", *route.Target, r.URL.Path)
+	e := fmt.Sprintf(`W/"%x-%x"`, info.ModTime().Unix(), info.Size())
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if strings.Contains(match, e) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	w.Header().Set("Cache-Control", "public, max-age=2592000")
+	w.Header().Set("ETag", e)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return true
 }
 
 func (handler *routeHandler) serveProxy(w http.ResponseWriter, r *http.Request, route *ConfigRoute) bool {
@@ -306,6 +1098,221 @@ func (handler *routeHandler) serveProxy(w http.ResponseWriter, r *http.Request,
 	return true
 }
 
+// parseFlags parses the command line in args, reading
+// the configuration file given with -config into
+// config first, so that the flags that are set
+// override it.
+func parseFlags(fs *flag.FlagSet, args []string, config *Config) {
+	listen := fs.String("listen", config.Listen, "Address to listen to")
+	bind := fs.String("bind", "", "Address to listen to, such as 10.0.0.1 or [::1] (same as -listen)")
+	port := fs.Int("port", config.Port, "Port to listen to")
+	key := fs.String("key", config.Key, "TLS key file")
+	cert := fs.String("cert", config.Cert, "TLS cert file")
+	loglevel := fs.String("loglevel", config.LogLevel, "Log level (debug|info|warning|error|fatal|panic)")
+	logfile := fs.String("logfile", "", "Log to this file instead of stderr (reopened on SIGHUP)")
+	cfgfile := fs.String("config", "", "Configuration file")
+	logRepeatWindow := fs.Int("log-repeat-window", config.LogRepeatWindow, "Seconds during which repeated identical errors are collapsed (0 = off)")
+	parseWorkers := fs.Int("parse-workers", 0, "Number of goroutines rendering API views after a CIB update (0 = GOMAXPROCS)")
+	streamBuffer := fs.Int("stream-buffer", config.StreamBuffer, "Number of events buffered per streaming client")
+	streamPolicy := fs.String("stream-policy", config.StreamPolicy, "What to do when a streaming client can't keep up (drop-oldest|disconnect)")
+	gzipMinSize := fs.Int("gzip-min-size", config.GzipMinSize, "Minimum response size in bytes to compress")
+	gzipLevel := fs.Int("gzip-level", config.GzipLevel, "Gzip compression level, from 1 (fastest) to 9 (smallest), -1 for the default")
+	hostname := fs.String("hostname", "", "External hostname used in redirects when the client sends no Host header")
+	trustAuthHeader := fs.Bool("trust-auth-header", false, "Accept the X-Authenticated-User header from trusted proxies")
+	logRequestBodies := fs.Bool("log-request-bodies", false, "Log request bodies at debug level, for debugging clients (never use in production)")
+	waitForCert := fs.Int("wait-for-cert", 0, "Seconds to keep retrying if the TLS cert or key can't be loaded (0 = fail at once)")
+	authFailureTTL := fs.Int("auth-failure-ttl", config.AuthFailureTTL, "Seconds to reject failed credentials without checking them again (0 = off, at most 5)")
+	authCacheTTL := fs.Int("auth-cache-ttl", config.AuthCacheTTL, "Seconds to accept successful credentials without checking them again (0 = off)")
+	authMaxFailures := fs.Int("auth-max-failures", config.AuthMaxFailures, "Failed authentication attempts after which a client address is locked out (0 = never, the default)")
+	authFailureWindow := fs.Int("auth-failure-window", config.AuthFailureWindow, "Seconds within which failed authentication attempts of a client are counted")
+	authLockout := fs.Int("auth-lockout", config.AuthLockout, "Seconds a client address is locked out after too many failed authentication attempts")
+	authExecTimeout := fs.Int("auth-exec-timeout", config.AuthExecTimeout, "Seconds after which hawk_chkpwd and attrd_updater are killed (0 = never)")
+	allowAmbiguous := fs.Bool("allow-ambiguous-requests", false, "Don't reject requests with conflicting Content-Length / Transfer-Encoding headers")
+	noRootHandler := fs.Bool("no-root-handler", false, "Don't serve the catch-all / routes, return 404 for unmatched paths")
+	proxyStrict := fs.Bool("proxy-strict", false, "Reject requests that don't come through a trusted proxy with forwarding headers")
+	maxConnLifetime := fs.Int("max-connection-lifetime", 0, "Seconds after which keep-alive connections are closed once idle (0 = never)")
+	peekTimeout := fs.Int("peek-timeout", config.PeekTimeout, "Seconds a client has to send its first bytes before being dropped (0 = no limit)")
+	parseConcurrency := fs.Int("parse-concurrency", 0, "Number of requests parsing the CIB at the same time (0 = GOMAXPROCS)")
+	parseQueue := fs.Int("parse-queue", config.ParseQueue, "Number of requests waiting to parse the CIB before returning 503")
+	cookieFallback := fs.String("cookie-fallback", config.CookieFallback, "What to do with session cookies when attrd_updater is missing (basic|reject|cib)")
+	otelEndpoint := fs.String("otel-endpoint", "", "OTLP/HTTP collector to export request traces to (e.g. http://localhost:4318)")
+	ssrIndex := fs.Bool("ssr-index", false, "Render index.tmpl in file routes with a summary of the cluster state")
+	shutdownTimeout := fs.Int("shutdown-timeout", config.ShutdownTimeout, "Seconds to wait for requests in progress on SIGINT or SIGTERM")
+	userRateLimit := fs.Float64("user-rate-limit", 0, "Requests per second allowed for each authenticated user (0 = unlimited)")
+	adminRateLimit := fs.Float64("admin-rate-limit", 0, "Requests per second allowed for each admin user (0 = unlimited)")
+	tlsMinVersion := fs.String("tls-min-version", config.TLSMinVersion, "Oldest TLS version to accept (1.0|1.1|1.2|1.3)")
+	tlsCiphers := fs.String("tls-ciphers", "", "Comma-separated list of TLS cipher suites to accept")
+	socket := fs.String("socket", "", "Listen on this Unix domain socket instead of listen:port")
+	socketMode := fs.String("socket-mode", defaultSocketMode, "File mode of the socket, in octal")
+	plainHTTP := fs.Bool("plain-http", false, "Serve plain HTTP without TLS on the socket")
+	logFormat := fs.String("log-format", config.LogFormat, "Format of the log and access log (text|json)")
+	tokenFile := fs.String("token-file", "", "File of bearer tokens accepted by the API, one per line (reloaded on SIGHUP)")
+	docRoot := fs.String("docroot", "", "Directory of static files to serve at / (such as index.html and favicon.ico)")
+	corsOrigins := fs.String("cors-origins", "", "Comma-separated list of origins allowed to call the API from a browser")
+	trustedProxies := fs.String("trusted-proxies", "", "Comma-separated list of trusted reverse proxy addresses or CIDR ranges")
+
+	fs.Parse(args)
+
+	if *cfgfile != "" {
+		parseConfigFile(*cfgfile, config)
+	}
+
+	// only the flags given on the command line override
+	// the file, whatever their value
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	if set["listen"] {
+		config.Listen = *listen
+	}
+	if set["bind"] {
+		config.Listen = *bind
+	}
+	if set["port"] {
+		config.Port = *port
+	}
+	if set["key"] {
+		config.Key = *key
+	}
+	if set["cert"] {
+		config.Cert = *cert
+	}
+	if set["loglevel"] {
+		config.LogLevel = *loglevel
+	}
+	if set["logfile"] {
+		config.LogFile = *logfile
+	}
+	if set["log-repeat-window"] {
+		config.LogRepeatWindow = *logRepeatWindow
+	}
+	if set["parse-workers"] {
+		config.ParseWorkers = *parseWorkers
+	}
+	if set["stream-buffer"] {
+		config.StreamBuffer = *streamBuffer
+	}
+	if set["stream-policy"] {
+		config.StreamPolicy = *streamPolicy
+	}
+	if set["gzip-min-size"] {
+		config.GzipMinSize = *gzipMinSize
+	}
+	if set["gzip-level"] {
+		config.GzipLevel = *gzipLevel
+	}
+	if set["hostname"] {
+		config.Hostname = *hostname
+	}
+	if set["trusted-proxies"] {
+		config.TrustedProxies = splitFlagList(*trustedProxies)
+	}
+	if set["trust-auth-header"] {
+		config.TrustAuthHeader = *trustAuthHeader
+	}
+	if set["proxy-strict"] {
+		config.ProxyStrict = *proxyStrict
+	}
+	if set["log-request-bodies"] {
+		config.LogRequestBodies = *logRequestBodies
+	}
+	if set["no-root-handler"] {
+		config.NoRootHandler = *noRootHandler
+	}
+	if set["allow-ambiguous-requests"] {
+		config.AllowAmbiguousRequests = *allowAmbiguous
+	}
+	if set["auth-failure-ttl"] {
+		config.AuthFailureTTL = *authFailureTTL
+	}
+	if set["auth-cache-ttl"] {
+		config.AuthCacheTTL = *authCacheTTL
+	}
+	if set["auth-exec-timeout"] {
+		config.AuthExecTimeout = *authExecTimeout
+	}
+	if set["auth-max-failures"] {
+		config.AuthMaxFailures = *authMaxFailures
+	}
+	if set["auth-failure-window"] {
+		config.AuthFailureWindow = *authFailureWindow
+	}
+	if set["auth-lockout"] {
+		config.AuthLockout = *authLockout
+	}
+	if set["max-connection-lifetime"] {
+		config.MaxConnLifetime = *maxConnLifetime
+	}
+	if set["peek-timeout"] {
+		config.PeekTimeout = *peekTimeout
+	}
+	if set["ssr-index"] {
+		config.SSRIndex = *ssrIndex
+	}
+	if set["parse-concurrency"] {
+		config.ParseConcurrency = *parseConcurrency
+	}
+	if set["parse-queue"] {
+		config.ParseQueue = *parseQueue
+	}
+	if set["tls-min-version"] {
+		config.TLSMinVersion = *tlsMinVersion
+	}
+	if set["socket"] {
+		config.Socket = *socket
+	}
+	if set["socket-mode"] {
+		config.SocketMode = *socketMode
+	}
+	if set["plain-http"] {
+		config.PlainHTTP = *plainHTTP
+	}
+	if set["log-format"] {
+		config.LogFormat = *logFormat
+	}
+	if set["token-file"] {
+		config.TokenFile = *tokenFile
+	}
+	if set["docroot"] {
+		config.DocRoot = *docRoot
+	}
+	if set["cors-origins"] {
+		config.CORSOrigins = splitFlagList(*corsOrigins)
+	}
+	if set["tls-ciphers"] {
+		config.TLSCiphers = splitFlagList(*tlsCiphers)
+	}
+	if set["user-rate-limit"] {
+		config.UserRateLimit.Rate = *userRateLimit
+	}
+	if set["admin-rate-limit"] {
+		config.AdminRateLimit.Rate = *adminRateLimit
+	}
+	if set["shutdown-timeout"] {
+		config.ShutdownTimeout = *shutdownTimeout
+	}
+	if set["cookie-fallback"] {
+		config.CookieFallback = *cookieFallback
+	}
+	if set["otel-endpoint"] {
+		config.OtelEndpoint = *otelEndpoint
+	}
+	if set["wait-for-cert"] {
+		config.WaitForCert = *waitForCert
+	}
+}
+
+// splitFlagList splits a comma-separated flag value,
+// returning nil if it is empty.
+func splitFlagList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
 func main() {
 	log.SetFormatter(&log.TextFormatter{
 		DisableTimestamp: true,
@@ -313,11 +1320,28 @@ func main() {
 	})
 
 	config := Config{
-		Listen:   "0.0.0.0",
-		Port:     17630,
-		Key:      "/etc/hawk/hawk.key",
-		Cert:     "/etc/hawk/hawk.pem",
-		LogLevel: "info",
+		Listen:            "0.0.0.0",
+		Port:              17630,
+		Key:               "/etc/hawk/hawk.key",
+		Cert:              "/etc/hawk/hawk.pem",
+		LogLevel:          "info",
+		LogRepeatWindow:   60,
+		GzipMinSize:       defaultMinSize,
+		GzipLevel:         gzip.DefaultCompression,
+		StreamBuffer:      defaultStreamBuffer,
+		StreamPolicy:      streamDropOldest,
+		AuthFailureTTL:    defaultAuthFailureTTL,
+		AuthCacheTTL:      defaultAuthCacheTTL,
+		AuthExecTimeout:   defaultAuthExecTimeout,
+		AuthMaxFailures:   defaultAuthMaxFailures,
+		AuthFailureWindow: defaultAuthFailureWindow,
+		AuthLockout:       defaultAuthLockout,
+		CookieFallback:    cookieFallbackBasic,
+		ParseQueue:        defaultParseQueue,
+		ShutdownTimeout:   defaultShutdownTimeout,
+		PeekTimeout:       defaultPeekTimeout,
+		TLSMinVersion:     defaultTLSMinVersion,
+		LogFormat:         logFormatText,
 		Route: []ConfigRoute{
 			{
 				Handler: "api/v1",
@@ -327,45 +1351,141 @@ func main() {
 		},
 	}
 
-	listen := flag.String("listen", config.Listen, "Address to listen to")
-	port := flag.Int("port", config.Port, "Port to listen to")
-	key := flag.String("key", config.Key, "TLS key file")
-	cert := flag.String("cert", config.Cert, "TLS cert file")
-	loglevel := flag.String("loglevel", config.LogLevel, "Log level (debug|info|warning|error|fatal|panic)")
-	cfgfile := flag.String("config", "", "Configuration file")
+	parseFlags(flag.CommandLine, os.Args[1:], &config)
+
+	lvl, err := log.ParseLevel(config.LogLevel)
+	if err != nil {
+		log.Errorf("Failed to parse loglevel \"%v\" (must be debug|info|warning|error|fatal|panic)", config.LogLevel)
+		lvl = log.InfoLevel
+	}
+	log.SetLevel(lvl)
+	formatter, err := logFormatter(config.LogFormat, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetFormatter(formatter)
 
-	flag.Parse()
+	reload := newReloader()
+	var logout io.Writer = os.Stderr
+	if config.LogFile != "" {
+		lf, err := openLogFile(config.LogFile)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %s", err)
+		}
+		logout = lf
+		reload.add("log file", lf.Reopen)
+	}
+	logs := newLogBuffer(logout)
+	log.SetOutput(logs)
+	stdlog.SetOutput(logs)
+	reload.start()
 
-	if *cfgfile != "" {
-		parseConfigFile(*cfgfile, &config)
+	proxies, err := newProxyTrust(config.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid trusted proxy: %s", err)
+	}
+	if config.ProxyStrict && len(proxies.nets) == 0 {
+		log.Fatalf("proxy-strict requires trusted proxies to be configured")
 	}
 
-	if *listen != "0.0.0.0" {
-		config.Listen = *listen
+	ttls, err := parseViewTTLs(config.CacheTTL)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if *port != 17630 {
-		config.Port = *port
+	if config.DocRoot != "" {
+		if err := checkDocRoot(config.DocRoot); err != nil {
+			log.Fatal(err)
+		}
+		docroot := config.DocRoot
+		config.Route = append(config.Route, ConfigRoute{Handler: "file", Path: "/", Target: &docroot})
 	}
-	if *key != "/etc/hawk/hawk.key" {
-		config.Key = *key
+	cibParses = newParseLimiter(config.ParseConcurrency, config.ParseQueue)
+	routehandler := NewRouteHandler(&config, ttls)
+	routehandler.logs = logs
+	routehandler.auth.failures = newAuthFailureCache(time.Duration(config.AuthFailureTTL) * time.Second)
+	routehandler.auth.successes = newAuthSuccessCache(time.Duration(config.AuthCacheTTL) * time.Second)
+	routehandler.auth.execTimeout = time.Duration(config.AuthExecTimeout) * time.Second
+	routehandler.auth.lockouts = newClientAuthLimiter(config.AuthMaxFailures,
+		time.Duration(config.AuthFailureWindow)*time.Second, time.Duration(config.AuthLockout)*time.Second)
+	routehandler.auth.proxies = proxies
+	tokens, err := newTokenStore(config.TokenFile)
+	if err != nil {
+		log.Fatalf("Failed to read token file: %s", err)
 	}
-	if *cert != "/etc/hawk/hawk.pem" {
-		config.Cert = *cert
+	if tokens != nil {
+		routehandler.auth.tokens = tokens
+		reload.add("token file", tokens.reload)
 	}
-	if *loglevel != "info" {
-		config.LogLevel = *loglevel
+	if err := checkCookieFallback(config.CookieFallback); err != nil {
+		log.Fatal(err)
 	}
-
-	lvl, err := log.ParseLevel(config.LogLevel)
+	routehandler.auth.cookieFallback = config.CookieFallback
+	routehandler.auth.admins = make(map[string]bool)
+	for _, user := range config.AdminUsers {
+		routehandler.auth.admins[user] = true
+	}
+	if config.UserRateLimit.Rate > 0 || config.AdminRateLimit.Rate > 0 {
+		routehandler.auth.limits = newUserRateLimiter(config.UserRateLimit, config.AdminRateLimit)
+	}
+	if config.TrustAuthHeader {
+		if len(config.TrustedProxies) == 0 {
+			log.Warnf("trust-auth-header is set but no trusted proxies are configured")
+		}
+		routehandler.auth.headerProxies = proxies
+	}
+	streams, err := newStreamPolicy(config.StreamBuffer, config.StreamPolicy)
 	if err != nil {
-		log.Errorf("Failed to parse loglevel \"%v\" (must be debug|info|warning|error|fatal|panic)", config.LogLevel)
-		lvl = log.InfoLevel
+		log.Fatal(err)
 	}
-	log.SetLevel(lvl)
-
-	routehandler := NewRouteHandler(&config)
+	routehandler.cib.streams = streams
+	routehandler.cib.errlog = newDedupLogger(time.Duration(config.LogRepeatWindow) * time.Second)
 	routehandler.cib.Start()
-	gziphandler := NewGzipHandler(routehandler)
-	fmt.Printf("Listening to https://%s:%d\n", config.Listen, config.Port)
-	ListenAndServeWithRedirect(fmt.Sprintf("%s:%d", config.Listen, config.Port), gziphandler, config.Cert, config.Key)
+	var adapters []Adapter
+	if config.OtelEndpoint != "" {
+		tracer := newSpanExporter(config.OtelEndpoint)
+		defer tracer.stop()
+		adapters = append(adapters, func(h http.Handler) http.Handler {
+			return NewTracingHandler(h, tracer)
+		})
+	}
+	if config.LogRequestBodies {
+		if lvl < log.DebugLevel {
+			log.Warnf("log-request-bodies has no effect unless loglevel is debug")
+		} else {
+			log.Warnf("Request body logging is enabled, request bodies may contain sensitive data")
+		}
+		adapters = append(adapters, NewBodyLogHandler)
+	}
+	if err := checkGzipLevel(config.GzipLevel); err != nil {
+		log.Fatal(err)
+	}
+	adapters = append(adapters, func(h http.Handler) http.Handler {
+		return NewGzipHandler(h, config.GzipMinSize, config.GzipLevel)
+	})
+	if len(config.CORSOrigins) > 0 {
+		origins, err := parseCORSOrigins(config.CORSOrigins)
+		if err != nil {
+			log.Fatal(err)
+		}
+		adapters = append(adapters, func(h http.Handler) http.Handler {
+			return NewCORSHandler(h, origins)
+		})
+	}
+	adapters = append(adapters, NewMetricsHandler)
+	if !config.AllowAmbiguousRequests {
+		adapters = append(adapters, NewSmugglingGuard)
+	}
+	accessLog, err := newAccessLogger(logs, config.LogFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler := Adapt(routehandler, adapters...)
+	listeners, err := listenerConfig(&config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ListenAndServeWithRedirect(listeners, handler, &config, proxies, reload, shutdownSignals(), func(h http.Handler) http.Handler {
+		return NewAccessLogHandler(h, accessLog, proxies)
+	})
+	routehandler.cib.Stop()
 }
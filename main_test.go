@@ -1,7 +1,40 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"github.com/krig/go-pacemaker"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestConfigParse(t *testing.T) {
@@ -11,3 +44,3173 @@ func TestConfigParse(t *testing.T) {
 		t.Fatal("expected 7630, got ", config.Port)
 	}
 }
+
+func TestParseForwarded(t *testing.T) {
+	elems := parseForwarded(`for=192.0.2.60;proto=https;host=hawk.example.com, For="[2001:db8:cafe::17]:4711"`)
+	if len(elems) != 2 {
+		t.Fatal("expected 2 elements, got ", len(elems))
+	}
+	if elems[0].For != "192.0.2.60" || elems[0].Proto != "https" || elems[0].Host != "hawk.example.com" {
+		t.Fatal("unexpected first element ", elems[0])
+	}
+	if elems[1].For != "2001:db8:cafe::17" {
+		t.Fatal("expected 2001:db8:cafe::17, got ", elems[1].For)
+	}
+}
+
+func TestForwardedOrigin(t *testing.T) {
+	proxies, err := newProxyTrust([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://internal:7630/", nil)
+	r.RemoteAddr = "10.1.2.3:5555"
+	r.Header.Set("Forwarded", `for=198.51.100.7;proto=https;host="hawk.example.com"`)
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	r.Header.Set("X-Forwarded-Proto", "http")
+	o := proxies.origin(r)
+	if o.ClientIP != "198.51.100.7" || o.Proto != "https" || o.Host != "hawk.example.com" {
+		t.Fatal("Forwarded not preferred: ", o)
+	}
+
+	// client prepends a fake hop, the proxy appends the real one
+	r.Header.Set("Forwarded", "for=1.2.3.4, for=198.51.100.7;proto=https")
+	if o := proxies.origin(r); o.ClientIP != "198.51.100.7" {
+		t.Fatal("expected 198.51.100.7, got ", o.ClientIP)
+	}
+
+	r.Header.Del("Forwarded")
+	if o := proxies.origin(r); o.ClientIP != "203.0.113.9" || o.Proto != "http" {
+		t.Fatal("X-Forwarded-* fallback failed: ", o)
+	}
+
+	// untrusted peers can't spoof anything
+	r.RemoteAddr = "192.0.2.1:5555"
+	r.Header.Set("Forwarded", "for=198.51.100.7;proto=https")
+	if o := proxies.origin(r); o.ClientIP != "192.0.2.1" || o.Proto != "http" || o.Host != "internal:7630" {
+		t.Fatal("untrusted peer was believed: ", o)
+	}
+}
+
+func TestListenFds(t *testing.T) {
+	pid := os.Getpid()
+	self := strconv.Itoa(pid)
+	for _, test := range []struct {
+		pid, fds string
+		nfds     int
+	}{
+		{self, "1", 1},
+		{self, "3", 3},
+		{strconv.Itoa(pid + 1), "1", 0},
+		{"", "1", 0},
+		{self, "0", 0},
+		{self, "", 0},
+		{self, "-1", 0},
+		{self, "x", 0},
+	} {
+		if nfds := listenFds(test.pid, test.fds, pid); nfds != test.nfds {
+			t.Error("LISTEN_PID=", test.pid, " LISTEN_FDS=", test.fds, ": expected ", test.nfds, ", got ", nfds)
+		}
+	}
+
+	// without sockets for this process, the environment
+	// is left alone
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	for _, env := range [][2]string{{strconv.Itoa(pid + 1), "1"}, {self, "0"}} {
+		os.Setenv("LISTEN_PID", env[0])
+		os.Setenv("LISTEN_FDS", env[1])
+		if l, err := systemdListener(); l != nil || err != nil {
+			t.Fatal("expected no listener for ", env, ", got ", l, err)
+		}
+		if os.Getenv("LISTEN_PID") != env[0] {
+			t.Fatal("expected LISTEN_PID to be kept")
+		}
+	}
+
+	// with two sockets, the first one is used
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, l.Addr().String())
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListenerChild$")
+	cmd.Env = append(os.Environ(), "HAWK_TEST_SYSTEMD_ADDR="+addrs[0])
+	cmd.ExtraFiles = files
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal("socket activation failed: ", err, "\n", string(out))
+	}
+	if !strings.Contains(string(out), "systemd passed 2 sockets, only the first one is used") {
+		t.Fatal("expected a warning about the second socket, got ", string(out))
+	}
+}
+
+// TestSystemdListenerChild runs in the process started
+// by TestListenFds, with the sockets at fds 3 and 4.
+func TestSystemdListenerChild(t *testing.T) {
+	addr := os.Getenv("HAWK_TEST_SYSTEMD_ADDR")
+	if addr == "" {
+		t.Skip("only run by TestListenFds")
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "2")
+	l, err := systemdListener()
+	if err != nil || l == nil {
+		t.Fatal("expected a listener, got ", l, err)
+	}
+	defer l.Close()
+	if l.Addr().String() != addr {
+		t.Fatal("expected the first socket ", addr, ", got ", l.Addr())
+	}
+	if os.Getenv("LISTEN_PID") != "" || os.Getenv("LISTEN_FDS") != "" {
+		t.Fatal("expected the environment to be cleared")
+	}
+}
+
+func TestRedirectBehindProxy(t *testing.T) {
+	proxies, _ := newProxyTrust([]string{"127.0.0.1"})
+	handler := &HTTPRedirectHandler{
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		proxies: proxies,
+	}
+
+	r := httptest.NewRequest("GET", "http://internal/api/v1", nil)
+	r.RemoteAddr = "127.0.0.1:5555"
+	r.Header.Set("Forwarded", "proto=http;host=hawk.example.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://hawk.example.com/api/v1" {
+		t.Fatal("unexpected redirect: ", w.Code, w.Header().Get("Location"))
+	}
+
+	r.Header.Set("Forwarded", "proto=https;host=hawk.example.com")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatal("expected no redirect, got ", w.Code)
+	}
+}
+
+func TestRedirectHTTP10(t *testing.T) {
+	handler := &HTTPRedirectHandler{
+		handler:  http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		hostname: "hawk.example.com",
+	}
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// HTTP/1.0 with keep-alive: both requests are answered
+	// on the same connection
+	for i := 0; i < 2; i++ {
+		io.WriteString(conn, "GET /api/v1 HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if loc := resp.Header.Get("Location"); loc != "https://hawk.example.com:"+port+"/api/v1" {
+			t.Fatal("unexpected redirect: ", loc)
+		}
+		if resp.Close {
+			t.Fatal("expected keep-alive connection")
+		}
+	}
+
+	// plain HTTP/1.0: the connection is closed after the response
+	io.WriteString(conn, "GET /api/v1 HTTP/1.0\r\n\r\n")
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !resp.Close {
+		t.Fatal("expected connection to be closed")
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatal("expected EOF, got ", err)
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	h := &histogramVec{
+		buckets: []float64{0.1, 1},
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+	}
+	h.init("test_seconds", "Test.", "histogram", []string{"command"})
+	h.observe(0.05, "a")
+	h.observe(0.5, "a")
+
+	var buf bytes.Buffer
+	h.writeTo(&buf)
+	expected := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{command="a",le="0.1"} 1
+test_seconds_bucket{command="a",le="1"} 2
+test_seconds_bucket{command="a",le="+Inf"} 2
+test_seconds_sum{command="a"} 0.55
+test_seconds_count{command="a"} 2
+`
+	if buf.String() != expected {
+		t.Fatal("unexpected output:\n", buf.String())
+	}
+}
+
+func TestGraphQLProjection(t *testing.T) {
+	parser := &gqlParser{src: `query Dashboard { nodes { name: uname } cluster { cluster_property_set { id } } }`}
+	fields, err := parser.parseDocument()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nodes interface{}
+	json.Unmarshal([]byte(`[{"id":"1","uname":"alice"},{"id":"2","uname":"bob"}]`), &nodes)
+	result, err := project(nodes, fields[0].selections, "nodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, _ := json.Marshal(result)
+	if string(js) != `[{"name":"alice"},{"name":"bob"}]` {
+		t.Fatal("unexpected result ", string(js))
+	}
+
+	for _, q := range []string{`mutation { nodes { id } }`, `{ nodes(id: 1) { id } }`, `{ nodes { id `} {
+		parser := &gqlParser{src: q}
+		if _, err := parser.parseDocument(); err == nil {
+			t.Fatal("expected error for ", q)
+		}
+	}
+}
+
+func TestGzipSkipsCompressedTypes(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 4096)
+	for _, tc := range []struct {
+		contentType string
+		gzipped     bool
+	}{
+		{"image/png", false},
+		{"application/gzip", false},
+		{"image/svg+xml", true},
+		{"application/xml; charset=utf-8", true},
+	} {
+		handler := NewGzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tc.contentType)
+			w.Write(body)
+		}), 1024, gzip.BestSpeed)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if gzipped := w.Header().Get("Content-Encoding") == "gzip"; gzipped != tc.gzipped {
+			t.Fatalf("%s: expected gzipped=%v", tc.contentType, tc.gzipped)
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatal("expected Vary: Accept-Encoding for ", tc.contentType)
+		}
+		if !tc.gzipped && !bytes.Equal(w.Body.Bytes(), body) {
+			t.Fatalf("%s: body changed", tc.contentType)
+		}
+	}
+	for _, level := range []int{0, 10, -2} {
+		if checkGzipLevel(level) == nil {
+			t.Fatal("expected an error for gzip level ", level)
+		}
+	}
+	if checkGzipLevel(gzip.DefaultCompression) != nil || checkGzipLevel(gzip.BestCompression) != nil {
+		t.Fatal("expected valid gzip levels")
+	}
+}
+
+func TestGzipMinSize(t *testing.T) {
+	for _, tc := range []struct {
+		size          int
+		contentLength bool
+		gzipped       bool
+	}{
+		{100, false, false},
+		{100, true, false},
+		{2000, false, true},
+		{2000, true, true},
+	} {
+		handler := NewGzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.contentLength {
+				w.Header().Set("Content-Length", strconv.Itoa(tc.size))
+			}
+			w.Write(bytes.Repeat([]byte("x"), tc.size))
+		}), 1024, gzip.DefaultCompression)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if gzipped := w.Header().Get("Content-Encoding") == "gzip"; gzipped != tc.gzipped {
+			t.Fatalf("size %d (content-length %v): expected gzipped=%v", tc.size, tc.contentLength, tc.gzipped)
+		}
+		if !tc.gzipped && w.Body.Len() != tc.size {
+			t.Fatalf("size %d: body is %d bytes", tc.size, w.Body.Len())
+		}
+	}
+}
+
+func TestGzippedConfigParse(t *testing.T) {
+	raw, err := ioutil.ReadFile("./config.json.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempFile("", "config.json.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	zw := gzip.NewWriter(tmp)
+	zw.Write(raw)
+	zw.Close()
+	tmp.Close()
+
+	config := Config{}
+	parseConfigFile(tmp.Name(), &config)
+	if config.Port != 7630 {
+		t.Fatal("expected 7630, got ", config.Port)
+	}
+
+	ioutil.WriteFile(tmp.Name(), []byte{0x1f, 0x8b, 0, 0}, 0600)
+	if _, err := readConfigFile(tmp.Name()); err == nil {
+		t.Fatal("expected error for malformed gzip data")
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	cases := map[string]string{
+		`{"user":"hacluster","password":"linux"}`:    `{"user":"hacluster","password":"[REDACTED]"}`,
+		`{"api_key" : "a\"b", "name":"x"}`:           `{"api_key" : "[REDACTED]", "name":"x"}`,
+		`username=hacluster&passwd=linux&remember=1`: `username=hacluster&passwd=[REDACTED]&remember=1`,
+		`Token=abc`:                                   `Token=[REDACTED]`,
+		`{"password":12345,"user":"x"}`:               `{"password":"[REDACTED]","user":"x"}`,
+		`{"token":null}`:                              `{"token":"[REDACTED]"}`,
+		`{"auth": true }`:                             `{"auth": "[REDACTED]" }`,
+		`{"secret":{"k":"v","n":{"a":"}"}},"id":1}`:   `{"secret":"[REDACTED]","id":1}`,
+		`{"keys":["a","b"],"id":1}`:                   `{"keys":"[REDACTED]","id":1}`,
+		`{"user":"x","password":"cut off at the lim`:  `{"user":"x","password":"[REDACTED]"`,
+		`{"secret":{"k":"cut off`:                     `{"secret":"[REDACTED]"`,
+		`{"opts":{"session":"s1"},"password":-1.5e3}`: `{"opts":{"session":"[REDACTED]"},"password":"[REDACTED]"}`,
+	}
+	for in, expected := range cases {
+		if got := string(redactBody([]byte(in))); got != expected {
+			t.Fatal("expected ", expected, ", got ", got)
+		}
+	}
+}
+
+func TestListenerConfig(t *testing.T) {
+	config := Config{Listen: "0.0.0.0", Port: 7630, Key: "hawk.key", Cert: "hawk.pem"}
+	listeners, err := listenerConfig(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 1 || listeners[0].addr() != "0.0.0.0:7630" || listeners[0].Auth != authHawk {
+		t.Fatal("expected default listener, got ", listeners)
+	}
+
+	config.Listeners = []ConfigListener{
+		{Listen: "10.0.0.1", Port: 7630, ClientCA: "ca.pem", Auth: "client-cert"},
+		{Port: 7631, Cert: "ro.pem", Auth: "basic", ReadOnly: true},
+	}
+	listeners, err = listenerConfig(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listeners[0].Key != "hawk.key" || listeners[1].Cert != "ro.pem" || listeners[1].Listen != "0.0.0.0" {
+		t.Fatal("expected defaults to be filled in, got ", listeners)
+	}
+
+	config.Listeners = []ConfigListener{{Port: 7630, Auth: "client-cert"}}
+	if _, err := listenerConfig(&config); err == nil {
+		t.Fatal("expected client-cert without client_ca to fail")
+	}
+
+	for listen, expected := range map[string]string{"::1": "[::1]:7630", "[::1]": "[::1]:7630", "10.0.0.1": "10.0.0.1:7630"} {
+		l := ConfigListener{Listen: listen, Port: 7630}
+		if l.addr() != expected {
+			t.Errorf("%s: expected %s, got %s", listen, expected, l.addr())
+		}
+	}
+	ln, err := net.Listen("tcp", (&ConfigListener{Listen: "[::1]", Port: 0}).addr())
+	if err == nil {
+		l := ConfigListener{}
+		if url := l.url(ln.Addr()); !strings.HasPrefix(url, "https://[::1]:") || strings.HasSuffix(url, ":0") {
+			t.Error("expected the bound address in the url, got ", url)
+		}
+		ln.Close()
+	}
+
+	config.Listeners = nil
+	config.Socket, config.PlainHTTP = "/run/hawk.sock", true
+	listeners, err = listenerConfig(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listeners[0].SocketMode != defaultSocketMode || listeners[0].addr() != "unix:/run/hawk.sock" {
+		t.Fatal("expected a plain socket listener, got ", listeners)
+	}
+	config.Socket = ""
+	if _, err := listenerConfig(&config); err == nil {
+		t.Fatal("expected plain_http without a socket to fail")
+	}
+	config.Socket, config.SocketMode = "/run/hawk.sock", "rw"
+	if _, err := listenerConfig(&config); err == nil {
+		t.Fatal("expected an invalid socket mode to fail")
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hawk-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/api.sock"
+
+	// leave a stale socket behind
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatal("expected the socket to have mode 0600, got ", fi, err)
+	}
+	if _, err := listenUnix(path, 0600); err == nil {
+		t.Fatal("expected a socket in use to be kept")
+	}
+
+	handler := &HTTPRedirectHandler{
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") }),
+		plain:   true,
+	}
+	handler.proxies, _ = newProxyTrust(nil)
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(ln)
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := client.Get("http://hawk/api/v1/cib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatal("expected plain HTTP to be served without a redirect, got ", resp.Status, " ", string(body))
+	}
+
+	file := dir + "/file"
+	ioutil.WriteFile(file, nil, 0600)
+	if _, err := listenUnix(file, 0600); err == nil {
+		t.Fatal("expected a regular file not to be removed")
+	}
+}
+
+func TestListenerHandler(t *testing.T) {
+	var seen *ConfigListener
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = r.Context().Value(listenerContextKey).(*ConfigListener)
+	})
+	l := &ConfigListener{ReadOnly: true, Paths: []string{"/api/v1/nodes"}}
+	handler := &listenerHandler{listener: l, handler: inner}
+
+	cases := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"GET", "/api/v1/nodes", 200},
+		{"POST", "/api/v1/nodes", 405},
+		{"GET", "/api/v1/cib.xml", 404},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != c.code {
+			t.Fatal("expected ", c.code, " for ", c.method, " ", c.path, ", got ", w.Code)
+		}
+	}
+	if seen != l {
+		t.Fatal("expected the listener in the request context")
+	}
+}
+
+func TestLogBuffer(t *testing.T) {
+	var out bytes.Buffer
+	logs := newLogBuffer(&out)
+	for i := 0; i < logBufferLines+2; i++ {
+		fmt.Fprintf(logs, "line %d\n", i)
+	}
+	ch, backlog, err := logs.subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backlog) != logBufferLines || backlog[0] != "line 2" || backlog[len(backlog)-1] != fmt.Sprintf("line %d", logBufferLines+1) {
+		t.Fatal("expected the most recent lines in order, got ", backlog[0], " .. ", backlog[len(backlog)-1])
+	}
+	logs.Write([]byte("new\n"))
+	if line := <-ch; line != "new" {
+		t.Fatal("expected new, got ", line)
+	}
+	if !strings.HasSuffix(out.String(), "new\n") {
+		t.Fatal("expected output to be passed through")
+	}
+	for i := 1; i < maxLogSubscribers; i++ {
+		if _, _, err := logs.subscribe(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := logs.subscribe(); err != errTooManyLogSubscribers {
+		t.Fatal("expected subscriber cap, got ", err)
+	}
+}
+
+func TestDedupLogger(t *testing.T) {
+	logs := newLogBuffer(ioutil.Discard)
+	lines, _, err := logs.subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := log.StandardLogger().Out
+	log.SetOutput(logs)
+	defer log.SetOutput(saved)
+
+	d := newDedupLogger(50 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		d.Warnf("Failed to connect to Pacemaker: %s", "dedup test")
+	}
+	var logged []string
+	timeout := time.After(time.Second)
+	for len(logged) < 2 {
+		select {
+		case line := <-lines:
+			if strings.Contains(line, "dedup test") {
+				logged = append(logged, line)
+			}
+		case <-timeout:
+			t.Fatal("expected a line and a summary, got ", logged)
+		}
+	}
+	if strings.Contains(logged[0], "occurred") || !strings.Contains(logged[0], "level=warning") {
+		t.Fatal("expected the first occurrence to be logged as it is, got ", logged[0])
+	}
+	if !strings.Contains(logged[1], "occurred 5 times in the last 50ms") {
+		t.Fatal("expected a summary of the repeats, got ", logged[1])
+	}
+	timeout = time.After(100 * time.Millisecond)
+Quiet:
+	for {
+		select {
+		case line := <-lines:
+			if strings.Contains(line, "dedup test") {
+				t.Fatal("expected nothing more, got ", line)
+			}
+		case <-timeout:
+			break Quiet
+		}
+	}
+
+	// the window is over, so the message is logged again
+	d.Warnf("Failed to connect to Pacemaker: %s", "dedup test")
+	timeout = time.After(time.Second)
+	for {
+		select {
+		case line := <-lines:
+			if !strings.Contains(line, "dedup test") {
+				continue
+			}
+			if strings.Contains(line, "occurred") {
+				t.Fatal("expected the message again, got ", line)
+			}
+			return
+		case <-timeout:
+			t.Fatal("expected the message to be logged after the window")
+		}
+	}
+}
+
+func TestViewCacheTTL(t *testing.T) {
+	cibWith := func(value string) string {
+		return `<cib><configuration><crm_config><cluster_property_set id="opts">` +
+			`<nvpair id="opts-a" name="a" value="` + value + `"/>` +
+			`</cluster_property_set></crm_config></configuration></cib>`
+	}
+	vc := newViewCache(1, map[string]time.Duration{"properties": time.Hour})
+	vc.update(cibWith("1"), "1")
+	var data []byte
+	for i := 0; i < 100; i++ {
+		var ok bool
+		if data, ok = vc.get(context.Background(), "properties"); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if string(data) != `{"a":"1"}` {
+		t.Fatal("expected rendered properties, got ", string(data))
+	}
+
+	// kept across an update while within the TTL
+	vc.update(cibWith("2"), "2")
+	if data, _ = vc.get(context.Background(), "properties"); string(data) != `{"a":"1"}` {
+		t.Fatal("expected cached properties, got ", string(data))
+	}
+	// but only served along with the CIB it came from
+	if _, ok := vc.getCib(context.Background(), "properties", "2"); ok {
+		t.Fatal("expected the cached properties not to be served for the new CIB")
+	}
+	if data, ok := vc.getCib(context.Background(), "properties", "1"); !ok || string(data) != `{"a":"1"}` {
+		t.Fatal("expected the cached properties for their own CIB, got ", string(data))
+	}
+
+	// rendered from the latest CIB once expired
+	vc.ttls["properties"] = 0
+	if data, _ = vc.get(context.Background(), "properties"); string(data) != `{"a":"2"}` {
+		t.Fatal("expected fresh properties, got ", string(data))
+	}
+
+	if _, err := parseViewTTLs(map[string]int{"status": 10}); err == nil {
+		t.Fatal("expected error for unknown view")
+	}
+}
+
+func TestCheckCibDocument(t *testing.T) {
+	valid := []string{
+		`<cib epoch="1"><configuration><nodes/></configuration><status/></cib>`,
+		`<?xml version="1.0"?><cib><status/><configuration/></cib>`,
+	}
+	for _, doc := range valid {
+		if err := checkCibDocument(doc); err != nil {
+			t.Fatal("expected ", doc, " to be accepted, got ", err)
+		}
+	}
+	invalid := []string{
+		``,
+		`<pacemaker-result status="102"/>`,
+		`<cib><status/></cib>`,
+		`<cib><status><configuration/></status></cib>`,
+		`<cib><configur`,
+	}
+	for _, doc := range invalid {
+		if checkCibDocument(doc) == nil {
+			t.Fatal("expected ", doc, " to be rejected")
+		}
+	}
+}
+
+func TestGzipTrailers(t *testing.T) {
+	for _, size := range []int{10, 4096} {
+		body := strings.Repeat("x", size)
+		inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Cib-Epoch")
+			io.WriteString(w, body)
+			w.Header().Set(http.TrailerPrefix+"X-Cib-Epoch", "42")
+		})
+		srv := httptest.NewServer(NewGzipHandler(inner, 1024, gzip.DefaultCompression))
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		srv.Close()
+		if resp.Header.Get("X-Cib-Epoch") != "" {
+			t.Fatal("expected trailer not to be sent as a header for size ", size)
+		}
+		if resp.Trailer.Get("X-Cib-Epoch") != "42" {
+			t.Fatal("expected trailer for size ", size, ", got ", resp.Trailer)
+		}
+		if (size >= 1024) != (resp.Header.Get("Content-Encoding") == "gzip") {
+			t.Fatal("unexpected Content-Encoding for size ", size)
+		}
+	}
+}
+
+func TestNoRootHandler(t *testing.T) {
+	target := "unix:///nonexistent.sock"
+	config := Config{
+		Route: []ConfigRoute{
+			{Handler: "proxy", Path: "/", Target: &target},
+		},
+		NoRootHandler: true,
+	}
+	handler := NewRouteHandler(&config, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/dashboard", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatal("expected 404, got ", w.Code)
+	}
+}
+
+func TestSSRIndex(t *testing.T) {
+	target := "html"
+	config := Config{
+		Route: []ConfigRoute{
+			{Handler: "file", Path: "/", Target: &target},
+		},
+		SSRIndex: true,
+	}
+	handler := NewRouteHandler(&config, nil)
+
+	// no CIB yet: the static index
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/index.html", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<h1>Hawk</h1>") {
+		t.Fatal("expected the static index, got ", w.Code, " ", w.Body.String())
+	}
+
+	xmldoc := `<cib><configuration><nodes><node id="1" uname="alice"/><node id="2" uname="bob"/></nodes>
+		<resources><primitive id="ip"/></resources></configuration><status>
+		<node_state id="1" uname="alice" in_ccm="true" crmd="online" join="member"/>
+	</status></cib>`
+	handler.cib.xmldoc = xmldoc
+	handler.cib.hash = cibHash(xmldoc)
+	for _, p := range []string{"/", "/index.html"} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "1 of 2 online") || !strings.Contains(w.Body.String(), "0 of 1 started") {
+			t.Fatal("expected the rendered index for ", p, ", got ", w.Code, " ", w.Body.String())
+		}
+	}
+
+	config.SSRIndex = false
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/index.html", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<h1>Hawk</h1>") {
+		t.Fatal("expected the static index, got ", w.Code, " ", w.Body.String())
+	}
+}
+
+func TestDocRoot(t *testing.T) {
+	if err := checkDocRoot("html"); err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range []string{"no-such-dir", "main.go"} {
+		if err := checkDocRoot(root); err == nil {
+			t.Fatal("expected an error for ", root)
+		}
+	}
+
+	target := "html"
+	config := Config{
+		Route: []ConfigRoute{
+			{Handler: "file", Path: "/", Target: &target},
+		},
+	}
+	handler := NewRouteHandler(&config, nil)
+	for _, p := range []string{"/", "/index.html", "/favicon.ico"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+		if w.Code != http.StatusOK || w.Header().Get("ETag") == "" {
+			t.Fatal("expected ", p, " to be served, got ", w.Code)
+		}
+	}
+	for _, p := range []string{"/../main.go", "/%2e%2e/main.go", "/..%2fmain.go", "/html/../../main.go"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path, _ = url.PathUnescape(p)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if strings.Contains(w.Body.String(), "package main") {
+			t.Fatal("served a file outside of the docroot for ", p)
+		}
+	}
+}
+
+func TestConnLifetime(t *testing.T) {
+	lifetime := newConnLifetime(time.Minute)
+	now := time.Now()
+	lifetime.now = func() time.Time { return now }
+	idle, active := &closeConn{}, &closeConn{}
+	lifetime.connState(idle, http.StateNew)
+	lifetime.connState(active, http.StateNew)
+	lifetime.connState(idle, http.StateIdle)
+	lifetime.connState(active, http.StateActive)
+	if idle.closed || active.closed {
+		t.Fatal("closed a new connection")
+	}
+
+	now = now.Add(time.Minute)
+	lifetime.sweep()
+	if !idle.closed {
+		t.Fatal("expected the old idle connection to be closed")
+	}
+	if active.closed {
+		t.Fatal("closed an active connection")
+	}
+	lifetime.connState(active, http.StateIdle)
+	if !active.closed {
+		t.Fatal("expected the connection to be closed once idle")
+	}
+	if len(lifetime.conns) != 0 {
+		t.Fatal("expected no tracked connections, got ", len(lifetime.conns))
+	}
+}
+
+type closeConn struct {
+	net.Conn
+	closed bool
+}
+
+func (c *closeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestReloaderCoalesce(t *testing.T) {
+	rl := newReloader()
+	rl.window = 50 * time.Millisecond
+	reloads := make(chan int, 10)
+	rl.add("test", func() error {
+		reloads <- 1
+		return nil
+	})
+	signals := make(chan os.Signal, 3)
+	for i := 0; i < 3; i++ {
+		signals <- syscall.SIGHUP
+	}
+	go rl.run(signals)
+	<-reloads
+	select {
+	case <-reloads:
+		t.Fatal("expected a single reload for a burst of signals")
+	case <-time.After(2 * rl.window):
+	}
+	signals <- syscall.SIGHUP
+	select {
+	case <-reloads:
+	case <-time.After(time.Second):
+		t.Fatal("expected a reload for a later signal")
+	}
+	close(signals)
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hawk-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := dir + "/hawk.log"
+	lf, err := openLogFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := lf.file
+	if err := lf.Reopen(); err != nil || lf.file != file {
+		t.Fatal("expected the unchanged file to be kept, got ", err)
+	}
+	os.Rename(name, name+".1")
+	if err := lf.Reopen(); err != nil || lf.file == file {
+		t.Fatal("expected the rotated file to be reopened, got ", err)
+	}
+}
+
+func TestSnapshotPinning(t *testing.T) {
+	config := Config{Route: []ConfigRoute{{Handler: "api/v1", Path: "/api/v1"}}}
+	handler := NewRouteHandler(&config, nil)
+	handler.auth.headerProxies, _ = newProxyTrust([]string{"192.0.2.1"})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set(authUserHeader, "hacluster")
+		handler.serveAPI(w, r, &config.Route[0])
+		return w
+	}
+	props := func(name string) string {
+		return `<cib><configuration><crm_config><cluster_property_set id="cib-bootstrap-options">
+			<nvpair id="cn" name="cluster-name" value="` + name + `"/>
+		</cluster_property_set></crm_config></configuration></cib>`
+	}
+	old, current := props("old"), props("new")
+	handler.cib.snapshots[0] = cibSnapshot{xmldoc: old, hash: cibHash(old)}
+	handler.cib.snapshots[1] = cibSnapshot{xmldoc: current, hash: cibHash(current)}
+	// the views are still those of the old CIB, as
+	// between the update and the views being rendered
+	// again
+	handler.views.update(old, cibHash(old))
+	for i := 0; i < 100; i++ {
+		if _, ok := handler.views.get(context.Background(), "properties"); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	handler.cib.xmldoc, handler.cib.hash = current, cibHash(current)
+
+	w := get("/api/v1/properties")
+	if w.Header().Get("X-Cib-Hash") != cibHash(current) || !strings.Contains(w.Body.String(), `"new"`) {
+		t.Fatal("expected the current CIB, got ", w.Body.String())
+	}
+	w = get("/api/v1/properties?snapshot=" + cibHash(old))
+	if w.Header().Get("X-Cib-Hash") != cibHash(old) || !strings.Contains(w.Body.String(), `"old"`) {
+		t.Fatal("expected the pinned CIB, got ", w.Body.String())
+	}
+	w = get("/api/v1/properties?snapshot=evicted")
+	if w.Code != http.StatusConflict {
+		t.Fatal("expected 409, got ", w.Code)
+	}
+
+	query := "/api/v1/graphql?query=" + url.QueryEscape("{ cluster { cluster_property_set { nvpair { value } } } }")
+	w = get(query)
+	if w.Header().Get("X-Cib-Hash") != cibHash(current) || !strings.Contains(w.Body.String(), `"new"`) {
+		t.Fatal("expected the current CIB from GraphQL, got ", w.Body.String())
+	}
+	w = get(query + "&snapshot=" + cibHash(old))
+	if w.Header().Get("X-Cib-Hash") != cibHash(old) || !strings.Contains(w.Body.String(), `"old"`) {
+		t.Fatal("expected the pinned CIB from GraphQL, got ", w.Body.String())
+	}
+	w = get(query + "&snapshot=evicted")
+	if w.Code != http.StatusConflict {
+		t.Fatal("expected 409 from GraphQL, got ", w.Code)
+	}
+}
+
+func TestSinceNumUpdates(t *testing.T) {
+	config := Config{Route: []ConfigRoute{{Handler: "api/v1", Path: "/api/v1"}}}
+	handler := NewRouteHandler(&config, nil)
+	handler.auth.headerProxies, _ = newProxyTrust([]string{"192.0.2.1"})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set(authUserHeader, "hacluster")
+		handler.serveAPI(w, r, &config.Route[0])
+		return w
+	}
+	set := func(epoch, numUpdates int32) string {
+		xmldoc := fmt.Sprintf(`<cib epoch="%d" num_updates="%d"><configuration/></cib>`, epoch, numUpdates)
+		handler.cib.xmldoc, handler.cib.hash = xmldoc, cibHash(xmldoc)
+		handler.cib.version = &pacemaker.CibVersion{Epoch: epoch, NumUpdates: numUpdates}
+		return handler.cib.hash
+	}
+	old := set(5, 57)
+	handler.cib.snapshots[0] = handler.cib.Current()
+
+	w := get("/api/v1/features")
+	if w.Header().Get("X-Cib-Num-Updates") != "57" || w.Header().Get("X-Cib-Version") != "0.5.57" {
+		t.Fatal("unexpected version headers: ", w.Header())
+	}
+	for _, since := range []string{"0.5.57", "0.5.60", "57", "60"} {
+		if w = get("/api/v1/features?since_num_updates=" + since); w.Code != http.StatusNotModified {
+			t.Fatal("expected 304 for ", since, ", got ", w.Code)
+		}
+	}
+	for _, since := range []string{"0.5.56", "56", "0.4.60", "1.5.60"} {
+		if w = get("/api/v1/features?since_num_updates=" + since); w.Code == http.StatusNotModified {
+			t.Fatal("expected a newer CIB to be returned for ", since)
+		}
+	}
+	for _, since := range []string{"0.5", "0.5.x", "0.-5.57", "-1", "x", "1.2.3.4"} {
+		if w = get("/api/v1/features?since_num_updates=" + since); w.Code != http.StatusBadRequest {
+			t.Fatal("expected 400 for ", since, ", got ", w.Code)
+		}
+	}
+
+	// a configuration change resets num_updates, which
+	// must not hide it
+	set(6, 0)
+	if w = get("/api/v1/features?since_num_updates=0.5.57"); w.Code == http.StatusNotModified || w.Header().Get("X-Cib-Version") != "0.6.0" {
+		t.Fatal("expected the new epoch to be returned, got ", w.Code, " ", w.Header())
+	}
+	// unlike a bare counter, which is of the current epoch
+	if w = get("/api/v1/features?since_num_updates=57"); w.Code != http.StatusNotModified {
+		t.Fatal("expected a bare counter to be compared within the epoch, got ", w.Code)
+	}
+
+	// the headers describe the pinned CIB
+	w = get("/api/v1/features?snapshot=" + old)
+	if w.Header().Get("X-Cib-Hash") != old || w.Header().Get("X-Cib-Version") != "0.5.57" {
+		t.Fatal("expected the version of the pinned CIB, got ", w.Header())
+	}
+}
+
+func TestSchemaConversion(t *testing.T) {
+	for schema, expected := range map[string]string{"3.0": "pacemaker-3.0", "pacemaker-3.0": "pacemaker-3.0", "": ""} {
+		if normalizeSchema(schema) != expected {
+			t.Error("unexpected normalized schema for ", schema, ": ", normalizeSchema(schema))
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "hawk-schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runs := dir + "/runs"
+	upgrade := dir + "/upgrade"
+	script := "#!/bin/sh\necho run >>" + runs + "\nsed -i 's/pacemaker-2.0/pacemaker-3.5/' \"$CIB_file\"\n"
+	if err := ioutil.WriteFile(upgrade, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fail := dir + "/fail"
+	if err := ioutil.WriteFile(fail, []byte("#!/bin/sh\necho run >>"+runs+"\necho broken >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	countRuns := func() int {
+		data, _ := ioutil.ReadFile(runs)
+		return strings.Count(string(data), "run")
+	}
+	defer func(c string) { cibadminPath = c }(cibadminPath)
+
+	config := Config{Route: []ConfigRoute{{Handler: "api/v1", Path: "/api/v1"}}}
+	handler := NewRouteHandler(&config, nil)
+	handler.auth.headerProxies, _ = newProxyTrust([]string{"192.0.2.1"})
+	xmldoc := `<cib validate-with="pacemaker-2.0" epoch="1"><configuration/></cib>`
+	handler.cib.xmldoc, handler.cib.hash = xmldoc, cibHash(xmldoc)
+	handler.cib.version = &pacemaker.CibVersion{Epoch: 1}
+	get := func(schema string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/api/v1/configuration/cib.xml?schema="+schema, nil)
+		r.Header.Set(authUserHeader, "hacluster")
+		handler.serveAPI(w, r, &config.Route[0])
+		return w
+	}
+
+	// the current schema is served without running cibadmin
+	cibadminPath = dir + "/missing"
+	if w := get("2.0"); w.Code != http.StatusOK || w.Body.String() != xmldoc {
+		t.Fatal("expected the CIB as it is, got ", w.Code, " ", w.Body.String())
+	}
+
+	cibadminPath = fail
+	for i := 1; i <= 2; i++ {
+		if w := get("3.5"); w.Code != http.StatusInternalServerError {
+			t.Fatal("expected a failed conversion to give 500, got ", w.Code)
+		}
+		if countRuns() != i {
+			t.Fatal("expected a failed conversion not to be cached, got ", countRuns(), " runs")
+		}
+	}
+
+	cibadminPath = upgrade
+	for i := 0; i < 2; i++ {
+		if w := get("pacemaker-3.0"); w.Code != http.StatusConflict {
+			t.Fatal("expected an unsupported schema to give 409, got ", w.Code)
+		}
+	}
+	if countRuns() != 3 {
+		t.Fatal("expected the unsupported schema to be cached, got ", countRuns(), " runs")
+	}
+	if w := get("3.5"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `validate-with="pacemaker-3.5"`) {
+		t.Fatal("expected the upgraded CIB, got ", w.Code, " ", w.Body.String())
+	}
+
+	// a new CIB drops the cached results
+	xmldoc = `<cib validate-with="pacemaker-2.0" epoch="2"><configuration/></cib>`
+	handler.cib.xmldoc, handler.cib.hash = xmldoc, cibHash(xmldoc)
+	if w := get("3.0"); w.Code != http.StatusConflict || countRuns() != 5 {
+		t.Fatal("expected the new CIB to be converted, got ", w.Code, " ", countRuns(), " runs")
+	}
+}
+
+func TestCibETag(t *testing.T) {
+	config := Config{Route: []ConfigRoute{{Handler: "api/v1", Path: "/api/v1"}}}
+	handler := NewRouteHandler(&config, nil)
+	handler.auth.headerProxies, _ = newProxyTrust([]string{"192.0.2.1"})
+	api := NewGzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.serveAPI(w, r, &config.Route[0])
+	}), 16, gzip.DefaultCompression)
+	get := func(path, etag string, gzipped bool) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set(authUserHeader, "hacluster")
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		if gzipped {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+		api.ServeHTTP(w, r)
+		return w
+	}
+	xmldoc := `<cib epoch="1"><configuration><nodes><node id="1" uname="alice"/></nodes></configuration></cib>`
+	handler.cib.xmldoc, handler.cib.hash = xmldoc, cibHash(xmldoc)
+
+	w := get("/api/v1/configuration/cib.xml", "", false)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag != `"`+cibHash(xmldoc)+`-xml"` {
+		t.Fatal("expected the CIB with an ETag, got ", w.Code, " ", etag)
+	}
+	w = get("/api/v1/configuration/cib.xml", etag, false)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+		t.Fatal("expected 304, got ", w.Code, " ", w.Body.String())
+	}
+
+	// the gzipped CIB gets a weak ETag, which still
+	// matches, and the 304 isn't compressed
+	w = get("/api/v1/configuration/cib.xml", "", true)
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("ETag") != "W/"+etag {
+		t.Fatal("expected a gzipped CIB with a weak ETag, got ", w.Header())
+	}
+	for _, match := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		w = get("/api/v1/configuration/cib.xml", match, true)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("Content-Encoding") != "" {
+			t.Fatal("expected an empty 304 for ", match, ", got ", w.Code, " ", w.Header())
+		}
+	}
+
+	// other representations have their own ETags
+	w = get("/api/v1/cib?xpath=//node", etag, false)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatal("expected the XPath result with its own ETag, got ", w.Code, " ", w.Header().Get("ETag"))
+	}
+	w = get("/api/v1/cib?xpath=//node", w.Header().Get("ETag"), false)
+	if w.Code != http.StatusNotModified {
+		t.Fatal("expected 304 for the XPath result, got ", w.Code)
+	}
+
+	// a new CIB doesn't match
+	xmldoc = `<cib epoch="2"><configuration><nodes/></configuration></cib>`
+	handler.cib.xmldoc, handler.cib.hash = xmldoc, cibHash(xmldoc)
+	w = get("/api/v1/configuration/cib.xml", etag, false)
+	if w.Code != http.StatusOK || w.Body.String() != xmldoc {
+		t.Fatal("expected the new CIB, got ", w.Code, " ", w.Body.String())
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	trace, parent, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || fmt.Sprintf("%x", trace) != "4bf92f3577b34da6a3ce929d0e0e4736" || fmt.Sprintf("%x", parent) != "00f067aa0ba902b7" {
+		t.Fatal("failed to parse traceparent: ", ok, trace, parent)
+	}
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+	} {
+		if _, _, ok := parseTraceparent(bad); ok {
+			t.Error("accepted invalid traceparent ", bad)
+		}
+	}
+}
+
+func TestTracingHandler(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if r.URL.Path != "/v1/traces" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- body
+	}))
+	defer collector.Close()
+
+	tracer := newSpanExporter(collector.URL)
+	handler := NewTracingHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v struct{}
+		unmarshalCib(r.Context(), "<cib/>", &v)
+		w.WriteHeader(http.StatusTeapot)
+	}), tracer)
+	r := httptest.NewRequest("GET", "/api/v1/properties", nil)
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	tracer.stop()
+
+	body := <-received
+	data, _ := json.Marshal(body)
+	for _, expected := range []string{
+		`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"`,
+		`"parentSpanId":"00f067aa0ba902b7"`,
+		`"name":"GET /api/v1/properties"`,
+		`"name":"parse cib"`,
+		`"stringValue":"418"`,
+	} {
+		if !strings.Contains(string(data), expected) {
+			t.Error("expected ", expected, " in ", string(data))
+		}
+	}
+}
+
+func TestCheckCibSession(t *testing.T) {
+	xmldoc := `<cib><configuration/><status>
+		<node_state id="1" uname="alice"><transient_attributes id="1"><instance_attributes id="status-1">
+			<nvpair id="status-1-hawk_session_hacluster" name="hawk_session_hacluster" value="abc123"/>
+			<nvpair id="status-1-hawk_session_" name="hawk_session_" value="nobody"/>
+		</instance_attributes></transient_attributes></node_state>
+		<node_state id="2" uname="bob"><transient_attributes id="2"><instance_attributes id="status-2">
+			<nvpair id="status-2-hawk_session_hacluster" name="hawk_session_hacluster" value="def456"/>
+		</instance_attributes></transient_attributes></node_state>
+	</status></cib>`
+	status, err := parseCibStatus(xmldoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := status.hawkSessions()
+	if len(sessions) != 1 || len(sessions["hacluster"]) != 2 {
+		t.Fatal("unexpected sessions ", sessions)
+	}
+	if !checkCibSession(sessions["hacluster"], "abc123") || !checkCibSession(sessions["hacluster"], "def456") {
+		t.Error("expected the sessions to be found")
+	}
+	if checkCibSession(sessions["hacluster"], "wrong") || checkCibSession(sessions["other"], "abc123") || checkCibSession([]string{""}, "") {
+		t.Error("accepted an invalid session")
+	}
+	if checkCookieFallback("reject") != nil || checkCookieFallback("cookie") == nil {
+		t.Error("unexpected cookie fallback validation")
+	}
+}
+
+func TestCookieFallbackCib(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hawk-cookie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	accept := dir + "/accept"
+	if err := ioutil.WriteFile(accept, []byte("#!/bin/sh\ncat >/dev/null\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(a, c string) { attrdUpdater, hawkChkpwd = a, c }(attrdUpdater, hawkChkpwd)
+	attrdUpdater, hawkChkpwd = dir+"/attrd_updater", accept
+
+	config := Config{Route: []ConfigRoute{{Handler: "api/v1", Path: "/api/v1"}}}
+	handler := NewRouteHandler(&config, nil)
+	handler.auth.cookieFallback = cookieFallbackCib
+	handler.auth.lockouts = newClientAuthLimiter(2, time.Minute, time.Minute)
+	// the sessions come from the fetcher, a request
+	// mustn't look for them in the CIB itself
+	handler.cib.xmldoc = `<cib><configuration/><status><node_state id="1" uname="alice">
+		<transient_attributes id="1"><instance_attributes id="status-1">
+			<nvpair id="status-1-hawk_session_hacluster" name="hawk_session_hacluster" value="stale"/>
+		</instance_attributes></transient_attributes></node_state></status></cib>`
+	handler.cib.sessions = map[string][]string{"hacluster": {"abc123"}}
+	saved := cibParses
+	defer func() { cibParses = saved }()
+	cibParses = newParseLimiter(1, 0)
+	cibParses.acquire(context.Background())
+	defer cibParses.release()
+
+	request := func(session string, basic bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v1/features", nil)
+		r.AddCookie(&http.Cookie{Name: "hawk_remember_me_id", Value: "hacluster"})
+		r.AddCookie(&http.Cookie{Name: "hawk_remember_me_key", Value: session})
+		if basic {
+			r.SetBasicAuth("hacluster", "secret")
+		}
+		w := httptest.NewRecorder()
+		handler.serveAPI(w, r, &config.Route[0])
+		return w
+	}
+	if w := request("abc123", false); w.Code == http.StatusUnauthorized {
+		t.Fatal("expected the session to be accepted, got ", w.Code)
+	}
+	// an invalid cookie doesn't fall back to basic auth
+	if w := request("stale", true); w.Code != http.StatusUnauthorized {
+		t.Fatal("expected an invalid session to be refused, got ", w.Code)
+	}
+	if w := request("wrong", false); w.Code != http.StatusUnauthorized {
+		t.Fatal("expected an invalid session to be refused, got ", w.Code)
+	}
+	if w := request("abc123", false); w.Code != http.StatusTooManyRequests {
+		t.Fatal("expected the failures to lock the client out, got ", w.Code)
+	}
+}
+
+func TestTopology(t *testing.T) {
+	xmldoc := `<cib><configuration><nodes><node id="1" uname="alice"/></nodes>
+		<resources>
+			<primitive id="ip"/>
+			<group id="grp"><primitive id="fs"/><primitive id="db"/></group>
+		</resources>
+		<constraints>
+			<rsc_colocation id="col" rsc="grp" with-rsc="ip" score="INFINITY"/>
+			<rsc_order id="ord" first="ip" then="grp"/>
+			<rsc_order id="ghost" first="ip" then="missing"/>
+			<rsc_colocation id="set" score="100"><resource_set id="s1"><resource_ref id="fs"/><resource_ref id="db"/></resource_set></rsc_colocation>
+		</constraints></configuration><status>
+		<node_state id="1" uname="alice" in_ccm="true" crmd="online" join="member"><lrm><lrm_resources>
+			<lrm_resource id="ip"><lrm_rsc_op operation="start" call-id="1" rc-code="0" op-status="0"/></lrm_resource>
+		</lrm_resources></lrm></node_state>
+	</status></cib>`
+	status, err := parseCibStatus(xmldoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc cibConstraintsDoc
+	if err := xml.Unmarshal([]byte(xmldoc), &doc); err != nil {
+		t.Fatal(err)
+	}
+	graph := buildTopology(status, &doc.Constraints)
+	if len(graph.Nodes) != 5 {
+		t.Fatal("expected 4 resources and 1 node, got ", graph.Nodes)
+	}
+	links := make(map[string]bool)
+	for _, l := range graph.Links {
+		links[l.Type+" "+l.Source+" "+l.Target] = true
+	}
+	for _, expected := range []string{
+		"colocation resource/grp resource/ip",
+		"order resource/ip resource/grp",
+		"colocation resource/db resource/fs",
+		"member resource/fs resource/grp",
+		"placement resource/ip node/alice",
+	} {
+		if !links[expected] {
+			t.Error("missing link ", expected, " in ", graph.Links)
+		}
+	}
+	if len(graph.Links) != 6 {
+		t.Error("expected 6 links, got ", graph.Links)
+	}
+
+	empty := buildTopology(&cibStatusDoc{}, &Constraints{})
+	data, _ := json.Marshal(empty)
+	if string(data) != `{"nodes":[],"links":[]}` {
+		t.Error("expected an empty graph, got ", string(data))
+	}
+}
+
+func TestNodeAttributes(t *testing.T) {
+	xmldoc := `<cib><configuration><nodes>
+		<node id="1" uname="alice">
+			<instance_attributes id="alice-ia"><nvpair id="a-s" name="standby" value="off"/><nvpair id="a-r" name="rack" value="r1"/></instance_attributes>
+			<utilization id="alice-u"><nvpair id="a-cpu" name="cpu" value="4"/></utilization>
+		</node>
+		<node id="2" uname="bob"/>
+	</nodes></configuration></cib>`
+	get := func(node string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleApiNodeAttributes(w, httptest.NewRequest("GET", "/api/v1/nodes/"+node+"/attributes", nil), xmldoc, node)
+		return w
+	}
+	expected := `{"node":"alice","id":"1","attributes":{"rack":"r1","standby":"off"},"utilization":{"cpu":"4"}}` + "\n"
+	for _, node := range []string{"alice", "1"} {
+		if w := get(node); w.Code != http.StatusOK || w.Body.String() != expected {
+			t.Fatal("unexpected attributes for ", node, ": ", w.Code, " ", w.Body.String())
+		}
+	}
+	if w := get("bob"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"attributes":{},"utilization":{}`) {
+		t.Fatal("expected empty attributes, got ", w.Code, " ", w.Body.String())
+	}
+	if w := get("carol"); w.Code != http.StatusNotFound {
+		t.Fatal("expected 404 for an unknown node, got ", w.Code)
+	}
+}
+
+func TestParseLimiter(t *testing.T) {
+	limiter := newParseLimiter(1, 1)
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan error)
+	go func() {
+		acquired <- limiter.acquire(context.Background())
+	}()
+	for {
+		limiter.lock.Lock()
+		waiting := limiter.waiting
+		limiter.lock.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := limiter.acquire(context.Background()); err != errParseQueueFull {
+		t.Fatal("expected the queue to be full, got ", err)
+	}
+	limiter.release()
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+
+	saved := cibParses
+	defer func() { cibParses = saved }()
+	cibParses = newParseLimiter(1, 0)
+	cibParses.acquire(context.Background())
+	w := httptest.NewRecorder()
+	handleApiTickets(w, httptest.NewRequest("GET", "/api/v1/tickets", nil), "<cib/>")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatal("expected 503 with Retry-After, got ", w.Code)
+	}
+	// the properties and the views served to GraphQL
+	// are bounded too
+	w = httptest.NewRecorder()
+	handleApiProperties(w, httptest.NewRequest("GET", "/api/v1/properties", nil), "<cib/>")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatal("expected 503 with Retry-After for the properties, got ", w.Code)
+	}
+	handler := NewRouteHandler(&Config{}, nil)
+	if _, err := handler.view(context.Background(), "nodes", cibSnapshot{xmldoc: "<cib/>", hash: "h"}); err != errParseQueueFull {
+		t.Fatal("expected the view to be bounded, got ", err)
+	}
+}
+
+func TestCibJSON(t *testing.T) {
+	handler := NewRouteHandler(&Config{}, nil)
+	w := httptest.NewRecorder()
+	handler.serveCibJSON(w, cibSnapshot{})
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "error") {
+		t.Fatal("expected 503 without a CIB, got ", w.Code, " ", w.Body.String())
+	}
+
+	xmldoc := `<cib><configuration><nodes><node id="1" uname="alice"/></nodes>
+		<resources><primitive id="ip" class="ocf" provider="heartbeat" type="IPaddr2"/></resources>
+	</configuration><status/></cib>`
+	w = httptest.NewRecorder()
+	handler.serveCibJSON(w, cibSnapshot{xmldoc: xmldoc, hash: cibHash(xmldoc)})
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+	for _, key := range []string{"nodes", "resources", "constraints", "cluster", "properties", "node_status"} {
+		if _, ok := doc[key]; !ok {
+			t.Error("missing ", key, " in ", w.Body.String())
+		}
+	}
+	if string(doc["resource_status"]) != `[{"id":"ip","parent":"","class":"ocf","provider":"heartbeat","type":"IPaddr2","running_on":[],"failed_actions":0}]` {
+		t.Error("unexpected resource_status: ", string(doc["resource_status"]))
+	}
+}
+
+func TestCibStream(t *testing.T) {
+	handler := NewRouteHandler(&Config{}, nil)
+	handler.cib.xmldoc, handler.cib.hash = "<cib/>", cibHash("<cib/>")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.serveCibStream(w, r)
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(line, "data: ") {
+				return line
+			}
+		}
+	}
+	if line := readEvent(); !strings.Contains(line, `"cib":"\u003ccib/\u003e"`) {
+		t.Fatal("expected the current CIB, got ", line)
+	}
+
+	// a subscriber that doesn't read keeps the latest
+	// stream_buffer CIBs
+	handler.cib.streams = streamPolicy{Buffer: 1}
+	ch, _ := handler.cib.Subscribe()
+	handler.cib.lock.Lock()
+	for _, doc := range []string{"<cib epoch=\"1\"/>", "<cib epoch=\"2\"/>"} {
+		handler.cib.xmldoc, handler.cib.hash = doc, cibHash(doc)
+		handler.cib.notifyCibSubscribers()
+	}
+	handler.cib.lock.Unlock()
+	if snap := <-ch; snap.xmldoc != "<cib epoch=\"2\"/>" {
+		t.Fatal("expected the latest CIB, got ", snap.xmldoc)
+	}
+	handler.cib.Unsubscribe(ch)
+	// the stream may or may not have received the
+	// first one, but ends with the latest
+	for !strings.Contains(readEvent(), `epoch=\"2\"`) {
+	}
+}
+
+func TestSlowStreamSubscriber(t *testing.T) {
+	if _, err := newStreamPolicy(0, streamDropOldest); err == nil {
+		t.Error("expected a buffer of 0 to be refused")
+	}
+	if _, err := newStreamPolicy(4, "block"); err == nil {
+		t.Error("expected an unknown policy to be refused")
+	}
+	if (streamPolicy{}).bufferSize() != defaultStreamBuffer {
+		t.Error("expected the default buffer for a zero policy")
+	}
+
+	// notify sends n node changes and a CIB to
+	// subscribers that never read, and fails if that
+	// blocks while holding the lock
+	notify := func(acib *AsyncCib, n int) {
+		done := make(chan struct{})
+		go func() {
+			acib.lock.Lock()
+			for i := 0; i < n; i++ {
+				acib.notifyNodeChanges([]nodeStatus{{Name: "alice", Online: i%2 == 0}})
+			}
+			acib.xmldoc, acib.hash = "<cib/>", cibHash("<cib/>")
+			acib.notifyCibSubscribers()
+			acib.notifyCibSubscribers()
+			acib.lock.Unlock()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("notifying a slow subscriber blocked")
+		}
+	}
+
+	policy, err := newStreamPolicy(2, streamDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acib := &AsyncCib{streams: policy}
+	nodes, _ := acib.SubscribeNodes()
+	cibs, _ := acib.Subscribe()
+	notify(acib, 5)
+	// the oldest changes were dropped, the latest two kept
+	if len(nodes) != 2 || !acib.nodeSubs[nodes] {
+		t.Fatal("expected the subscriber to stay with a full buffer, got ", len(nodes))
+	}
+	if first, second := <-nodes, <-nodes; first.Online || !second.Online {
+		t.Fatal("expected the latest changes, got ", first, second)
+	}
+	if len(cibs) != 2 || !acib.cibSubs[cibs] {
+		t.Fatal("expected the CIB subscriber to stay with a full buffer, got ", len(cibs))
+	}
+
+	policy, err = newStreamPolicy(2, streamDisconnect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acib = &AsyncCib{streams: policy}
+	nodes, _ = acib.SubscribeNodes()
+	cibs, _ = acib.Subscribe()
+	notify(acib, 5)
+	if acib.nodeSubs[nodes] {
+		t.Fatal("expected the slow subscriber to be disconnected")
+	}
+	// two CIBs fit, so notify again to overflow
+	notify(acib, 0)
+	if acib.cibSubs[cibs] {
+		t.Fatal("expected the slow CIB subscriber to be disconnected")
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := <-cibs; !ok {
+			t.Fatal("expected the buffered CIBs before the end")
+		}
+	}
+	if _, ok := <-cibs; ok {
+		t.Fatal("expected the CIB channel to be closed")
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := <-nodes; !ok {
+			t.Fatal("expected the buffered changes before the end")
+		}
+	}
+	if _, ok := <-nodes; ok {
+		t.Fatal("expected the channel to be closed")
+	}
+}
+
+func TestDiffNodeStatuses(t *testing.T) {
+	alice := nodeStatus{Name: "alice", Online: true}
+	bob := nodeStatus{Name: "bob", Online: true}
+	for _, test := range []struct {
+		name          string
+		before, after []nodeStatus
+		changes       []nodeStatus
+	}{
+		{"unchanged", []nodeStatus{alice, bob}, []nodeStatus{bob, alice}, nil},
+		{"added", []nodeStatus{alice}, []nodeStatus{alice, bob}, []nodeStatus{bob}},
+		{"removed", []nodeStatus{alice, bob}, []nodeStatus{alice}, []nodeStatus{{Name: "bob", Removed: true}}},
+		{"changed", []nodeStatus{alice, bob}, []nodeStatus{alice, {Name: "bob", Online: true, Standby: true}}, []nodeStatus{{Name: "bob", Online: true, Standby: true}}},
+		{"all", []nodeStatus{alice}, []nodeStatus{{Name: "alice"}, bob}, []nodeStatus{{Name: "alice"}, bob}},
+		{"replaced", []nodeStatus{alice}, []nodeStatus{bob}, []nodeStatus{bob, {Name: "alice", Removed: true}}},
+		{"first", nil, []nodeStatus{alice}, []nodeStatus{alice}},
+	} {
+		if changes := diffNodeStatuses(test.before, test.after); !reflect.DeepEqual(changes, test.changes) {
+			t.Error(test.name, ": expected ", test.changes, ", got ", changes)
+		}
+	}
+}
+
+func TestNodeStream(t *testing.T) {
+	handler := NewRouteHandler(&Config{}, nil)
+	handler.cib.nodes = []nodeStatus{{Name: "alice", Online: true}, {Name: "bob", Online: true}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.serveNodeStream(w, r)
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatal("unexpected content type ", ct)
+	}
+	events := bufio.NewReader(resp.Body)
+	readEvent := func() (string, string) {
+		var event string
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(line, "event: ") {
+				event = strings.TrimSpace(strings.TrimPrefix(line, "event: "))
+			}
+			if strings.HasPrefix(line, "data: ") {
+				return event, strings.TrimSpace(strings.TrimPrefix(line, "data: "))
+			}
+		}
+	}
+	if event, data := readEvent(); event != "nodes" || !strings.Contains(data, `"name":"alice"`) || !strings.Contains(data, `"name":"bob"`) {
+		t.Fatal("expected the current nodes, got ", event, " ", data)
+	}
+
+	handler.cib.lock.Lock()
+	handler.cib.notifyNodeChanges([]nodeStatus{{Name: "alice", Online: true, Standby: true}})
+	handler.cib.lock.Unlock()
+	if event, data := readEvent(); event != "node" || data != `{"name":"alice","online":true,"standby":true,"maintenance":false}` {
+		t.Fatal("expected alice to change, got ", event, " ", data)
+	}
+	if event, data := readEvent(); event != "node" || data != `{"name":"bob","online":false,"standby":false,"maintenance":false,"removed":true}` {
+		t.Fatal("expected bob to be removed, got ", event, " ", data)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for cn
+// and its key to dir.
+func writeTestCert(t *testing.T, dir, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hawk-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir, "one")
+	certs, err := newCertHolder(certFile, keyFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := baseTLSConfig(&Config{TLSMinVersion: "1.2"})
+	config, err := listenerTLSConfig(&ConfigListener{}, base, certs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reload := newReloader()
+	reload.add("certificates", func() error { return reloadCerts([]*certHolder{certs}) })
+
+	handler := NewRouteHandler(&Config{}, nil)
+	handler.cib.xmldoc, handler.cib.hash = "<cib/>", cibHash("<cib/>")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			handler.serveCibStream(w, r)
+		}
+	})}
+	go srv.Serve(tls.NewListener(ln, config))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	url := "https://" + ln.Addr().String()
+	peer := func() string {
+		resp, err := client.Get(url + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		client.Transport.(*http.Transport).CloseIdleConnections()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if cn := peer(); cn != "one" {
+		t.Fatal("expected the first certificate, got ", cn)
+	}
+
+	stream, err := client.Get(url + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+	events := bufio.NewReader(stream.Body)
+	readEvent := func() string {
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				t.Fatal("stream ended: ", err)
+			}
+			if strings.HasPrefix(line, "data: ") {
+				return line
+			}
+		}
+	}
+	readEvent()
+
+	writeTestCert(t, dir, "two")
+	reload.reload(1)
+	if cn := peer(); cn != "two" {
+		t.Fatal("expected the reloaded certificate, got ", cn)
+	}
+
+	// the stream opened before the reload keeps going
+	handler.cib.lock.Lock()
+	handler.cib.xmldoc, handler.cib.hash = "<cib epoch=\"1\"/>", cibHash("<cib epoch=\"1\"/>")
+	handler.cib.notifyCibSubscribers()
+	handler.cib.lock.Unlock()
+	if line := readEvent(); !strings.Contains(line, `epoch=\"1\"`) {
+		t.Fatal("expected the new CIB on the stream, got ", line)
+	}
+
+	// a broken pair keeps the current certificate
+	ioutil.WriteFile(keyFile, []byte("garbage"), 0600)
+	if err := reloadCerts([]*certHolder{certs}); err == nil {
+		t.Fatal("expected an error for a broken key")
+	}
+	if cn := peer(); cn != "two" {
+		t.Fatal("expected the previous certificate to be kept, got ", cn)
+	}
+}
+
+func TestWaitForCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hawk-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	staging := dir + "/staging"
+	if err := os.Mkdir(staging, 0700); err != nil {
+		t.Fatal(err)
+	}
+	stagedCert, stagedKey := writeTestCert(t, staging, "late")
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+
+	if _, err := loadKeyPair(certFile, keyFile, 0); err == nil {
+		t.Fatal("expected a missing certificate to fail without waiting")
+	}
+
+	// the pair is only put in place after the first
+	// attempt
+	put := make(chan error, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		err := os.Rename(stagedKey, keyFile)
+		if err == nil {
+			err = os.Rename(stagedCert, certFile)
+		}
+		put <- err
+	}()
+	start := time.Now()
+	cert, err := loadKeyPair(certFile, keyFile, 10*time.Second)
+	if err := <-put; err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatal("expected the certificate to be loaded once it appeared, got ", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatal("unexpected wait ", elapsed)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || leaf.Subject.CommonName != "late" {
+		t.Fatal("expected the late certificate, got ", leaf, err)
+	}
+}
+
+func TestShutdownServers(t *testing.T) {
+	started := make(chan bool)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			started <- true
+			<-r.Context().Done()
+			return
+		}
+		started <- true
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, "done")
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+	url := "http://" + ln.Addr().String()
+
+	type result struct {
+		body string
+		err  error
+	}
+	get := func(path string) chan result {
+		results := make(chan result, 1)
+		go func() {
+			resp, err := http.Get(url + path)
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			results <- result{string(body), err}
+		}()
+		<-started
+		return results
+	}
+	request, stream := get("/"), get("/stream")
+
+	start := time.Now()
+	shutdownServers([]*http.Server{srv}, 500*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("shutdown took ", elapsed)
+	}
+	if r := <-request; r.err != nil || r.body != "done" {
+		t.Fatalf("expected the request in progress to complete, got %q, %v", r.body, r.err)
+	}
+	if r := <-stream; r.err == nil {
+		t.Fatal("expected the stream to be closed at the deadline")
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Fatal("expected ErrServerClosed, got ", err)
+	}
+}
+
+func TestUserRateLimit(t *testing.T) {
+	limits := newUserRateLimiter(ConfigRateLimit{Rate: 1, Burst: 2}, ConfigRateLimit{Rate: 10})
+	now := time.Now()
+	limits.now = func() time.Time { return now }
+	auth := &hawkAuth{admins: map[string]bool{"root": true}, limits: limits}
+
+	for i := 0; i < 2; i++ {
+		if !auth.checkRateLimit(httptest.NewRecorder(), "hacluster") {
+			t.Fatal("rejected a request within the burst")
+		}
+	}
+	w := httptest.NewRecorder()
+	if auth.checkRateLimit(w, "hacluster") {
+		t.Fatal("expected the request over the limit to be rejected")
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 429 with Retry-After: 1, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	for i := 0; i < 20; i++ {
+		if !auth.checkRateLimit(httptest.NewRecorder(), "root") {
+			t.Fatal("rejected an admin request within the admin burst")
+		}
+	}
+	if auth.checkRateLimit(httptest.NewRecorder(), "root") {
+		t.Fatal("expected the admin request over the limit to be rejected")
+	}
+
+	now = now.Add(time.Second)
+	if !auth.checkRateLimit(httptest.NewRecorder(), "hacluster") {
+		t.Fatal("expected a token after a second")
+	}
+	now = now.Add(rateIdleSweep)
+	auth.checkRateLimit(httptest.NewRecorder(), "other")
+	if len(limits.users) != 1 {
+		t.Fatal("expected the idle buckets to be forgotten, got ", len(limits.users))
+	}
+}
+
+func TestBaseTLSConfig(t *testing.T) {
+	config, err := baseTLSConfig(&Config{TLSMinVersion: "1.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || config.CipherSuites != nil || config.NextProtos != nil {
+		t.Fatalf("unexpected TLS config %+v", config)
+	}
+	config, err = baseTLSConfig(&Config{
+		TLSMinVersion: "1.1",
+		TLSCiphers:    []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", " TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS11 || len(config.CipherSuites) != 2 || config.CipherSuites[1] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Fatalf("unexpected TLS config %+v", config)
+	}
+	if _, err := baseTLSConfig(&Config{TLSMinVersion: "1.4"}); err == nil {
+		t.Fatal("expected an error for an invalid version")
+	}
+	if _, err := baseTLSConfig(&Config{TLSMinVersion: "1.2", TLSCiphers: []string{"TLS_NONE"}}); err == nil {
+		t.Fatal("expected an error for an unknown cipher suite")
+	}
+}
+
+func TestHealthReady(t *testing.T) {
+	handler := NewRouteHandler(&Config{}, nil)
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	if code := get("/health"); code != http.StatusOK {
+		t.Fatal("expected /health to return 200, got ", code)
+	}
+	if code := get("/ready"); code != http.StatusServiceUnavailable {
+		t.Fatal("expected /ready to return 503 without a CIB, got ", code)
+	}
+	handler.cib.xmldoc = "<cib/>"
+	if code := get("/ready"); code != http.StatusOK {
+		t.Fatal("expected /ready to return 200 with a CIB, got ", code)
+	}
+}
+
+func TestOverview(t *testing.T) {
+	handler := NewRouteHandler(&Config{}, nil)
+	xmldoc := `<cib><configuration><nodes><node id="1" uname="alice"/><node id="2" uname="bob"/></nodes>
+		<resources><primitive id="ip" class="ocf" provider="heartbeat" type="IPaddr2"/></resources>
+	</configuration><status>
+		<node_state id="1" uname="alice" crmd="online" join="member" expected="member" in_ccm="true">
+			<lrm><lrm_resources><lrm_resource id="ip"><lrm_rsc_op operation="start" call-id="1" rc-code="0" op-status="0"/></lrm_resource></lrm_resources></lrm>
+		</node_state>
+		<node_state id="2" uname="bob" crmd="online" join="member" expected="member" in_ccm="true"/>
+	</status></cib>`
+	w := httptest.NewRecorder()
+	handler.serveOverview(w, cibSnapshot{xmldoc: xmldoc, hash: cibHash(xmldoc)})
+	expected := `{"healthy":true,"nodes_online":2,"nodes_total":2,"resources_started":1,"resources_total":1,"failures":0}` + "\n"
+	if w.Body.String() != expected {
+		t.Fatal("unexpected overview: ", w.Body.String())
+	}
+
+	stopped := strings.Replace(xmldoc, `rc-code="0"`, `rc-code="1"`, 1)
+	w = httptest.NewRecorder()
+	handler.serveOverview(w, cibSnapshot{xmldoc: stopped, hash: cibHash(stopped)})
+	var o overview
+	if err := json.Unmarshal(w.Body.Bytes(), &o); err != nil {
+		t.Fatal(err)
+	}
+	if o.Healthy || o.ResourcesStarted != 0 || o.Failures != 1 {
+		t.Fatalf("expected a failed, unhealthy overview, got %+v", o)
+	}
+}
+
+func TestStatusSummary(t *testing.T) {
+	handler := NewRouteHandler(&Config{}, nil)
+	w := httptest.NewRecorder()
+	handler.serveStatusSummary(w, cibSnapshot{})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatal("expected 503 without a CIB, got ", w.Code)
+	}
+
+	xmldoc := `<cib><configuration><nodes><node id="1" uname="alice"/>
+		<node id="2" uname="bob"><instance_attributes id="bob-ia"><nvpair id="bob-standby" name="standby" value="on"/></instance_attributes></node></nodes>
+		<resources><primitive id="ip" class="ocf" type="IPaddr2"/><primitive id="web" class="ocf" type="apache"/>
+		<master id="ms"><primitive id="db" class="ocf" type="mysql"/></master></resources>
+	</configuration><status>
+		<node_state id="1" uname="alice" crmd="online" join="member" in_ccm="true"><lrm><lrm_resources>
+			<lrm_resource id="ip"><lrm_rsc_op operation="start" call-id="1" rc-code="0" op-status="0"/></lrm_resource>
+			<lrm_resource id="db:0"><lrm_rsc_op operation="promote" call-id="2" rc-code="0" op-status="0"/></lrm_resource>
+		</lrm_resources></lrm></node_state>
+		<node_state id="2" uname="bob" crmd="offline" join="down" in_ccm="false"><lrm><lrm_resources>
+			<lrm_resource id="db:1"><lrm_rsc_op operation="monitor" call-id="3" rc-code="0" op-status="0"/></lrm_resource>
+		</lrm_resources></lrm></node_state>
+	</status></cib>`
+	w = httptest.NewRecorder()
+	handler.serveStatusSummary(w, cibSnapshot{xmldoc: xmldoc, hash: cibHash(xmldoc)})
+	expected := `{"nodes":[{"name":"alice","online":true,"standby":false,"maintenance":false},` +
+		`{"name":"bob","online":false,"standby":true,"maintenance":false}],` +
+		`"resources":[{"id":"ip","role":"Started","node":"alice"},{"id":"web","role":"Stopped"},` +
+		`{"id":"db","role":"Promoted","node":"alice"},{"id":"db","role":"Started","node":"bob"}]}` + "\n"
+	if w.Code != http.StatusOK || w.Body.String() != expected {
+		t.Fatal("unexpected status summary: ", w.Code, " ", w.Body.String())
+	}
+
+	// absent sections give empty lists
+	empty := `<cib><configuration/></cib>`
+	w = httptest.NewRecorder()
+	handler.serveStatusSummary(w, cibSnapshot{xmldoc: empty, hash: cibHash(empty)})
+	if w.Code != http.StatusOK || w.Body.String() != `{"nodes":[],"resources":[]}`+"\n" {
+		t.Fatal("unexpected status summary of an empty CIB: ", w.Code, " ", w.Body.String())
+	}
+}
+
+func TestXPath(t *testing.T) {
+	handler := NewRouteHandler(&Config{}, nil)
+	xmldoc := `<cib epoch="3"><configuration><resources>
+		<primitive id="ip" class="ocf" type="IPaddr2"><instance_attributes id="ip-ia"><nvpair id="ip-addr" name="ip" value="10.0.0.1"/></instance_attributes></primitive>
+		<group id="g"><primitive id="web" class="ocf" type="apache"/><primitive id="db" class="ocf" type="mysql"/></group>
+	</resources></configuration><status/></cib>`
+	snap := cibSnapshot{xmldoc: xmldoc, hash: cibHash(xmldoc)}
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{`//primitive[@id='web']`, `<xpath-query><primitive id="web" class="ocf" type="apache"/></xpath-query>`},
+		{`/cib/configuration/resources/group/primitive[2]/@id/..`, ""},
+		{`//group/primitive[2]`, `<xpath-query><primitive id="db" class="ocf" type="mysql"/></xpath-query>`},
+		{`//primitive[instance_attributes/nvpair/@value="10.0.0.1"]/instance_attributes/nvpair`, `<xpath-query><nvpair id="ip-addr" name="ip" value="10.0.0.1"/></xpath-query>`},
+		{`//primitive[@type='mysql' or @type='apache'][not(@id='db')]`, `<xpath-query><primitive id="web" class="ocf" type="apache"/></xpath-query>`},
+		{`//primitive[@id='db'] | //primitive[@id='ip']/..`, `<xpath-query><resources>`},
+		{`//nvpair/../../../group[@id = 'g']/*[1]`, `<xpath-query><primitive id="web" class="ocf" type="apache"/></xpath-query>`},
+		{`/cib[@epoch=3]/status`, `<xpath-query><status/></xpath-query>`},
+		{`//clone`, `<xpath-query></xpath-query>`},
+		// the document node is the whole document
+		{`/`, `<xpath-query><cib epoch="3"><configuration>`},
+		{`//.`, `<xpath-query><cib epoch="3"><configuration>`},
+		{`/cib/..`, `<xpath-query><cib epoch="3"><configuration>`},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.serveCibXPath(w, httptest.NewRequest("GET", "/api/v1/cib", nil), snap, test.expr)
+		body := strings.TrimSuffix(w.Body.String(), "\n")
+		if test.expected == "" {
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected 400, got %d %s", test.expr, w.Code, body)
+			}
+			continue
+		}
+		if w.Code != http.StatusOK || !strings.HasPrefix(body, test.expected) {
+			t.Errorf("%s: unexpected result %d %s", test.expr, w.Code, body)
+		}
+		if err := xml.Unmarshal([]byte(body), new(struct{})); err != nil {
+			t.Errorf("%s: not well-formed: %s %s", test.expr, err, body)
+		}
+	}
+
+	for _, expr := range []string{`//primitive[`, `//primitive[@id='x]`, `child::cib`, `//primitive/@id`, `count(//primitive)`, `//primitive]`} {
+		w := httptest.NewRecorder()
+		handler.serveCibXPath(w, httptest.NewRequest("GET", "/api/v1/cib", nil), snap, expr)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d %s", expr, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	paths := map[string]string{
+		"/api/v1/configuration/nodes/alice": "/api/v1/configuration/nodes/:id",
+		"/api/v1/configuration/resources/":  "/api/v1/configuration/resources",
+		"/api/v1/cib.json":                  "/api/v1/cib.json",
+		"/metrics":                          "/metrics",
+		"/dashboard/index.html":             "other",
+	}
+	for path, expected := range paths {
+		if label := metricPath(path, http.StatusOK); label != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, label)
+		}
+	}
+	if label := metricPath("/api/v1/nonsense", http.StatusNotFound); label != "other" {
+		t.Error("expected 404 to be counted as other, got ", label)
+	}
+
+	handler := NewMetricsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unauthorized request.", 401)
+	}))
+	before := httpRequests.values[httpRequests.key([]string{"/api/v1/configuration/nodes/:id", "401"})]
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/configuration/nodes/bob", nil))
+	if after := httpRequests.values[httpRequests.key([]string{"/api/v1/configuration/nodes/:id", "401"})]; after != before+1 {
+		t.Fatal("expected the request to be counted, got ", after)
+	}
+
+	var buf bytes.Buffer
+	age := newGaugeFunc("test_age_seconds", "Test.", func() (float64, bool) { return 2.5, true })
+	age.writeTo(&buf)
+	if !strings.Contains(buf.String(), "\ntest_age_seconds 2.5\n") {
+		t.Fatal("unexpected gauge output: ", buf.String())
+	}
+
+	// the endpoint is served without authentication
+	w := httptest.NewRecorder()
+	NewRouteHandler(&Config{}, nil).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "# TYPE hawk_http_requests_total counter") {
+		t.Fatal("unexpected /metrics response: ", w.Code, w.Body.String())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, 8*time.Second)
+	for _, max := range []time.Duration{1, 2, 4, 8, 8, 8} {
+		max *= time.Second
+		if delay := b.next(); delay < max/2 || delay > max {
+			t.Fatalf("expected a delay between %s and %s, got %s", max/2, max, delay)
+		}
+	}
+	b.reset()
+	if delay := b.next(); delay > time.Second {
+		t.Fatal("expected the base delay after reset, got ", delay)
+	}
+}
+
+type fakeCibDoc struct {
+	xml string
+}
+
+func (doc *fakeCibDoc) ToString() string {
+	if doc.xml == "" {
+		panic("no document")
+	}
+	return doc.xml
+}
+
+func (doc *fakeCibDoc) Version() *pacemaker.CibVersion {
+	return nil
+}
+
+type fakeCibConn struct {
+	query  func() (cibDoc, error)
+	events []cibDoc
+	closed bool
+}
+
+func (c *fakeCibConn) Query() (cibDoc, error) {
+	return c.query()
+}
+
+func (c *fakeCibConn) Subscribe(fn func(event pacemaker.CibEvent, doc cibDoc)) error {
+	for _, doc := range c.events {
+		fn(pacemaker.UpdateEvent, doc)
+	}
+	return nil
+}
+
+func (c *fakeCibConn) Close() {
+	c.closed = true
+}
+
+func TestNotifyPanicReleasesLock(t *testing.T) {
+	acib := &AsyncCib{}
+	// sending on a closed subscriber panics while the
+	// lock is held
+	ch, _ := acib.SubscribeNodes()
+	close(ch)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the notification to panic")
+			}
+		}()
+		acib.notifyNewCib(&fakeCibDoc{xml: `<cib><configuration><nodes><node id="1" uname="alice"/></nodes></configuration><status/></cib>`})
+	}()
+	done := make(chan string)
+	go func() {
+		done <- acib.Get()
+	}()
+	select {
+	case xmldoc := <-done:
+		if !strings.Contains(xmldoc, "alice") {
+			t.Fatal("expected the new CIB, got ", xmldoc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lock is still held after the panic")
+	}
+}
+
+func TestCibFetcher(t *testing.T) {
+	cib := func(epoch string) cibDoc {
+		return &fakeCibDoc{xml: `<cib epoch="` + epoch + `"><configuration/><status/></cib>`}
+	}
+	conns := []*fakeCibConn{
+		{query: func() (cibDoc, error) { return nil, fmt.Errorf("connection lost") }},
+		{query: func() (cibDoc, error) { return nil, nil }},
+		{query: func() (cibDoc, error) { panic("query") }},
+		// an update without a document is skipped, and one
+		// that panics forces a reconnect
+		{query: func() (cibDoc, error) { return cib("1"), nil }, events: []cibDoc{nil, cib("2"), &fakeCibDoc{}}},
+		{query: func() (cibDoc, error) { return cib("3"), nil }},
+	}
+	opened := 0
+	acib := AsyncCib{
+		stop:  make(chan struct{}),
+		retry: newBackoff(time.Millisecond, time.Millisecond),
+		open: func() (cibConn, error) {
+			if opened == 0 {
+				opened++
+				return nil, fmt.Errorf("not running")
+			}
+			if opened > len(conns) {
+				return nil, fmt.Errorf("no more connections")
+			}
+			opened++
+			return conns[opened-2], nil
+		},
+	}
+	var updates []string
+	acib.onUpdate = func(xmldoc string, hash string) { updates = append(updates, xmldoc) }
+	done := make(chan struct{})
+	go func() {
+		acib.runFetcher()
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(acib.Get(), `epoch="3"`) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the fetcher to recover, got ", acib.Get())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	acib.Stop()
+	<-done
+	if len(updates) != 3 || !strings.Contains(updates[1], `epoch="2"`) {
+		t.Fatal("unexpected updates: ", updates)
+	}
+	for i, c := range conns {
+		if !c.closed {
+			t.Fatal("expected connection ", i, " to be closed")
+		}
+	}
+	var buf bytes.Buffer
+	cibFetchErrors.writeTo(&buf)
+	for _, stage := range []string{"connect", "query", "panic", "update"} {
+		if !strings.Contains(buf.String(), `stage="`+stage+`"`) {
+			t.Fatal("expected ", stage, " errors to be counted, got ", buf.String())
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := newAccessLogger(&out, logFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies, _ := newProxyTrust(nil)
+	handler := NewAccessLogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			http.Redirect(w, r, "https://example.com/", http.StatusMovedPermanently)
+			return
+		}
+		http.Error(w, "Unauthorized request.", 401)
+	}), logger, proxies)
+
+	expected := []struct {
+		path   string
+		status float64
+	}{{"/", 301}, {"/api/v1/cib", 401}}
+	for _, e := range expected {
+		r := httptest.NewRequest("GET", e.path, nil)
+		r.RemoteAddr = "192.0.2.10:4321"
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatal("expected one line per request, got ", out.String())
+	}
+	for i, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["path"] != expected[i].path || entry["status"] != expected[i].status || entry["remote"] != "192.0.2.10" ||
+			entry["method"] != "GET" || entry["size"].(float64) == 0 || entry["time"] == nil || entry["msg"] != "request" {
+			t.Errorf("unexpected access log line: %s", line)
+		}
+	}
+
+	if _, err := newAccessLogger(&out, "xml"); err == nil {
+		t.Fatal("expected an invalid log format to fail")
+	}
+}
+
+func TestSplitListenerPeekTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	split := &SplitListener{Listener: ln, peekTimeout: 100 * time.Millisecond}
+	defer split.Close()
+
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	io.WriteString(client, "GET / HTTP/1.0\r\n\r\n")
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := split.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+	select {
+	case c := <-accepted:
+		if c == nil || c.RemoteAddr().String() != client.LocalAddr().String() {
+			t.Fatal("expected the silent client to be skipped, got ", c)
+		}
+		c.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept is stuck on the silent client")
+	}
+	silent.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("expected the silent client to be disconnected, got ", err)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	origins, err := parseCORSOrigins([]string{"https://Dashboard.example.com/", "http://localhost:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	handler := NewCORSHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusUnauthorized)
+	}), origins)
+
+	request := func(method, path, origin string) *httptest.ResponseRecorder {
+		called = false
+		r := httptest.NewRequest(method, path, nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("OPTIONS", "/api/v1/cib", "https://dashboard.example.com")
+	if w.Code != http.StatusNoContent || called || w.Header().Get("Access-Control-Allow-Origin") != "https://dashboard.example.com" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" || w.Header().Get("Access-Control-Allow-Methods") == "" {
+		t.Fatal("expected an allowed preflight, got ", w.Code, w.Header())
+	}
+	w = request("GET", "/api/v1/cib", "http://localhost:8080")
+	if !called || w.Header().Get("Access-Control-Allow-Origin") != "http://localhost:8080" || w.Header().Get("Access-Control-Expose-Headers") == "" {
+		t.Fatal("expected CORS headers on an allowed request, got ", w.Header())
+	}
+	for _, origin := range []string{"https://evil.example.com", ""} {
+		w = request("GET", "/api/v1/cib", origin)
+		if !called || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Fatal("expected no CORS headers for origin ", origin, ", got ", w.Header())
+		}
+	}
+	w = request("OPTIONS", "/api/v1/cib", "https://evil.example.com")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("expected a preflight without CORS headers, got ", w.Code, w.Header())
+	}
+	w = request("GET", "/index.html", "https://dashboard.example.com")
+	if !called || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("expected static files to be left alone, got ", w.Header())
+	}
+
+	if _, err := parseCORSOrigins([]string{"https://example.com/app"}); err == nil {
+		t.Fatal("expected an origin with a path to be rejected")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleApiVersion(w, "")
+	expected := `{"version":"unknown","go_version":"` + runtime.Version() + `","validate_with":null,"crm_feature_set":null}` + "\n"
+	if w.Body.String() != expected {
+		t.Fatal("unexpected version without a CIB: ", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handleApiVersion(w, `<cib validate-with="pacemaker-3.0" crm_feature_set="3.0.14"><configuration/><status/></cib>`)
+	var info versionInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ValidateWith == nil || *info.ValidateWith != "pacemaker-3.0" || info.CrmFeatureSet == nil || *info.CrmFeatureSet != "3.0.14" {
+		t.Fatal("expected the CIB versions, got ", w.Body.String())
+	}
+}
+
+func TestPoll(t *testing.T) {
+	handler := NewRouteHandler(&Config{}, nil)
+	// the stored hash is returned rather than computed
+	// again
+	handler.cib.xmldoc = "<cib/>"
+	handler.cib.hash = "stored"
+
+	w := httptest.NewRecorder()
+	handler.servePoll(w, httptest.NewRequest("GET", "/api/v1/cib/poll?since=old", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "<cib/>" || w.Header().Get("X-Cib-Hash") != handler.cib.hash {
+		t.Fatal("expected the current CIB, got ", w.Code, " ", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.servePoll(w, httptest.NewRequest("GET", "/api/v1/cib/poll?wait=0&since="+handler.cib.hash, nil))
+	if w.Code != http.StatusNotModified {
+		t.Fatal("expected 304, got ", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.servePoll(w, httptest.NewRequest("GET", "/api/v1/cib/poll?wait=soon", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatal("expected 400, got ", w.Code)
+	}
+
+	// a CIB arriving once the poll has read the current
+	// one wakes it up, even without a fetcher to drain
+	// the waiters
+	subscribed := func() bool {
+		handler.cib.lock.Lock()
+		defer handler.cib.lock.Unlock()
+		return len(handler.cib.cibSubs) == 1
+	}
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.servePoll(w, httptest.NewRequest("GET", "/api/v1/cib/poll?wait=30&since=stored", nil))
+		done <- w
+	}()
+	for !subscribed() {
+		time.Sleep(time.Millisecond)
+	}
+	handler.cib.lock.Lock()
+	handler.cib.xmldoc, handler.cib.hash = "<cib epoch=\"1\"/>", "new"
+	handler.cib.notifyCibSubscribers()
+	handler.cib.lock.Unlock()
+	select {
+	case w = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the poll to wake up on the new CIB")
+	}
+	if w.Code != http.StatusOK || w.Header().Get("X-Cib-Hash") != "new" || w.Body.String() != "<cib epoch=\"1\"/>" {
+		t.Fatal("expected the new CIB, got ", w.Code, " ", w.Body.String())
+	}
+	if subscribed() {
+		t.Fatal("expected the poll to unsubscribe")
+	}
+
+	// a client going away ends the poll
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		w := httptest.NewRecorder()
+		handler.servePoll(w, httptest.NewRequest("GET", "/api/v1/cib/poll?wait=30&since=new", nil).WithContext(ctx))
+		done <- w
+	}()
+	for !subscribed() {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the poll to end with the request")
+	}
+}
+
+func TestTLSHandshakeFailureLog(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config.ErrorLog = stdlog.New(serverErrorLog{}, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	// speak garbage instead of TLS
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("\x16\x03\x01\x00\x05hello"))
+	conn.Close()
+
+	for i := 0; i < 100; i++ {
+		var buf bytes.Buffer
+		tlsHandshakeFailures.writeTo(&buf)
+		if strings.Contains(buf.String(), "hawk_tls_handshake_failures_total{reason=") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected a handshake failure to be counted")
+}
+
+func TestEncodeCBOR(t *testing.T) {
+	decoder := json.NewDecoder(strings.NewReader(`{"a":[1,-2,"x",true,null,1000],"b":1.5}`))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := encodeCBOR(&buf, value); err != nil {
+		t.Fatal(err)
+	}
+	expected := "a261618601216178f5f61903e86162fb3ff8000000000000"
+	if got := fmt.Sprintf("%x", buf.Bytes()); got != expected {
+		t.Fatal("expected ", expected, ", got ", got)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/configuration/cib.xml", nil)
+	r.Header.Set("Accept", "application/cbor, application/xml;q=0.5")
+	if !acceptsCBOR(r) {
+		t.Fatal("expected CBOR to be accepted")
+	}
+	r.Header.Set("Accept", "*/*")
+	if acceptsCBOR(r) {
+		t.Fatal("expected XML for a wildcard")
+	}
+}
+
+func TestDiffCibs(t *testing.T) {
+	client := `<cib epoch="1"><configuration><resources>` +
+		`<primitive id="rsc1" class="ocf" type="Dummy"/>` +
+		`<primitive id="rsc2" class="ocf" type="Dummy"/>` +
+		`</resources></configuration></cib>`
+	server := `<cib epoch="2"><configuration><resources>` +
+		`<primitive id="rsc1" class="ocf" type="IPaddr2"/>` +
+		`<primitive id="rsc3" class="ocf" type="Dummy"/>` +
+		`</resources></configuration></cib>`
+	diff, err := diffCibs(client, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Identical || len(diff.Added) != 1 || diff.Added[0].Path != "primitive[rsc3]" {
+		t.Fatal("expected rsc3 to be added, got ", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0].Path != "primitive[rsc2]" {
+		t.Fatal("expected rsc2 to be removed, got ", diff.Removed)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].Attributes[0].Name != "type" || *diff.Changed[0].Attributes[0].Server != "IPaddr2" {
+		t.Fatal("expected rsc1 type to change, got ", diff.Changed)
+	}
+
+	diff, err = diffCibs(server, server)
+	if err != nil || !diff.Identical {
+		t.Fatal("expected identical CIBs, got ", diff, err)
+	}
+	if _, err := diffCibs(`<error/>`, server); err == nil {
+		t.Fatal("expected error for a document that isn't a CIB")
+	}
+}
+
+func TestAuthFailureCache(t *testing.T) {
+	cache := newAuthFailureCache(time.Hour)
+	if cache.ttl != maxAuthFailureTTL {
+		t.Fatal("expected the TTL to be capped, got ", cache.ttl)
+	}
+	cache.ttl = 50 * time.Millisecond
+	cache.add("hacluster", "wrong")
+	if !cache.failed("hacluster", "wrong") {
+		t.Fatal("expected cached failure")
+	}
+	if cache.failed("hacluster", "right") || cache.failed("other", "wrong") {
+		t.Fatal("expected other credentials not to be cached")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if cache.failed("hacluster", "wrong") {
+		t.Fatal("expected the failure to expire")
+	}
+	var disabled *authFailureCache
+	disabled.add("hacluster", "wrong")
+	if disabled.failed("hacluster", "wrong") {
+		t.Fatal("expected no caching without a cache")
+	}
+}
+
+func TestAuthSuccessCache(t *testing.T) {
+	cache := newAuthSuccessCache(50 * time.Millisecond)
+	auth := &hawkAuth{successes: cache}
+	// hawk_chkpwd isn't installed here, so checking
+	// fails unless the credentials come from the cache
+	if ok, _ := auth.checkBasicAuth(context.Background(), "hacluster", "secret"); ok {
+		t.Fatal("expected the credentials to be checked")
+	}
+	if len(cache.successes) != 0 {
+		t.Fatal("expected failures not to be cached")
+	}
+	cache.add("hacluster", "secret")
+	if ok, _ := auth.checkBasicAuth(context.Background(), "hacluster", "secret"); !ok {
+		t.Fatal("expected the cached credentials to be accepted")
+	}
+	if cache.valid("hacluster", "other") || cache.valid("other", "secret") {
+		t.Fatal("expected other credentials not to be cached")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if cache.valid("hacluster", "secret") {
+		t.Fatal("expected the success to expire")
+	}
+	if newAuthSuccessCache(0).valid("hacluster", "secret") {
+		t.Fatal("expected no caching with a TTL of 0")
+	}
+}
+
+func TestInvalidateSessions(t *testing.T) {
+	config := Config{Route: []ConfigRoute{{Handler: "api/v1", Path: "/api/v1"}}}
+	handler := NewRouteHandler(&config, nil)
+	handler.auth.headerProxies, _ = newProxyTrust([]string{"192.0.2.1"})
+	handler.auth.admins = map[string]bool{"root": true}
+	handler.auth.successes = newAuthSuccessCache(time.Minute)
+	handler.auth.successes.add("alice", "old")
+	handler.auth.successes.add("alice", "new")
+	handler.auth.successes.add("bob", "secret")
+	invalidate := func(method, user, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/api/v1/admin/sessions/invalidate"+query, nil)
+		r.Header.Set(authUserHeader, user)
+		handler.serveAPI(w, r, &config.Route[0])
+		return w
+	}
+	if w := invalidate("POST", "bob", "?user=alice"); w.Code != http.StatusForbidden {
+		t.Fatal("expected non-admins to be refused, got ", w.Code)
+	}
+	if w := invalidate("GET", "root", "?user=alice"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatal("expected GET to be refused, got ", w.Code)
+	}
+	if w := invalidate("POST", "root", ""); w.Code != http.StatusBadRequest {
+		t.Fatal("expected a missing user to be refused, got ", w.Code)
+	}
+	w := invalidate("POST", "root", "?user=alice")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"user":"alice","cleared":2}` {
+		t.Fatal("unexpected response ", w.Code, " ", w.Body.String())
+	}
+	if handler.auth.successes.valid("alice", "new") || !handler.auth.successes.valid("bob", "secret") {
+		t.Fatal("expected only the entries of alice to be cleared")
+	}
+	if w := invalidate("POST", "root", "?user=alice"); !strings.Contains(w.Body.String(), `"cleared":0`) {
+		t.Fatal("expected nothing left to clear, got ", w.Body.String())
+	}
+}
+
+func TestAuthExecTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hawk-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a child keeping stdout open must not block the
+	// session check either
+	hang := dir + "/hang"
+	if err := ioutil.WriteFile(hang, []byte("#!/bin/sh\nsleep 10 &\nsleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(a, c string) { attrdUpdater, hawkChkpwd = a, c }(attrdUpdater, hawkChkpwd)
+	attrdUpdater, hawkChkpwd = hang, hang
+
+	auth := &hawkAuth{execTimeout: 100 * time.Millisecond, failures: newAuthFailureCache(time.Second)}
+	start := time.Now()
+	r := httptest.NewRequest("GET", "/api/v1/cib", nil)
+	r.AddCookie(&http.Cookie{Name: "hawk_remember_me_id", Value: "hacluster"})
+	r.AddCookie(&http.Cookie{Name: "hawk_remember_me_key", Value: "session"})
+	if _, ok, err := auth.checkHawkAuthMethods(r); ok || err != errAuthTimeout {
+		t.Fatal("expected the session check to time out, got ", ok, err)
+	}
+	r = httptest.NewRequest("GET", "/api/v1/cib", nil)
+	r.SetBasicAuth("hacluster", "secret")
+	if _, ok, err := auth.checkHawkAuthMethods(r); ok || err != errAuthTimeout {
+		t.Fatal("expected the password check to time out, got ", ok, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatal("the checks took ", elapsed)
+	}
+	if auth.failures.failed("hacluster", "secret") {
+		t.Fatal("expected the timeout not to be cached as a failure")
+	}
+}
+
+func TestFlagsOverrideFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hawk-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := dir + "/config.json"
+	js := `{"port": 8443, "stream_policy": "disconnect", "trust_auth_header": true, "cookie_fallback": "reject", "cors_origins": ["https://a.example"]}`
+	if err := ioutil.WriteFile(name, []byte(js), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{Port: 17630, StreamPolicy: streamDropOldest, CookieFallback: cookieFallbackBasic}
+	fs := flag.NewFlagSet("hawk-apiserver", flag.ContinueOnError)
+	parseFlags(fs, []string{"-config", name, "-port", "17630", "-stream-policy", streamDropOldest, "-trust-auth-header=false", "-cors-origins", ""}, &config)
+	// flags given with their default value still win
+	if config.Port != 17630 || config.StreamPolicy != streamDropOldest || config.TrustAuthHeader || config.CORSOrigins != nil {
+		t.Fatal("expected the flags to override the file, got ", config)
+	}
+	// and the file wins over flags that aren't given
+	if config.CookieFallback != cookieFallbackReject {
+		t.Fatal("expected the file to override the defaults, got ", config.CookieFallback)
+	}
+}
+
+func TestConfigUnknownKey(t *testing.T) {
+	js := "{\n  \"port\": 7630,\n  \"listeners\": [{\"prot\": 7631}]\n}"
+	var config Config
+	err := decodeConfig([]byte(js), &config)
+	if err == nil {
+		t.Fatal("expected an error for an unknown key")
+	}
+	key, offset, ok := unknownKey(js, err)
+	if !ok || key != "prot" {
+		t.Fatal("expected the unknown key prot, got ", key, ok)
+	}
+	if ctx := contextAtOffset(js, offset); ctx.line != 2 || js[ctx.start+ctx.pos:ctx.start+ctx.pos+6] != `"prot"` {
+		t.Fatalf("unexpected location %+v", ctx)
+	}
+	if err := decodeConfig([]byte(`{"port": 7630}`), &config); err != nil || config.Port != 7630 {
+		t.Fatal("expected a valid configuration to parse, got ", err)
+	}
+}
+
+func TestTrustAuthHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hawk-header")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	accept := dir + "/accept"
+	if err := ioutil.WriteFile(accept, []byte("#!/bin/sh\ncat >/dev/null\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	attrd := dir + "/attrd_updater"
+	if err := ioutil.WriteFile(attrd, []byte("#!/bin/sh\necho 'name=\"hawk_session_hacluster\" value=\"session\"'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(a, c string) { attrdUpdater, hawkChkpwd = a, c }(attrdUpdater, hawkChkpwd)
+	attrdUpdater, hawkChkpwd = attrd, accept
+
+	proxies, _ := newProxyTrust([]string{"127.0.0.1"})
+	auth := &hawkAuth{headerProxies: proxies}
+	request := func(remote, header string, basic, cookie bool) *http.Request {
+		r := httptest.NewRequest("GET", "/api/v1/cib", nil)
+		r.RemoteAddr = remote
+		if header != "" {
+			r.Header.Set(authUserHeader, header)
+		}
+		if basic {
+			r.SetBasicAuth("hacluster", "secret")
+		}
+		if cookie {
+			r.AddCookie(&http.Cookie{Name: "hawk_remember_me_id", Value: "hacluster"})
+			r.AddCookie(&http.Cookie{Name: "hawk_remember_me_key", Value: "session"})
+		}
+		return r
+	}
+
+	if user, ok, _ := auth.checkHawkAuthMethods(request("127.0.0.1:1234", "alice", false, false)); !ok || user != "alice" {
+		t.Fatal("expected the header of a trusted proxy to be accepted, got ", user, " ", ok)
+	}
+	// an untrusted peer sending the header gets nothing,
+	// even with valid credentials
+	for _, r := range []*http.Request{
+		request("192.0.2.1:1234", "alice", false, false),
+		request("192.0.2.1:1234", "alice", true, false),
+		request("192.0.2.1:1234", "alice", false, true),
+	} {
+		if user, ok, _ := auth.checkHawkAuthMethods(r); ok {
+			t.Fatal("expected the untrusted header to be refused, got ", user)
+		}
+	}
+	config := Config{Route: []ConfigRoute{{Handler: "api/v1", Path: "/api/v1"}}}
+	handler := NewRouteHandler(&config, nil)
+	handler.auth.headerProxies = proxies
+	w := httptest.NewRecorder()
+	handler.serveAPI(w, request("192.0.2.1:1234", "alice", true, true), &config.Route[0])
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal("expected 401 for the untrusted header, got ", w.Code)
+	}
+
+	// a trusted proxy without the header still gets basic auth
+	if user, ok, _ := auth.checkHawkAuthMethods(request("127.0.0.1:1234", "", true, false)); !ok || user != "hacluster" {
+		t.Fatal("expected basic auth through the trusted proxy, got ", user, " ", ok)
+	}
+	if _, ok, _ := auth.checkHawkAuthMethods(request("127.0.0.1:1234", "", false, false)); ok {
+		t.Fatal("expected a request without credentials to be refused")
+	}
+
+	if user, ok, _ := auth.checkHawkAuthMethods(request("192.0.2.1:1234", "", false, true)); !ok || user != "hacluster" {
+		t.Fatal("expected the session cookie to be accepted without the header, got ", user, " ", ok)
+	}
+
+	// without -trust-auth-header, the header is ignored
+	auth = &hawkAuth{}
+	if user, ok, _ := auth.checkHawkAuthMethods(request("127.0.0.1:1234", "alice", false, false)); ok {
+		t.Fatal("expected the header to be ignored, got ", user)
+	}
+	if user, ok, _ := auth.checkHawkAuthMethods(request("192.0.2.1:1234", "alice", true, false)); !ok || user != "hacluster" {
+		t.Fatal("expected basic auth despite the header, got ", user, " ", ok)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hawk-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	accept := dir + "/accept"
+	if err := ioutil.WriteFile(accept, []byte("#!/bin/sh\ncat >/dev/null\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(c string) { hawkChkpwd = c }(hawkChkpwd)
+	hawkChkpwd = accept
+
+	name := dir + "/tokens"
+	if err := ioutil.WriteFile(name, []byte("# automation\nsecret-one\n\n  ci   secret-two  \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := newTokenStore(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &hawkAuth{tokens: tokens}
+	check := func(authorization string) (string, bool) {
+		r := httptest.NewRequest("GET", "/api/v1/cib", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		user, ok, _ := auth.checkHawkAuthMethods(r)
+		return user, ok
+	}
+	// each token has its own user, which no system
+	// account can have
+	for header, expected := range map[string]string{"Bearer secret-one": "bearer:1", "bearer secret-two": "bearer:ci"} {
+		if user, ok := check(header); !ok || user != expected {
+			t.Fatal("expected ", header, " to be accepted as ", expected, ", got ", user, " ", ok)
+		}
+	}
+	auth.admins = map[string]bool{"token": true, "bearer:ci": true}
+	if u, _ := check("Bearer secret-one"); auth.isAdmin(u) {
+		t.Fatal("expected the admin user token not to make every token an admin")
+	}
+	if u, _ := check("Bearer secret-two"); !auth.isAdmin(u) {
+		t.Fatal("expected the labelled token to be an admin")
+	}
+	for _, header := range []string{"Bearer secret", "Bearer secret-one2", "Bearer # automation", "Bearer ci", "Bearer ci secret-two", "Bearer ", "", "Token secret-one"} {
+		if _, ok := check(header); ok {
+			t.Fatal("expected ", header, " to be rejected")
+		}
+	}
+	if !hasCredentials(func() *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer wrong")
+		return r
+	}()) {
+		t.Fatal("expected bearer tokens to count as credentials for the lockouts")
+	}
+
+	// basic auth still works alongside the tokens
+	r := httptest.NewRequest("GET", "/api/v1/cib", nil)
+	r.SetBasicAuth("hacluster", "secret")
+	if user, ok, err := auth.checkHawkAuthMethods(r); !ok || user != "hacluster" {
+		t.Fatal("expected basic auth to be accepted, got ", user, " ", ok, " ", err)
+	}
+
+	// revoked on reload
+	ioutil.WriteFile(name, []byte("secret-two\n"), 0600)
+	if err := tokens.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := check("Bearer secret-one"); ok {
+		t.Fatal("expected the revoked token to be rejected")
+	}
+	if _, ok := check("Bearer secret-two"); !ok {
+		t.Fatal("expected the remaining token to be accepted")
+	}
+
+	// a missing or unset file accepts no tokens
+	os.Remove(name)
+	if err := tokens.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := check("Bearer secret-two"); ok {
+		t.Fatal("expected no tokens without a token file")
+	}
+	if s, err := newTokenStore(dir + "/missing"); err != nil || s.entries.Load().([]tokenEntry) != nil {
+		t.Fatal("expected a missing token file to accept no tokens, got ", err)
+	}
+	if s, err := newTokenStore(""); s != nil || err != nil {
+		t.Fatal("expected no token store without a -token-file")
+	}
+	if _, ok := (*tokenStore)(nil).check(""); ok {
+		t.Fatal("expected no token store without a -token-file")
+	}
+}
+
+func TestClientAuthLockout(t *testing.T) {
+	now := time.Now()
+	limiter := newClientAuthLimiter(3, time.Minute, 5*time.Minute)
+	limiter.now = func() time.Time { return now }
+	proxies, _ := newProxyTrust([]string{"127.0.0.1"})
+	auth := &hawkAuth{lockouts: limiter, proxies: proxies}
+
+	request := func(remote, forwarded string) *http.Request {
+		r := httptest.NewRequest("GET", "/api/v1/cib", nil)
+		r.RemoteAddr = remote
+		r.SetBasicAuth("hacluster", "wrong")
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return r
+	}
+
+	// a spoofed header from an untrusted peer counts against the peer
+	for i := 0; i < 3; i++ {
+		auth.recordAuthResult(request("192.0.2.1:1234", "198.51.100.1"), false)
+	}
+	w := httptest.NewRecorder()
+	if auth.checkClientLockout(w, request("192.0.2.1:1234", "")) || w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "300" {
+		t.Fatal("expected the client to be locked out, got ", w.Code, w.Header())
+	}
+	if !auth.checkClientLockout(httptest.NewRecorder(), request("127.0.0.1:1234", "198.51.100.1")) {
+		t.Fatal("expected the spoofed address not to be locked out")
+	}
+
+	// failures behind a trusted proxy count against the client
+	for i := 0; i < 2; i++ {
+		auth.recordAuthResult(request("127.0.0.1:1234", "198.51.100.2"), false)
+	}
+	auth.recordAuthResult(request("127.0.0.1:1234", "198.51.100.2"), true)
+	auth.recordAuthResult(request("127.0.0.1:1234", "198.51.100.2"), false)
+	if !auth.checkClientLockout(httptest.NewRecorder(), request("127.0.0.1:1234", "198.51.100.2")) {
+		t.Fatal("expected a success to reset the failures")
+	}
+
+	// requests without credentials aren't counted
+	anonymous := httptest.NewRequest("GET", "/api/v1/cib", nil)
+	anonymous.RemoteAddr = "192.0.2.3:1234"
+	for i := 0; i < 5; i++ {
+		auth.recordAuthResult(anonymous, false)
+	}
+	if !auth.checkClientLockout(httptest.NewRecorder(), anonymous) {
+		t.Fatal("expected requests without credentials not to lock out")
+	}
+
+	now = now.Add(6 * time.Minute)
+	if !auth.checkClientLockout(httptest.NewRecorder(), request("192.0.2.1:1234", "")) {
+		t.Fatal("expected the lockout to expire")
+	}
+	limiter.fail("192.0.2.4")
+	now = now.Add(2 * time.Minute)
+	limiter.fail("192.0.2.4")
+	if _, ok := limiter.failures["192.0.2.1"]; ok {
+		t.Fatal("expected stale clients to be swept")
+	}
+	if f := limiter.failures["192.0.2.4"]; f == nil || f.count != 1 {
+		t.Fatal("expected failures outside the window to start over, got ", f)
+	}
+}
+
+func TestProxyStrict(t *testing.T) {
+	proxies, _ := newProxyTrust([]string{"127.0.0.1"})
+	handler := &HTTPRedirectHandler{
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		proxies: proxies,
+		strict:  true,
+	}
+	cases := []struct {
+		remote    string
+		forwarded string
+		code      int
+	}{
+		{"127.0.0.1:5555", "proto=https;for=192.0.2.1", http.StatusOK},
+		{"127.0.0.1:5555", "", http.StatusForbidden},
+		{"192.0.2.1:5555", "proto=https", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://internal/api/v1", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("Forwarded", c.forwarded)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Fatal("expected ", c.code, " from ", c.remote, " with ", c.forwarded, ", got ", w.Code)
+		}
+	}
+}
+
+func TestResourcesCSV(t *testing.T) {
+	xmldoc := `<cib><configuration><nodes/><resources>
+		<primitive id="ip" class="ocf" provider="heartbeat" type="IPaddr2"/>
+		<clone id="cl"><primitive id="ping" class="ocf" provider="pacemaker" type="ping"/></clone>
+	</resources></configuration><status>
+		<node_state id="1" uname="alice"><lrm><lrm_resources>
+			<lrm_resource id="ping:0">
+				<lrm_rsc_op operation="start" call-id="1" rc-code="0" op-status="0" transition-key="1:0:0:x"/>
+			</lrm_resource>
+		</lrm_resources></lrm></node_state>
+		<node_state id="2" uname="bob"><lrm><lrm_resources>
+			<lrm_resource id="ping:1">
+				<lrm_rsc_op operation="start" call-id="1" rc-code="0" op-status="0" transition-key="1:0:0:x"/>
+			</lrm_resource>
+			<lrm_resource id="ip">
+				<lrm_rsc_op operation="start" call-id="2" rc-code="1" op-status="0" transition-key="2:0:0:x"/>
+			</lrm_resource>
+		</lrm_resources></lrm></node_state>
+	</status></cib>`
+	w := httptest.NewRecorder()
+	handleApiResourcesCSV(w, httptest.NewRequest("GET", "/api/v1/resources.csv", nil), xmldoc)
+	expected := "id,parent,class,provider,type,running_on,failed_actions\n" +
+		"ip,,ocf,heartbeat,IPaddr2,,1\n" +
+		"ping,cl,ocf,pacemaker,ping,\"alice,bob\",0\n"
+	if w.Body.String() != expected {
+		t.Fatal("unexpected CSV: ", w.Body.String())
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") || !strings.Contains(w.Header().Get("Content-Disposition"), `filename="resources.csv"`) {
+		t.Fatal("unexpected headers: ", w.Header())
+	}
+}
+
+func TestResourceSummary(t *testing.T) {
+	doc, err := parseCibStatus(`<cib><configuration><nodes/><resources>
+		<primitive id="ip"/>
+		<group id="grp"><primitive id="fs"/><primitive id="db"/></group>
+		<clone id="cl"><primitive id="ping"/></clone>
+	</resources></configuration><status>
+		<node_state id="1" uname="alice"><lrm><lrm_resources>
+			<lrm_resource id="ip">
+				<lrm_rsc_op operation="monitor" call-id="1" rc-code="7" op-status="0" transition-key="1:0:7:x"/>
+				<lrm_rsc_op operation="start" call-id="2" rc-code="0" op-status="0" transition-key="2:0:0:x"/>
+			</lrm_resource>
+			<lrm_resource id="fs">
+				<lrm_rsc_op operation="start" call-id="3" rc-code="1" op-status="0" transition-key="3:0:0:x"/>
+			</lrm_resource>
+			<lrm_resource id="ping:0">
+				<lrm_rsc_op operation="start" call-id="4" rc-code="0" op-status="0" transition-key="4:0:0:x"/>
+				<lrm_rsc_op operation="monitor" call-id="5" rc-code="0" op-status="0" transition-key="5:0:0:x"/>
+			</lrm_resource>
+			<lrm_resource id="db">
+				<lrm_rsc_op operation="start" call-id="6" rc-code="0" op-status="0" transition-key="6:0:0:x"/>
+				<lrm_rsc_op operation="stop" call-id="7" rc-code="0" op-status="0" transition-key="7:0:0:x"/>
+			</lrm_resource>
+		</lrm_resources></lrm></node_state>
+	</status></cib>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total, started, failed := doc.resourceSummary()
+	if total != 4 || started != 2 || failed != 1 {
+		t.Fatal("expected 4 resources, 2 started and 1 failed, got ", total, started, failed)
+	}
+}
+
+func TestResourceActivity(t *testing.T) {
+	cib := `<cib><configuration/><status><node_state id="1" uname="alice"><lrm><lrm_resources>
+		<lrm_resource id="ip">
+			<lrm_rsc_op operation="start" call-id="2" rc-code="0" op-status="0" transition-key="2:0:0:x" last-run="1500000000" last-rc-change="1500000000"/>
+		</lrm_resource>
+		<lrm_resource id="db">
+			<lrm_rsc_op operation="start" call-id="3" rc-code="1" op-status="0" transition-key="3:0:0:x" last-run="1600000000" last-rc-change="1600000000"/>
+		</lrm_resource>
+	</lrm_resources></lrm></node_state></status></cib>`
+
+	get := func(query string) (int, []resourceActivity) {
+		w := httptest.NewRecorder()
+		handleApiResourceActivity(w, httptest.NewRequest("GET", "/api/v1/resources"+query, nil), cib)
+		var activity []resourceActivity
+		json.Unmarshal(w.Body.Bytes(), &activity)
+		return w.Code, activity
+	}
+	if code, activity := get(""); code != 200 || len(activity) != 2 || activity[0].Id != "db" || !activity[0].Failed {
+		t.Fatal("expected both resources, newest first, got ", code, activity)
+	}
+	if _, activity := get("?changed_since=2019-01-01T00:00:00Z"); len(activity) != 1 || activity[0].Id != "db" {
+		t.Fatal("expected only db, got ", activity)
+	}
+	if _, activity := get("?changed_since=2030-01-01T00:00:00Z"); activity == nil || len(activity) != 0 {
+		t.Fatal("expected an empty list, got ", activity)
+	}
+	if code, _ := get("?changed_since=yesterday"); code != http.StatusBadRequest {
+		t.Fatal("expected 400, got ", code)
+	}
+}
+
+func TestSmugglingGuard(t *testing.T) {
+	reached := false
+	guard := NewSmugglingGuard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	cases := []struct {
+		headers map[string][]string
+		te      []string
+		ok      bool
+	}{
+		{map[string][]string{"Content-Length": {"5"}}, nil, true},
+		{nil, []string{"chunked"}, true},
+		{map[string][]string{"Content-Length": {"5"}}, []string{"chunked"}, false},
+		{map[string][]string{"Content-Length": {"5", "5"}}, nil, false},
+		{map[string][]string{"Content-Length": {"+5"}}, nil, false},
+		{map[string][]string{"Content-Length": {"5, 6"}}, nil, false},
+		{map[string][]string{"Transfer-Encoding": {"chunked"}, "Content-Length": {"0"}}, nil, false},
+		{nil, []string{"gzip", "chunked"}, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/api/v1/graphql", strings.NewReader("hello"))
+		r.Header = http.Header(c.headers)
+		if r.Header == nil {
+			r.Header = http.Header{}
+		}
+		r.TransferEncoding = c.te
+		reached = false
+		w := httptest.NewRecorder()
+		guard.ServeHTTP(w, r)
+		if reached != c.ok || (!c.ok && w.Code != http.StatusBadRequest) {
+			t.Fatal("unexpected result for ", c.headers, " ", c.te, ": ", w.Code)
+		}
+	}
+
+	// conflicting lengths on the wire never reach the handler
+	srv := httptest.NewServer(guard)
+	defer srv.Close()
+	for _, raw := range []string{
+		"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello",
+		"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: -5\r\n\r\nhello",
+	} {
+		reached = false
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(raw))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+		if !strings.Contains(line, " 400 ") || reached {
+			t.Fatal("expected 400 for ", strconv.Quote(raw), ", got ", line)
+		}
+	}
+}
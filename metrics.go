@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics
+//
+// A minimal implementation of the Prometheus text
+// exposition format, enough to export the server's
+// own counters, gauges and histograms at /metrics
+// without pulling in the Prometheus client library
+// and its dependencies.
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+type metricsRegistry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+var metrics = &metricsRegistry{}
+
+func (reg *metricsRegistry) register(m metric) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	reg.metrics = append(reg.metrics, m)
+}
+
+func (reg *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	for _, m := range reg.metrics {
+		m.writeTo(w)
+	}
+}
+
+// metricVec holds the label names of a metric and
+// its series, keyed by their label values.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	lock   sync.Mutex
+	series map[string][]string
+}
+
+func (v *metricVec) init(name, help, kind string, labels []string) {
+	v.name = name
+	v.help = help
+	v.kind = kind
+	v.labels = labels
+	v.series = make(map[string][]string)
+}
+
+// key returns the series key for the label values,
+// which must be called with the lock held.
+func (v *metricVec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	k := strings.Join(values, "\xff")
+	if _, ok := v.series[k]; !ok {
+		v.series[k] = values
+	}
+	return k
+}
+
+// sortedKeys must be called with the lock held.
+func (v *metricVec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *metricVec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// labelString formats the label pairs of a series,
+// with any extra pairs appended.
+func (v *metricVec) labelString(values []string, extra ...string) string {
+	var pairs []string
+	for i, l := range v.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", l, labelEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[i], labelEscaper.Replace(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// counterVec is a monotonically increasing value.
+type counterVec struct {
+	metricVec
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{values: make(map[string]float64)}
+	c.init(name, help, "counter", labels)
+	metrics.register(c)
+	return c
+}
+
+func (c *counterVec) add(delta float64, labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[c.key(labelValues)] += delta
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeHeader(w)
+	for _, k := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(c.series[k]), formatFloat(c.values[k]))
+	}
+}
+
+// gaugeVec is a value that can go up and down.
+type gaugeVec struct {
+	metricVec
+	values map[string]float64
+}
+
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	g := &gaugeVec{values: make(map[string]float64)}
+	g.init(name, help, "gauge", labels)
+	metrics.register(g)
+	return g
+}
+
+func (g *gaugeVec) set(value float64, labelValues ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values[g.key(labelValues)] = value
+}
+
+func (g *gaugeVec) add(delta float64, labelValues ...string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values[g.key(labelValues)] += delta
+}
+
+func (g *gaugeVec) writeTo(w io.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.writeHeader(w)
+	for _, k := range g.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(g.series[k]), formatFloat(g.values[k]))
+	}
+}
+
+// gaugeFunc is a gauge without labels whose value is
+// computed when scraped. No sample is written while
+// fn returns false.
+type gaugeFunc struct {
+	metricVec
+	fn func() (float64, bool)
+}
+
+func newGaugeFunc(name, help string, fn func() (float64, bool)) *gaugeFunc {
+	g := &gaugeFunc{fn: fn}
+	g.init(name, help, "gauge", nil)
+	metrics.register(g)
+	return g
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	g.writeHeader(w)
+	if value, ok := g.fn(); ok {
+		fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(value))
+	}
+}
+
+// histogramVec counts observations in buckets.
+type histogramVec struct {
+	metricVec
+	buckets []float64
+	counts  map[string][]uint64
+	sums    map[string]float64
+}
+
+// defaultDurationBuckets are in seconds, from 5ms to 10s.
+var defaultDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		buckets: buckets,
+		counts:  make(map[string][]uint64),
+		sums:    make(map[string]float64),
+	}
+	h.init(name, help, "histogram", labels)
+	metrics.register(h)
+	return h
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	k := h.key(labelValues)
+	counts, ok := h.counts[k]
+	if !ok {
+		// the last count is the +Inf bucket
+		counts = make([]uint64, len(h.buckets)+1)
+		h.counts[k] = counts
+	}
+	for i, b := range h.buckets {
+		if value <= b {
+			counts[i]++
+		}
+	}
+	counts[len(h.buckets)]++
+	h.sums[k] += value
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.writeHeader(w)
+	for _, k := range h.sortedKeys() {
+		values := h.series[k]
+		counts := h.counts[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(values, "le", formatFloat(b)), counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(values, "le", "+Inf"), counts[len(h.buckets)])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(values), formatFloat(h.sums[k]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(values), counts[len(h.buckets)])
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// Parse limits
+//
+// Requests that can't be answered from the view cache
+// parse the CIB themselves. On a large cluster, a burst
+// of such requests right after a CIB change could
+// saturate the CPU, so at most parse_concurrency of
+// them parse at a time, and at most parse_queue more
+// wait for their turn. Beyond that, requests get 503
+// Service Unavailable with a Retry-After header.
+
+const (
+	defaultParseQueue = 64
+	parseRetryAfter   = 1
+)
+
+var errParseQueueFull = errors.New("Too many requests parsing the CIB, try again later.")
+
+var (
+	parseQueueDepth = newGaugeVec("hawk_cib_parse_queue_depth",
+		"Requests waiting to parse the CIB.")
+	parseRejected = newCounterVec("hawk_cib_parse_rejected_total",
+		"Requests rejected because the CIB parse queue was full.")
+)
+
+type parseLimiter struct {
+	slots   chan struct{}
+	lock    sync.Mutex
+	waiting int
+	queue   int
+}
+
+// cibParses limits the requests parsing the CIB. It is
+// replaced in main according to the configuration.
+var cibParses = newParseLimiter(0, defaultParseQueue)
+
+// newParseLimiter allows concurrency parses at a time,
+// GOMAXPROCS if 0, with up to queue waiting.
+func newParseLimiter(concurrency, queue int) *parseLimiter {
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	return &parseLimiter{
+		slots: make(chan struct{}, concurrency),
+		queue: queue,
+	}
+}
+
+// acquire waits for a parse slot. It returns
+// errParseQueueFull if too many requests are already
+// waiting, or the error of ctx if it is done first.
+func (l *parseLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	l.lock.Lock()
+	if l.waiting >= l.queue {
+		l.lock.Unlock()
+		parseRejected.inc()
+		return errParseQueueFull
+	}
+	l.waiting++
+	parseQueueDepth.set(float64(l.waiting))
+	l.lock.Unlock()
+	defer func() {
+		l.lock.Lock()
+		l.waiting--
+		parseQueueDepth.set(float64(l.waiting))
+		l.lock.Unlock()
+	}()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *parseLimiter) release() {
+	<-l.slots
+}
+
+// parseFailed responds to a request whose CIB parse
+// failed. It returns false, so that the request falls
+// through, unless the parse queue was full.
+func parseFailed(w http.ResponseWriter, err error) bool {
+	if err == errParseQueueFull {
+		w.Header().Set("Retry-After", strconv.Itoa(parseRetryAfter))
+		httpJSONError(w, err.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	log.Error(err)
+	return false
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Long polling
+//
+// A fallback for clients behind proxies that break
+// Server-Sent Events: the client passes the hash of
+// the last CIB it has seen, and the request is held
+// until the CIB changes or the wait time runs out.
+
+const (
+	defaultPollWait = 30
+	maxPollWait     = 60
+)
+
+func cibHash(xmldoc string) string {
+	sum := sha256.Sum256([]byte(xmldoc))
+	return hex.EncodeToString(sum[:])
+}
+
+// servePoll returns the CIB as soon as its hash
+// differs from the since parameter, or 304 Not
+// Modified if it doesn't change within wait seconds.
+// The hash of the returned CIB is in X-Cib-Hash.
+func (handler *routeHandler) servePoll(w http.ResponseWriter, r *http.Request) bool {
+	wait := defaultPollWait
+	if v := r.URL.Query().Get("wait"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			httpJSONError(w, fmt.Sprintf("Invalid wait: %v.", v), http.StatusBadRequest)
+			return true
+		}
+		wait = n
+	}
+	if wait > maxPollWait {
+		wait = maxPollWait
+	}
+	since := r.URL.Query().Get("since")
+
+	// subscribe before reading the CIB, so that a change
+	// in between isn't missed; the body and hash are read
+	// together, so that they describe the same CIB
+	events, current := handler.cib.Subscribe()
+	defer handler.cib.Unsubscribe(events)
+	xmldoc, hash := current.xmldoc, current.hash
+	if hash == "" || hash == since {
+		timer := time.NewTimer(time.Duration(wait) * time.Second)
+		defer timer.Stop()
+	Wait:
+		for hash == "" || hash == since {
+			select {
+			case snap, ok := <-events:
+				if !ok {
+					// disconnected for being too slow
+					xmldoc, hash = handler.cib.Snapshot()
+					break Wait
+				}
+				xmldoc, hash = snap.xmldoc, snap.hash
+			case <-timer.C:
+				break Wait
+			case <-r.Context().Done():
+				return true
+			}
+		}
+	}
+
+	if hash == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	if hash == since {
+		w.Header().Set("X-Cib-Hash", hash)
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	w.Header().Set("X-Cib-Hash", hash)
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xmldoc)
+	return true
+}
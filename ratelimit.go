@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Per-user rate limits
+//
+// Once a request is authenticated, it is counted
+// against a token bucket for its user, so that a single
+// misbehaving dashboard account can't overwhelm the
+// server, even from many addresses. Users in
+// admin_users get the admin_rate_limit, others the
+// user_rate_limit. A request over the limit gets 429
+// Too Many Requests with a Retry-After header. A limit
+// with a rate of 0 doesn't limit at all.
+
+// ConfigRateLimit is a sustained rate in requests per
+// second, with bursts of up to Burst requests (default
+// twice the rate).
+type ConfigRateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (l ConfigRateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(2*l.Rate))
+}
+
+// rateIdleSweep is how often buckets that have filled
+// up again are forgotten.
+const rateIdleSweep = time.Minute
+
+var userRateLimited = newCounterVec("hawk_user_rate_limited_total",
+	"Requests rejected for exceeding the rate limit of their user.", "user", "role")
+
+type tokenBucket struct {
+	limit  ConfigRateLimit
+	tokens float64
+	last   time.Time
+}
+
+type userRateLimiter struct {
+	user  ConfigRateLimit
+	admin ConfigRateLimit
+	lock  sync.Mutex
+	users map[string]*tokenBucket
+	swept time.Time
+	now   func() time.Time
+}
+
+func newUserRateLimiter(user, admin ConfigRateLimit) *userRateLimiter {
+	return &userRateLimiter{
+		user:  user,
+		admin: admin,
+		users: make(map[string]*tokenBucket),
+		now:   time.Now,
+	}
+}
+
+// fill adds the tokens earned since the last request,
+// and returns true if the bucket is full.
+func (b *tokenBucket) fill(now time.Time) bool {
+	burst := b.limit.burst()
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+	return b.tokens >= burst
+}
+
+// allow takes a token for user. If there is none left,
+// it returns false and how long until there is.
+func (l *userRateLimiter) allow(user string, admin bool) (bool, time.Duration) {
+	limit := l.user
+	if admin {
+		limit = l.admin
+	}
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	if now.Sub(l.swept) >= rateIdleSweep {
+		l.sweep(now)
+	}
+	b, ok := l.users[user]
+	if !ok || b.limit != limit {
+		b = &tokenBucket{limit: limit, tokens: limit.burst(), last: now}
+		l.users[user] = b
+	}
+	b.fill(now)
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets the buckets that are full again. It
+// must be called with the lock held.
+func (l *userRateLimiter) sweep(now time.Time) {
+	l.swept = now
+	for user, b := range l.users {
+		if b.fill(now) {
+			delete(l.users, user)
+		}
+	}
+}
+
+// checkRateLimit responds with 429 and returns false if
+// user has exceeded its rate limit.
+func (auth *hawkAuth) checkRateLimit(w http.ResponseWriter, user string) bool {
+	if auth.limits == nil {
+		return true
+	}
+	admin := auth.isAdmin(user)
+	ok, wait := auth.limits.allow(user, admin)
+	if ok {
+		return true
+	}
+	role := "user"
+	if admin {
+		role = "admin"
+	}
+	userRateLimited.inc(user, role)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	httpJSONError(w, "Too many requests, try again later.", http.StatusTooManyRequests)
+	return false
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 )
 
 // Provides ListenAndServeWithRedirect(),
@@ -16,41 +22,89 @@ import (
 // accesses the :7630 port over HTTP, it'll
 // automagically redirect to HTTPS.
 
+// defaultPeekTimeout is the number of seconds a client
+// has to send its first bytes.
+const defaultPeekTimeout = 5
+
 type SplitListener struct {
 	net.Listener
 	config *tls.Config
+	// peekTimeout bounds the wait for the first bytes of
+	// each connection, since Accept blocks until then.
+	peekTimeout time.Duration
 }
 
 func (l *SplitListener) Accept() (net.Conn, error) {
-	c, err := l.Listener.Accept()
-	if err != nil {
-		return nil, err
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		bconn := &Conn{
+			Conn: c,
+			buf:  bufio.NewReader(c),
+		}
+
+		// inspect the first bytes to see if it is HTTPS
+		if l.peekTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(l.peekTimeout))
+		}
+		hdr, err := bconn.buf.Peek(6)
+		c.SetReadDeadline(time.Time{})
+		if err != nil {
+			// drop the client, an error would stop Serve
+			log.Printf("Short %s: %s\n", c.RemoteAddr().String(), err.Error())
+			c.Close()
+			continue
+		}
+
+		// SSL 3.0 or TLS 1.0, 1.1 and 1.2
+		if hdr[0] == 0x16 && hdr[1] == 0x3 && hdr[5] == 0x1 {
+			return tls.Server(bconn, l.config), nil
+			// SSL 2
+		} else if hdr[0] == 0x80 {
+			return tls.Server(bconn, l.config), nil
+		}
+		return bconn, nil
 	}
+}
+
+// tlsHandshakeFailures counts the TLS handshakes that
+// failed, by a rough classification of the error.
+var tlsHandshakeFailures = newCounterVec("hawk_tls_handshake_failures_total",
+	"Failed TLS handshakes.", "reason")
+
+const tlsHandshakeError = "http: TLS handshake error from "
 
-	bconn := &Conn{
-		Conn: c,
-		buf:  bufio.NewReader(c),
+// serverErrorLog
+//
+// The handshake of the connections returned by
+// SplitListener happens inside net/http, which only
+// reports failures to the ErrorLog of the server. This
+// writer picks them out to count them, and logs
+// everything as before.
+type serverErrorLog struct{}
+
+func (serverErrorLog) Write(p []byte) (int, error) {
+	msg := string(p)
+	if strings.HasPrefix(msg, tlsHandshakeError) {
+		tlsHandshakeFailures.inc(handshakeFailureReason(msg))
 	}
+	log.Print(msg)
+	return len(p), nil
+}
 
-	// inspect the first bytes to see if it is HTTPS
-	hdr, err := bconn.buf.Peek(6)
-	if err != nil {
-		log.Printf("Short %s: %s\n", c.RemoteAddr().String(), err.Error())
-		// couldn't peek, assume it's HTTPS
-		return tls.Server(bconn, l.config), nil
-		// log.Printf("Short %s\n", c.RemoteAddr().String())
-		// bconn.Close()
-		// return nil, err
-	}
-
-	// SSL 3.0 or TLS 1.0, 1.1 and 1.2
-	if hdr[0] == 0x16 && hdr[1] == 0x3 && hdr[5] == 0x1 {
-		return tls.Server(bconn, l.config), nil
-		// SSL 2
-	} else if hdr[0] == 0x80 {
-		return tls.Server(bconn, l.config), nil
-	}
-	return bconn, nil
+func handshakeFailureReason(msg string) string {
+	switch {
+	case strings.Contains(msg, "EOF") || strings.Contains(msg, "connection reset"):
+		return "eof"
+	case strings.Contains(msg, "certificate"):
+		return "certificate"
+	case strings.Contains(msg, "version") || strings.Contains(msg, "protocol") || strings.Contains(msg, "cipher"):
+		return "protocol"
+	}
+	return "other"
 }
 
 type Conn struct {
@@ -64,55 +118,272 @@ func (c *Conn) Read(b []byte) (int, error) {
 
 type HTTPRedirectHandler struct {
 	handler http.Handler
+	proxies *proxyTrust
+	// hostname is used in redirects for clients that
+	// don't send a Host header (HTTP/1.0).
+	hostname string
+	// strict rejects requests that didn't come through
+	// one of the proxies.
+	strict bool
+	// plain serves HTTP requests instead of redirecting
+	// them, on a plain HTTP socket.
+	plain bool
+}
+
+// redirectHost returns the host to redirect to when
+// the request has no Host header: the configured
+// hostname if any, otherwise the local address the
+// client connected to. The port of the connection is
+// added unless the hostname includes one, since HTTP
+// and HTTPS share the same port.
+func (handler *HTTPRedirectHandler) redirectHost(r *http.Request) string {
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if handler.hostname == "" {
+		if local == nil {
+			return ""
+		}
+		return local.String()
+	}
+	if _, _, err := net.SplitHostPort(handler.hostname); err == nil || local == nil {
+		return handler.hostname
+	}
+	_, port, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return handler.hostname
+	}
+	return net.JoinHostPort(handler.hostname, port)
 }
 
 func (handler *HTTPRedirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.TLS == nil {
+	if handler.strict {
+		if err := handler.proxies.checkProxied(r); err != nil {
+			log.Printf("Rejected request for %s: %v", r.URL.Path, err)
+			http.Error(w, "Requests must go through the proxy.", http.StatusForbidden)
+			return
+		}
+	}
+	// A trusted proxy may have terminated TLS for us,
+	// in which case there is nothing to redirect.
+	origin := handler.proxies.origin(r)
+	if origin.Proto != "https" && !handler.plain {
+		host := origin.Host
+		if host == "" {
+			host = handler.redirectHost(r)
+		}
 		u := url.URL{
 			Scheme:   "https",
 			Opaque:   r.URL.Opaque,
 			User:     r.URL.User,
-			Host:     r.Host,
+			Host:     host,
 			Path:     r.URL.Path,
 			RawQuery: r.URL.RawQuery,
 			Fragment: r.URL.Fragment,
 		}
-		log.Printf("http -> %s\n", u.String())
+		log.Printf("http -> %s (%s)\n", u.String(), origin.ClientIP)
 		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
 		return
 	}
 	handler.handler.ServeHTTP(w, r)
 }
 
-func ListenAndServeWithRedirect(addr string, handler http.Handler, cert string, key string) {
+// listenerHandler applies the exposure settings of
+// a listener before passing requests on to the shared
+// handler.
+type listenerHandler struct {
+	listener *ConfigListener
+	handler  http.Handler
+}
+
+func (handler *listenerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := handler.listener
+	if !l.servesPath(r.URL.Path) {
+		if isAPIPath(r.URL.Path) {
+			httpJSONError(w, "Not found", http.StatusNotFound)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	if l.ReadOnly && r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		httpJSONError(w, "This listener is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	handler.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), listenerContextKey, l)))
+}
+
+// loadKeyPair loads the certificate and key, retrying
+// with backoff for up to wait if they can't be loaded,
+// since in some deployments they are put in place
+// shortly after the server starts.
+func loadKeyPair(certFile, keyFile string, wait time.Duration) (tls.Certificate, error) {
+	deadline := time.Now().Add(wait)
+	delay := time.Second
+	for {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err == nil || !time.Now().Add(delay).Before(deadline) {
+			return cert, err
+		}
+		log.Printf("Failed to load certificate, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxCertRetryDelay {
+			delay = maxCertRetryDelay
+		}
+	}
+}
+
+const maxCertRetryDelay = 30 * time.Second
+
+const defaultTLSMinVersion = "1.2"
+
+// baseTLSConfig returns the TLS settings shared by all
+// listeners: the minimum protocol version and, if set,
+// the TLS 1.2 cipher suites to accept.
+func baseTLSConfig(cfg *Config) (*tls.Config, error) {
 	config := &tls.Config{}
-	if config.NextProtos == nil {
-		config.NextProtos = []string{"http1/1"}
+	version, ok := tlsVersions[cfg.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("Invalid TLS version %q (must be one of 1.0, 1.1, 1.2, 1.3)", cfg.TLSMinVersion)
 	}
+	config.MinVersion = version
 
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(cert, key)
-	if err != nil {
-		log.Fatal(err)
+	suites, insecure := tlsCipherSuites()
+	for _, name := range cfg.TLSCiphers {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS cipher suite %q", name)
+		}
+		if insecure[id] {
+			log.Printf("Warning: TLS cipher suite %s is insecure", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	return config, nil
+}
+
+func listenerTLSConfig(l *ConfigListener, base *tls.Config, certs *certHolder) (*tls.Config, error) {
+	config := cloneTLSConfig(base)
+	config.GetCertificate = certs.getCertificate
+
+	if l.ClientCA != "" {
+		pem, err := ioutil.ReadFile(l.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", l.ClientCA)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
 	}
+	return config, nil
+}
 
-	ln, err := net.Listen("tcp", addr)
+// ListenAndServeWithRedirect serves handler on each of
+// the listeners concurrently. The first listener may
+// be replaced by a systemd socket. When any of the
+// servers fails, all of them are shut down. When quit
+// is closed, they are shut down gracefully. The
+// certificates are reloaded by reload. The adapters
+// wrap the whole server, including the HTTP redirect.
+func ListenAndServeWithRedirect(listeners []ConfigListener, handler http.Handler, cfg *Config, proxies *proxyTrust, reload *reloader, quit <-chan struct{}, adapters ...Adapter) {
+	var lns []net.Listener
+	var servers []*http.Server
+	var lifetime *connLifetime
+	if cfg.MaxConnLifetime > 0 {
+		lifetime = newConnLifetime(time.Duration(cfg.MaxConnLifetime) * time.Second)
+		done := make(chan struct{})
+		defer close(done)
+		go lifetime.run(done)
+	}
+	base, err := baseTLSConfig(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	var holders []*certHolder
+	for i := range listeners {
+		l := &listeners[i]
+		var ln net.Listener
+		if i == 0 {
+			ln, err = systemdListener()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if ln != nil {
+			log.Printf("Using socket-activated listener on %s", ln.Addr())
+		} else if l.Socket != "" {
+			mode, _ := parseSocketMode(l.SocketMode)
+			ln, err = listenUnix(l.Socket, mode)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			ln, err = net.Listen("tcp", l.addr())
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		fmt.Printf("Listening to %s\n", l.url(ln.Addr()))
+		if l.PlainHTTP {
+			lns = append(lns, ln)
+		} else {
+			certs, err := newCertHolder(l.Cert, l.Key, time.Duration(cfg.WaitForCert)*time.Second)
+			if err != nil {
+				log.Fatal(err)
+			}
+			holders = append(holders, certs)
+			config, err := listenerTLSConfig(l, base, certs)
+			if err != nil {
+				log.Fatal(err)
+			}
+			lns = append(lns, &SplitListener{
+				Listener:    ln,
+				config:      config,
+				peekTimeout: time.Duration(cfg.PeekTimeout) * time.Second,
+			})
+		}
 
-	listener := &SplitListener{
-		Listener: ln,
-		config:   config,
+		srv := &http.Server{
+			Addr: l.addr(),
+			Handler: Adapt(&HTTPRedirectHandler{
+				handler:  &listenerHandler{listener: l, handler: handler},
+				proxies:  proxies,
+				hostname: cfg.Hostname,
+				strict:   cfg.ProxyStrict,
+				plain:    l.PlainHTTP,
+			}, adapters...),
+			ErrorLog: log.New(serverErrorLog{}, "", 0),
+		}
+		if lifetime != nil {
+			srv.ConnState = lifetime.connState
+		}
+		srv.SetKeepAlivesEnabled(true)
+		servers = append(servers, srv)
 	}
 
-	srv := &http.Server{
-		Addr: addr,
-		Handler: &HTTPRedirectHandler{
-			handler: handler,
-		},
+	reload.add("certificates", func() error { return reloadCerts(holders) })
+
+	errs := make(chan error, len(servers))
+	for i := range servers {
+		go func(srv *http.Server, ln net.Listener) {
+			errs <- srv.Serve(ln)
+		}(servers[i], lns[i])
+	}
+	select {
+	case err := <-errs:
+		log.Printf("Server stopped: %v", err)
+		for _, ln := range lns {
+			ln.Close()
+		}
+		for i := 1; i < len(servers); i++ {
+			<-errs
+		}
+	case <-quit:
+		shutdownServers(servers, time.Duration(cfg.ShutdownTimeout)*time.Second)
+		for range servers {
+			<-errs
+		}
+		log.Printf("Server stopped")
 	}
-	srv.SetKeepAlivesEnabled(true)
-	srv.Serve(listener)
 }
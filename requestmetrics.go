@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Request metrics
+//
+// Every request is counted by path and status code,
+// and its duration observed by path. To keep the number
+// of series bounded, the ids in node, resource and
+// constraint paths are replaced with :id, and paths
+// outside of /api/ other than the unauthenticated
+// endpoints, as well as anything that got 404 Not
+// Found, are counted as "other".
+
+var (
+	httpRequests = newCounterVec("hawk_http_requests_total",
+		"HTTP requests handled, by path and status code.", "path", "code")
+	httpRequestDuration = newHistogramVec("hawk_http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by path.", defaultDurationBuckets, "path")
+	authAttempts = newCounterVec("hawk_auth_attempts_total",
+		"Authentication attempts, by outcome.", "outcome")
+	cibFetchErrors = newCounterVec("hawk_cib_fetch_errors_total",
+		"Failures to read the CIB from Pacemaker, by stage.", "stage")
+	streamClients = newGaugeVec("hawk_stream_clients",
+		"Clients connected to a streaming endpoint.", "stream")
+)
+
+// lastCibUpdate is when the last CIB was received, in
+// Unix nanoseconds.
+var lastCibUpdate int64
+
+var cibAge = newGaugeFunc("hawk_cib_age_seconds",
+	"Seconds since the last CIB update was received.", func() (float64, bool) {
+		last := atomic.LoadInt64(&lastCibUpdate)
+		if last == 0 {
+			return 0, false
+		}
+		return time.Since(time.Unix(0, last)).Seconds(), true
+	})
+
+var metricIdPath = regexp.MustCompile(`^(.*/configuration/(?:nodes|resources|constraints))/[^/]+/?$`)
+
+// metricPath returns the path label of a request.
+func metricPath(path string, code int) string {
+	if code == http.StatusNotFound {
+		return "other"
+	}
+	switch path {
+	case "/metrics", "/health", "/ready":
+		return path
+	}
+	if !isAPIPath(path) {
+		return "other"
+	}
+	if m := metricIdPath.FindStringSubmatch(path); m != nil {
+		return m[1] + "/:id"
+	}
+	return strings.TrimSuffix(path, "/")
+}
+
+// NewMetricsHandler wraps h, counting its requests.
+func NewMetricsHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		path := metricPath(r.URL.Path, rec.code)
+		httpRequests.inc(path, strconv.Itoa(rec.code))
+		httpRequestDuration.observe(time.Since(start).Seconds(), path)
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CIB schema conversion
+//
+// Clients can ask for the CIB in a particular schema
+// version with ?schema=<version>. Pacemaker can only
+// upgrade a CIB (there are no downgrade transforms),
+// and only to the latest schema it knows about, so
+// the conversion is done by running cibadmin --upgrade
+// against a private copy of the document. Any other
+// target version can't be produced and is reported as
+// errSchemaUnsupported, which is cached like a
+// conversion so that asking for it again doesn't run
+// cibadmin. cibadmin takes a slot of the parse limiter
+// while it runs, and is killed after cibadminTimeout.
+
+var errSchemaUnsupported = errors.New("conversion to the requested schema is not possible")
+
+var cibadminPath = "/usr/sbin/cibadmin"
+
+const cibadminTimeout = 30 * time.Second
+
+// cibRootAttr returns an attribute of the <cib> root
+// element without parsing the rest of the document.
+func cibRootAttr(xmldoc string, name string) (string, bool) {
+	decoder := xml.NewDecoder(strings.NewReader(xmldoc))
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return "", false
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			if start.Name.Local != "cib" {
+				return "", false
+			}
+			for _, attr := range start.Attr {
+				if attr.Name.Local == name {
+					return attr.Value, true
+				}
+			}
+			return "", false
+		}
+	}
+}
+
+// normalizeSchema accepts both "3.0" and "pacemaker-3.0".
+func normalizeSchema(schema string) string {
+	if schema != "" && !strings.Contains(schema, "-") {
+		return "pacemaker-" + schema
+	}
+	return schema
+}
+
+type schemaCache struct {
+	lock    sync.Mutex
+	source  string
+	entries map[string]schemaEntry
+}
+
+// schemaEntry is a converted document, or
+// errSchemaUnsupported.
+type schemaEntry struct {
+	xmldoc string
+	err    error
+}
+
+// convert returns xmldoc, whose hash is source,
+// converted to the target schema. Results are cached
+// per source document and target version; entries for
+// older documents are dropped as soon as a new
+// document is converted. Errors other than
+// errSchemaUnsupported aren't cached.
+func (sc *schemaCache) convert(ctx context.Context, xmldoc string, source string, target string) (string, error) {
+	target = normalizeSchema(target)
+	current, _ := cibRootAttr(xmldoc, "validate-with")
+	if target == current {
+		return xmldoc, nil
+	}
+
+	sc.lock.Lock()
+	if sc.source != source {
+		sc.source = source
+		sc.entries = make(map[string]schemaEntry)
+	}
+	entry, ok := sc.entries[target]
+	sc.lock.Unlock()
+	if ok {
+		return entry.xmldoc, entry.err
+	}
+
+	converted, err := upgradeCib(ctx, xmldoc)
+	if err != nil {
+		return "", err
+	}
+	entry = schemaEntry{xmldoc: converted}
+	if v, _ := cibRootAttr(converted, "validate-with"); v != target {
+		entry = schemaEntry{err: errSchemaUnsupported}
+	}
+
+	sc.lock.Lock()
+	if sc.source == source {
+		sc.entries[target] = entry
+	}
+	sc.lock.Unlock()
+	return entry.xmldoc, entry.err
+}
+
+// upgradeCib upgrades a copy of the CIB to the latest
+// schema supported by the installed Pacemaker.
+func upgradeCib(ctx context.Context, xmldoc string) (string, error) {
+	if err := cibParses.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer cibParses.release()
+	ctx, cancel := context.WithTimeout(ctx, cibadminTimeout)
+	defer cancel()
+
+	tmp, err := ioutil.TempFile("", "hawk-cib-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(xmldoc)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.CommandContext(ctx, cibadminPath, "--upgrade", "--force")
+	cmd.Env = append(os.Environ(), fmt.Sprintf("CIB_file=%s", tmp.Name()))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return "", fmt.Errorf("cibadmin --upgrade failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	upgraded, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		return "", err
+	}
+	return string(upgraded), nil
+}
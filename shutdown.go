@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Graceful shutdown
+//
+// On SIGINT or SIGTERM, the servers stop accepting
+// connections and wait up to shutdown_timeout seconds
+// for the requests in progress to complete. Streams and
+// long polls still open at the deadline have their
+// connections closed. The CIB fetcher is then stopped
+// and the process exits with status 0. A second signal
+// terminates the process at once.
+
+const defaultShutdownTimeout = 10
+
+// shutdownSignals returns a channel that is closed when
+// the process receives SIGINT or SIGTERM.
+func shutdownSignals() <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	quit := make(chan struct{})
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Infof("Received %s, shutting down", sig)
+		close(quit)
+	}()
+	return quit
+}
+
+// shutdownServers shuts the servers down, closing the
+// connections of the requests still in progress after
+// timeout.
+func shutdownServers(servers []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Warnf("Requests still in progress on %s after %s, closing their connections", srv.Addr, timeout)
+				srv.Close()
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloader
+//
+// Runs the registered reload actions (reopening the
+// log file, etc.) each time the process receives
+// SIGHUP. Actions run in the order they were added,
+// and a failing action is logged without preventing
+// the others from running.
+//
+// Tools rotating logs and certificates tend to signal
+// the process at the same time, so signals arriving
+// within reloadWindow of the first one are coalesced
+// into a single reload. A signal arriving while the
+// actions run triggers another reload afterwards,
+// since whatever it announces may have happened after
+// the actions read their files. Actions must be
+// idempotent.
+
+const reloadWindow = 500 * time.Millisecond
+
+type reloadAction struct {
+	name string
+	fn   func() error
+}
+
+type reloader struct {
+	lock    sync.Mutex
+	actions []reloadAction
+	window  time.Duration
+}
+
+func newReloader() *reloader {
+	return &reloader{window: reloadWindow}
+}
+
+func (rl *reloader) add(name string, fn func() error) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	rl.actions = append(rl.actions, reloadAction{name: name, fn: fn})
+}
+
+// reload runs the actions for the given number of
+// coalesced signals, and logs a summary of the
+// results.
+func (rl *reloader) reload(signals int) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	var reloaded, failed []string
+	for _, action := range rl.actions {
+		if err := action.fn(); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%s)", action.name, err))
+		} else {
+			reloaded = append(reloaded, action.name)
+		}
+	}
+	summary := fmt.Sprintf("Reload after %d SIGHUP: reloaded [%s]", signals, strings.Join(reloaded, ", "))
+	if len(failed) > 0 {
+		log.Errorf("%s, failed [%s]", summary, strings.Join(failed, ", "))
+	} else {
+		log.Info(summary)
+	}
+}
+
+// run reloads for each burst of signals, until the
+// channel is closed.
+func (rl *reloader) run(signals <-chan os.Signal) {
+	for range signals {
+		n := 1
+		timer := time.NewTimer(rl.window)
+	coalesce:
+		for {
+			select {
+			case _, ok := <-signals:
+				if !ok {
+					break coalesce
+				}
+				n++
+			case <-timer.C:
+				break coalesce
+			}
+		}
+		timer.Stop()
+		rl.reload(n)
+	}
+}
+
+// start begins listening for SIGHUP in the background.
+func (rl *reloader) start() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go rl.run(signals)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+// Request smuggling
+//
+// A request whose length can be read in more than one
+// way (both Content-Length and Transfer-Encoding, or
+// several Content-Length values) may be split
+// differently by a proxy in front of the server than
+// by the server itself. net/http already rejects
+// conflicting Content-Length values and unknown
+// transfer codings, and drops Content-Length when the
+// body is chunked, but as defense in depth any such
+// combination that reaches a handler is rejected here
+// too.
+
+// ambiguousLength returns a description of what makes
+// the length of the request body ambiguous, or "".
+func ambiguousLength(r *http.Request) string {
+	cl := r.Header["Content-Length"]
+	te := append([]string{}, r.TransferEncoding...)
+	te = append(te, r.Header["Transfer-Encoding"]...)
+	if len(cl) > 1 {
+		return fmt.Sprintf("%d Content-Length headers", len(cl))
+	}
+	if len(cl) == 1 {
+		v := strings.TrimSpace(cl[0])
+		if v == "" || strings.Trim(v, "0123456789") != "" {
+			return fmt.Sprintf("malformed Content-Length %q", cl[0])
+		}
+	}
+	if len(te) > 0 && len(cl) > 0 {
+		return "both Content-Length and Transfer-Encoding"
+	}
+	if len(te) > 1 || (len(te) == 1 && !strings.EqualFold(strings.TrimSpace(te[0]), "chunked")) {
+		return fmt.Sprintf("unsupported Transfer-Encoding %q", strings.Join(te, ", "))
+	}
+	if len(te) > 0 && !r.ProtoAtLeast(1, 1) {
+		return "Transfer-Encoding in an " + r.Proto + " request"
+	}
+	return ""
+}
+
+// NewSmugglingGuard rejects requests with an
+// ambiguous length with 400 Bad Request.
+func NewSmugglingGuard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reason := ambiguousLength(r); reason != "" {
+			log.Warnf("Rejected request from %s for %s: %s", r.RemoteAddr, r.URL.Path, reason)
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Bad request: ambiguous message length.", http.StatusBadRequest)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
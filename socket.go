@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// Unix domain sockets
+//
+// A listener with a socket path serves on a Unix
+// domain socket instead of a TCP port, for running
+// behind a proxy on the same host. A socket file left
+// behind by a server that didn't shut down cleanly is
+// removed on startup, but not one that is still
+// accepting connections, nor anything that isn't a
+// socket. Behind a local proxy, TLS is pointless, so
+// such a listener may serve plain HTTP.
+
+const defaultSocketMode = "0660"
+
+// parseSocketMode parses an octal file mode such as
+// 0660.
+func parseSocketMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %q", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// removeStaleSocket removes the socket file at path if
+// no server is listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+	return os.Remove(path)
+}
+
+// listenUnix listens on a Unix domain socket at path,
+// with the given file mode. The socket file is removed
+// when the listener is closed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
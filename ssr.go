@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// Server-side rendered index
+//
+// With ssr_index set, requests for the index of a file
+// route render index.tmpl from the route target as an
+// html/template, with a summary of the cluster state
+// as its data, so that the dashboard shows the node and
+// resource counts before its scripts have loaded. The
+// page is rendered once per CIB and template version.
+// Without a template, or before the first CIB has been
+// read, the static index.html is served as usual.
+
+const indexTemplate = "index.tmpl"
+
+// indexSummary is the data passed to the index
+// template.
+type indexSummary struct {
+	ClusterName      string
+	Nodes            int
+	NodesOnline      int
+	Resources        int
+	ResourcesStarted int
+	FailedActions    int
+	Updated          time.Time
+}
+
+// indexCache holds the index rendered for the latest
+// CIB.
+type indexCache struct {
+	lock    sync.Mutex
+	key     string
+	data    []byte
+	updated time.Time
+}
+
+// get returns the page cached under key, or renders
+// and caches a new one.
+func (c *indexCache) get(key string, render func() ([]byte, error)) ([]byte, time.Time, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.key == key && c.data != nil {
+		return c.data, c.updated, nil
+	}
+	data, err := render()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	c.key, c.data, c.updated = key, data, time.Now()
+	return data, c.updated, nil
+}
+
+func newIndexSummary(xmldoc string, clusterName string, updated time.Time) (*indexSummary, error) {
+	doc, err := parseCibStatus(xmldoc)
+	if err != nil {
+		return nil, err
+	}
+	summary := &indexSummary{ClusterName: clusterName, Updated: updated}
+	nodes := doc.nodeStatuses()
+	summary.Nodes = len(nodes)
+	for _, n := range nodes {
+		if n.Online {
+			summary.NodesOnline++
+		}
+	}
+	summary.Resources, summary.ResourcesStarted, summary.FailedActions = doc.resourceSummary()
+	return summary, nil
+}
+
+func renderIndex(filename string, summary *indexSummary) ([]byte, error) {
+	tmpl, err := template.ParseFiles(filename)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, summary); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// clusterName returns the cluster-name property of the
+// current CIB, if set.
+func (handler *routeHandler) clusterName() string {
+	if data, ok := handler.views.get(context.Background(), "properties"); ok {
+		var properties map[string]string
+		if json.Unmarshal(data, &properties) == nil {
+			return properties["cluster-name"]
+		}
+	}
+	return ""
+}
+
+// isIndexPath returns true for requests of the index
+// page of a file route.
+func isIndexPath(route *ConfigRoute, urlpath string) bool {
+	return urlpath == route.Path || urlpath == path.Join(route.Path, "index.html")
+}
+
+// serveIndex renders the index template of a file
+// route. It returns false to fall back to the static
+// index.
+func (handler *routeHandler) serveIndex(w http.ResponseWriter, r *http.Request, route *ConfigRoute) bool {
+	filename := path.Join(*route.Target, indexTemplate)
+	info, err := os.Stat(filename)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	xmldoc, hash := handler.cib.Snapshot()
+	if xmldoc == "" {
+		return false
+	}
+	key := hash + "/" + info.ModTime().String()
+
+	data, updated, err := handler.index.get(key, func() ([]byte, error) {
+		summary, err := newIndexSummary(xmldoc, handler.clusterName(), handler.cib.Updated())
+		if err != nil {
+			return nil, err
+		}
+		return renderIndex(filename, summary)
+	})
+	if err != nil {
+		log.Errorf("Failed to render %s: %s", filename, err)
+		return false
+	}
+	log.Debugf("[index] %s", filename)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "index.html", updated, bytes.NewReader(data))
+	return true
+}
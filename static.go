@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+)
+
+// Static files
+//
+// File routes serve the files under their target
+// directory, and -docroot adds such a route at / for
+// the dashboard's own assets (index.html, favicon.ico
+// and so on). Files are opened through http.Dir, which
+// cleans the path as if rooted at the target first, so
+// that ".." can't escape it. A directory serves its
+// index.html, and never a listing. A request for a
+// file that doesn't exist falls through to the next
+// route.
+
+// openStatic opens the file for urlpath under root. It
+// returns nil if there is no such file.
+func openStatic(root, urlpath string) (http.File, os.FileInfo) {
+	dir := http.Dir(root)
+	f, err := dir.Open(urlpath)
+	if err != nil {
+		return nil, nil
+	}
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		f.Close()
+		if f, err = dir.Open(path.Join(urlpath, "index.html")); err != nil {
+			return nil, nil
+		}
+		info, err = f.Stat()
+	}
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, nil
+	}
+	return f, info
+}
+
+// checkDocRoot returns an error unless root is a
+// directory.
+func checkDocRoot(root string) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return fmt.Errorf("Invalid docroot: %s", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Invalid docroot: %s is not a directory", root)
+	}
+	return nil
+}
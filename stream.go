@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Server-Sent Events
+//
+// Streaming endpoints push JSON-encoded events to the
+// client as a text/event-stream, until the client goes
+// away. A comment line is sent periodically so that
+// proxies don't time out an idle stream.
+
+const sseKeepAlive = 30 * time.Second
+
+// streamPolicy
+//
+// Each streaming client gets its own buffered channel,
+// so that a slow client never blocks the others or the
+// CIB fetcher. When a client's buffer is full, the
+// default drop-oldest policy discards its oldest
+// pending event to make room for the new one, keeping
+// the client connected but possibly missing events.
+// The disconnect policy closes the stream instead, so
+// that the client can reconnect and start over from a
+// fresh snapshot.
+
+const (
+	defaultStreamBuffer = 64
+	streamDropOldest    = "drop-oldest"
+	streamDisconnect    = "disconnect"
+)
+
+var (
+	streamDropped = newCounterVec("hawk_stream_dropped_events_total",
+		"Events dropped because a streaming client was too slow.", "stream")
+	streamDisconnects = newCounterVec("hawk_stream_slow_disconnects_total",
+		"Streaming clients disconnected for being too slow.", "stream")
+)
+
+type streamPolicy struct {
+	Buffer     int
+	Disconnect bool
+}
+
+func newStreamPolicy(buffer int, policy string) (streamPolicy, error) {
+	if buffer < 1 {
+		return streamPolicy{}, fmt.Errorf("Invalid stream buffer size: %d", buffer)
+	}
+	switch policy {
+	case streamDropOldest:
+		return streamPolicy{Buffer: buffer}, nil
+	case streamDisconnect:
+		return streamPolicy{Buffer: buffer, Disconnect: true}, nil
+	}
+	return streamPolicy{}, fmt.Errorf("Invalid stream policy: %s (must be %s|%s)", policy, streamDropOldest, streamDisconnect)
+}
+
+// bufferSize returns the configured buffer size, or
+// the default for a zero policy.
+func (p streamPolicy) bufferSize() int {
+	if p.Buffer < 1 {
+		return defaultStreamBuffer
+	}
+	return p.Buffer
+}
+
+func startEventStream(w http.ResponseWriter) (http.Flusher, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpJSONError(w, "Streaming is not supported.", http.StatusInternalServerError)
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return flusher, true
+}
+
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, event string, data interface{}) error {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, js)
+	flusher.Flush()
+	return err
+}
+
+// cibEvent is the data of a "cib" event.
+type cibEvent struct {
+	Hash string `json:"hash"`
+	Cib  string `json:"cib"`
+}
+
+// serveCibStream sends the current CIB and then each
+// new one as "cib" events. A client that is too slow
+// to receive every CIB misses some or is disconnected,
+// according to the stream policy.
+func (handler *routeHandler) serveCibStream(w http.ResponseWriter, r *http.Request) bool {
+	events, current := handler.cib.Subscribe()
+	defer handler.cib.Unsubscribe(events)
+
+	flusher, ok := startEventStream(w)
+	if !ok {
+		return true
+	}
+	streamClients.add(1, "cib")
+	defer streamClients.add(-1, "cib")
+	if current.xmldoc != "" {
+		if writeEvent(w, flusher, "cib", cibEvent{Hash: current.hash, Cib: current.xmldoc}) != nil {
+			return true
+		}
+	}
+
+	keepalive := time.NewTicker(sseKeepAlive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return true
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return true
+			}
+			flusher.Flush()
+		case snap, ok := <-events:
+			if !ok {
+				// disconnected for being too slow
+				return true
+			}
+			if writeEvent(w, flusher, "cib", cibEvent{Hash: snap.hash, Cib: snap.xmldoc}) != nil {
+				return true
+			}
+		}
+	}
+}
+
+// serveNodeStream sends the state of all nodes as a
+// "nodes" event, followed by a "node" event each time
+// the online, standby or maintenance state of a node
+// changes.
+func (handler *routeHandler) serveNodeStream(w http.ResponseWriter, r *http.Request) bool {
+	events, current := handler.cib.SubscribeNodes()
+	defer handler.cib.UnsubscribeNodes(events)
+
+	flusher, ok := startEventStream(w)
+	if !ok {
+		return true
+	}
+	streamClients.add(1, "nodes")
+	defer streamClients.add(-1, "nodes")
+	if writeEvent(w, flusher, "nodes", current) != nil {
+		return true
+	}
+
+	keepalive := time.NewTicker(sseKeepAlive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return true
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return true
+			}
+			flusher.Flush()
+		case change, ok := <-events:
+			if !ok {
+				// disconnected for being too slow
+				return true
+			}
+			if writeEvent(w, flusher, "node", change) != nil {
+				return true
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// Socket activation
+//
+// When started by a systemd .socket unit, the listening
+// socket is passed to the process as file descriptor 3,
+// with LISTEN_PID and LISTEN_FDS set in the
+// environment, instead of the server binding the
+// address itself.
+
+const listenFdsStart = 3
+
+// listenFds returns the number of sockets passed to
+// the process with pid, given the LISTEN_PID and
+// LISTEN_FDS values, or 0 if they are for another
+// process or there are none.
+func listenFds(listenPid, listenFds string, pid int) int {
+	p, err := strconv.Atoi(listenPid)
+	if err != nil || p != pid {
+		return 0
+	}
+	nfds, err := strconv.Atoi(listenFds)
+	if err != nil || nfds < 1 {
+		return 0
+	}
+	return nfds
+}
+
+// systemdListener returns the socket-activated
+// listener, or nil if the process wasn't started with
+// socket activation.
+func systemdListener() (net.Listener, error) {
+	nfds := listenFds(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid())
+	if nfds == 0 {
+		return nil, nil
+	}
+	// don't pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if nfds > 1 {
+		log.Warnf("systemd passed %d sockets, only the first one is used", nfds)
+	}
+	for fd := listenFdsStart; fd < listenFdsStart+nfds; fd++ {
+		syscall.CloseOnExec(fd)
+	}
+
+	file := os.NewFile(uintptr(listenFdsStart), "systemd-socket")
+	defer file.Close()
+	return net.FileListener(file)
+}
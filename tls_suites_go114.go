@@ -0,0 +1,31 @@
+// +build go1.14
+
+package main
+
+import "crypto/tls"
+
+// tlsVersions and tlsCipherSuites
+//
+// TLS 1.3 was added in go 1.12 and the list of cipher
+// suites in go 1.14.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCipherSuites returns the cipher suites by name,
+// and whether each of them is insecure.
+func tlsCipherSuites() (map[string]uint16, map[uint16]bool) {
+	suites := make(map[string]uint16)
+	insecure := make(map[uint16]bool)
+	for _, s := range tls.CipherSuites() {
+		suites[s.Name] = s.ID
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		suites[s.Name] = s.ID
+		insecure[s.ID] = true
+	}
+	return suites, insecure
+}
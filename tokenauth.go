@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Bearer tokens
+//
+// With -token-file, automation can call the API with
+// Authorization: Bearer <token> instead of a session
+// cookie or a user's password. The file holds one token
+// per line, optionally preceded by a label and a space;
+// blank lines and lines starting with # are skipped. It
+// is read again on SIGHUP, so that tokens can be added
+// and revoked without a restart. A missing or empty
+// file accepts no tokens, and leaves the other
+// authentication methods alone. A request
+// authenticated by a token runs as bearer:<label>, or
+// bearer:<n> for the nth token of the file if it has
+// no label, for the rate limits, admin_users and the
+// logs. The colon keeps these names apart from system
+// accounts, which can't contain one.
+//
+// Tokens are kept as SHA-256 digests, and a presented
+// token is compared with each of them in constant time,
+// so that neither its content nor its length leaks
+// through the response time.
+
+const tokenUserPrefix = "bearer:"
+
+type tokenEntry struct {
+	hash [sha256.Size]byte
+	user string
+}
+
+type tokenStore struct {
+	path    string
+	entries atomic.Value // []tokenEntry
+}
+
+// newTokenStore loads the tokens in path. It returns
+// nil, accepting no tokens, if path is empty.
+func newTokenStore(path string) (*tokenStore, error) {
+	if path == "" {
+		return nil, nil
+	}
+	s := &tokenStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseTokens returns the digests of the tokens in
+// data, with the user each one authenticates as.
+func parseTokens(data []byte) []tokenEntry {
+	var entries []tokenEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		label := strconv.Itoa(len(entries) + 1)
+		token := line
+		if fields := strings.Fields(line); len(fields) == 2 {
+			label, token = fields[0], fields[1]
+		}
+		entries = append(entries, tokenEntry{hash: sha256.Sum256([]byte(token)), user: tokenUserPrefix + label})
+	}
+	return entries
+}
+
+// reload reads the token file again. If it can't be
+// read, the previous tokens are kept, unless it is
+// missing, which disables bearer auth.
+func (s *tokenStore) reload() error {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	entries := parseTokens(data)
+	if len(entries) == 0 {
+		log.Warnf("No tokens in %s, bearer authentication is disabled", s.path)
+	}
+	s.entries.Store(entries)
+	return nil
+}
+
+// check returns the user of token if it is one of the
+// accepted tokens.
+func (s *tokenStore) check(token string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	entries, _ := s.entries.Load().([]tokenEntry)
+	sum := sha256.Sum256([]byte(token))
+	user := ""
+	for i := range entries {
+		if subtle.ConstantTimeCompare(sum[:], entries[i].hash[:]) == 1 {
+			user = entries[i].user
+		}
+	}
+	return user, user != ""
+}
+
+// bearerToken returns the token of an Authorization:
+// Bearer header.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	const prefix = "bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing
+//
+// With otel_endpoint set, each request is traced as an
+// OpenTelemetry span, continuing the trace of the
+// caller if it sent a W3C traceparent header, with
+// child spans around the external authentication
+// commands and the parsing of the CIB. The spans are
+// exported in batches to the collector with the
+// OTLP/HTTP JSON encoding. Only what is needed for
+// that is implemented here; when the queue to the
+// exporter is full, spans are dropped and counted
+// rather than delaying requests.
+
+const (
+	spanQueueSize   = 1024
+	spanBatchSize   = 256
+	spanFlushPeriod = 5 * time.Second
+	traceService    = "hawk-apiserver"
+)
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+var spansDropped = newCounterVec("hawk_trace_spans_dropped_total",
+	"Trace spans dropped because the exporter couldn't keep up.")
+
+type traceID [16]byte
+type spanID [8]byte
+
+type span struct {
+	tracer  *spanExporter
+	trace   traceID
+	id      spanID
+	parent  spanID
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   map[string]string
+	failure string
+}
+
+// startSpan starts a child of the span in ctx. Without
+// a span in ctx, nothing is traced and the returned
+// span is nil, on which all methods can be called.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	parent, ok := ctx.Value(traceContextKey).(*span)
+	if !ok || parent == nil {
+		return ctx, nil
+	}
+	s := &span{
+		tracer: parent.tracer,
+		trace:  parent.trace,
+		parent: parent.id,
+		name:   name,
+		kind:   spanKindInternal,
+		start:  time.Now(),
+	}
+	rand.Read(s.id[:])
+	return context.WithValue(ctx, traceContextKey, s), s
+}
+
+func (s *span) setAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = value
+}
+
+func (s *span) setError(err error) {
+	if s != nil && err != nil {
+		s.failure = err.Error()
+	}
+}
+
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.tracer.export(s)
+}
+
+// parseTraceparent parses a W3C traceparent header
+// (version-traceid-parentid-flags).
+func parseTraceparent(value string) (traceID, spanID, bool) {
+	var trace traceID
+	var parent spanID
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return trace, parent, false
+	}
+	t, err := hex.DecodeString(parts[1])
+	if err != nil || len(t) != len(trace) || bytes.Equal(t, trace[:]) {
+		return trace, parent, false
+	}
+	p, err := hex.DecodeString(parts[2])
+	if err != nil || len(p) != len(parent) || bytes.Equal(p, parent[:]) {
+		return trace, parent, false
+	}
+	copy(trace[:], t)
+	copy(parent[:], p)
+	return trace, parent, true
+}
+
+// unmarshalCib parses the CIB into v for a request,
+// within the parse limits and in a child span of the
+// request.
+func unmarshalCib(ctx context.Context, cib_data string, v interface{}) error {
+	if err := cibParses.acquire(ctx); err != nil {
+		return err
+	}
+	defer cibParses.release()
+	_, s := startSpan(ctx, "parse cib")
+	err := xml.Unmarshal([]byte(cib_data), v)
+	s.setAttr("cib.size", strconv.Itoa(len(cib_data)))
+	s.setError(err)
+	s.finish()
+	return err
+}
+
+// spanExporter sends finished spans to the collector.
+type spanExporter struct {
+	endpoint string
+	client   *http.Client
+	queue    chan *span
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newSpanExporter(endpoint string) *spanExporter {
+	e := &spanExporter{
+		endpoint: strings.TrimRight(endpoint, "/") + "/v1/traces",
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *span, spanQueueSize),
+		done:     make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.run()
+	return e
+}
+
+func (e *spanExporter) export(s *span) {
+	select {
+	case e.queue <- s:
+	default:
+		spansDropped.inc()
+	}
+}
+
+// stop sends the queued spans and stops the exporter.
+func (e *spanExporter) stop() {
+	close(e.done)
+	e.wg.Wait()
+}
+
+func (e *spanExporter) run() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(spanFlushPeriod)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.done:
+			for {
+				select {
+				case s := <-e.queue:
+					batch = append(batch, s)
+				default:
+					e.send(batch)
+					return
+				}
+			}
+		}
+		e.send(batch)
+		batch = nil
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string      `json:"traceId"`
+	SpanId            string      `json:"spanId"`
+	ParentSpanId      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Status            *otlpStatus `json:"status,omitempty"`
+}
+
+func otlpAttrs(attrs map[string]string) []otlpAttr {
+	var list []otlpAttr
+	for k, v := range attrs {
+		list = append(list, otlpAttr{Key: k, Value: otlpValue{StringValue: v}})
+	}
+	return list
+}
+
+// encodeSpans returns the OTLP/HTTP JSON request for a
+// batch of spans.
+func encodeSpans(batch []*span) ([]byte, error) {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceId:           hex.EncodeToString(s.trace[:]),
+			SpanId:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttrs(s.attrs),
+		}
+		if s.parent != (spanID{}) {
+			o.ParentSpanId = hex.EncodeToString(s.parent[:])
+		}
+		if s.failure != "" {
+			o.Status = &otlpStatus{Code: 2, Message: s.failure}
+		}
+		spans = append(spans, o)
+	}
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttrs(map[string]string{"service.name": traceService}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": traceService},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+}
+
+func (e *spanExporter) send(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := encodeSpans(batch)
+	if err != nil {
+		log.Errorf("Failed to encode trace spans: %s", err)
+		return
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Warnf("Failed to export trace spans: %s", err)
+		spansDropped.add(float64(len(batch)))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Warnf("Failed to export trace spans: %s returned %s", e.endpoint, resp.Status)
+		spansDropped.add(float64(len(batch)))
+	}
+}
+
+// statusRecorder remembers the status code and size
+// of the response for the request span, metrics and
+// access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+	size int64
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if fw, ok := w.ResponseWriter.(http.Flusher); ok {
+		fw.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, fmt.Errorf("http.Hijacker interface is not supported")
+}
+
+// NewTracingHandler wraps h with a server span for each
+// request, exported by tracer.
+func NewTracingHandler(h http.Handler, tracer *spanExporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &span{
+			tracer: tracer,
+			name:   r.Method + " " + r.URL.Path,
+			kind:   spanKindServer,
+			start:  time.Now(),
+		}
+		if trace, parent, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+			s.trace, s.parent = trace, parent
+		} else {
+			rand.Read(s.trace[:])
+		}
+		rand.Read(s.id[:])
+		s.setAttr("http.method", r.Method)
+		s.setAttr("http.target", r.URL.RequestURI())
+		s.setAttr("net.peer.ip", addrHost(r.RemoteAddr))
+
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), traceContextKey, s)))
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		s.setAttr("http.status_code", strconv.Itoa(rec.code))
+		if rec.code >= 500 {
+			s.failure = http.StatusText(rec.code)
+		}
+		s.finish()
+	})
+}
@@ -2,19 +2,30 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // parseConfigFile
 //
 // Configuration file parser. The configuration file format is
-// described in config.json.example and README.md.
+// described in config.json.example and README.md. The file may
+// also be gzip-compressed. Unknown keys are fatal errors.
 
 type offsetContext struct {
 	start int
@@ -49,31 +60,218 @@ func fatalSyntaxError(js string, err error) {
 	log.Fatalf("%s^", strings.Repeat(" ", ctx.pos))
 }
 
+// readConfigFile reads the configuration file,
+// transparently decompressing it if it's gzipped.
+func readConfigFile(cfgfile string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(cfgfile)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 2 || raw[0] != 0x1f || raw[1] != 0x8b {
+		return raw, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%v: malformed gzip data: %v", cfgfile, err)
+	}
+	defer zr.Close()
+	raw, err = ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("%v: malformed gzip data: %v", cfgfile, err)
+	}
+	return raw, nil
+}
+
+// decodeConfig parses the configuration into target.
+// Keys that don't match any setting are errors, so
+// that typos don't go unnoticed.
+func decodeConfig(raw []byte, target *Config) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(target)
+}
+
+var unknownFieldError = regexp.MustCompile(`^json: unknown field "(.*)"$`)
+
+// unknownKey returns the name of the unknown key err
+// complains about, and where it first appears in js as
+// a key.
+func unknownKey(js string, err error) (string, int64, bool) {
+	m := unknownFieldError.FindStringSubmatch(err.Error())
+	if m == nil {
+		return "", 0, false
+	}
+	loc := regexp.MustCompile(regexp.QuoteMeta(strconv.Quote(m[1])) + `\s*:`).FindStringIndex(js)
+	if loc == nil {
+		return m[1], -1, true
+	}
+	return m[1], int64(loc[0]) + 1, true
+}
+
+func fatalUnknownKey(js string, key string, offset int64) {
+	if offset < 0 {
+		log.Fatalf("Unknown configuration key %q", key)
+		return
+	}
+	ctx := contextAtOffset(js, offset)
+	log.Printf("Error in line %d: unknown configuration key %q", ctx.line, key)
+	log.Printf("%s", js[ctx.start:ctx.end])
+	log.Fatalf("%s^", strings.Repeat(" ", ctx.pos))
+}
+
 func parseConfigFile(cfgfile string, target *Config) {
 	log.Printf("Reading %v...", cfgfile)
-	raw, err := ioutil.ReadFile(cfgfile)
+	raw, err := readConfigFile(cfgfile)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
-	err = json.Unmarshal(raw, target)
+	err = decodeConfig(raw, target)
 	if err != nil {
+		if key, offset, ok := unknownKey(string(raw), err); ok {
+			fatalUnknownKey(string(raw), key, offset)
+			return
+		}
 		fatalSyntaxError(string(raw), err)
 	}
 }
 
+// hawkAuth
+//
+// Settings for checkHawkAuthMethods.
+type hawkAuth struct {
+	// headerProxies is set when -trust-auth-header is
+	// enabled: requests from these proxies are
+	// authenticated by the authUserHeader they pass on.
+	headerProxies *proxyTrust
+	// admins are the users allowed to access the
+	// /admin endpoints.
+	admins map[string]bool
+	// failures remembers recently failed credentials.
+	failures *authFailureCache
+	// successes remembers recently successful
+	// credentials.
+	successes *authSuccessCache
+	// cookieFallback is what to do with session cookies
+	// when attrd_updater is missing.
+	cookieFallback string
+	// sessions returns the hawk sessions of a user in the
+	// current CIB, for the cib cookie fallback.
+	sessions func(user string) []string
+	// limits are the per-user rate limits, if any.
+	limits *userRateLimiter
+	// execTimeout bounds the authentication commands.
+	execTimeout time.Duration
+	// lockouts limits the failed attempts of each
+	// client address, if set.
+	lockouts *clientAuthLimiter
+	// proxies are trusted to pass on the client
+	// address for the lockouts.
+	proxies *proxyTrust
+	// tokens are the accepted bearer tokens, if any.
+	tokens *tokenStore
+}
+
+// What to do with session cookies when attrd_updater
+// is missing.
+const (
+	// fall through to basic auth, as if there was no
+	// cookie
+	cookieFallbackBasic = "basic"
+	// reject the request
+	cookieFallbackReject = "reject"
+	// look for the session in the transient node
+	// attributes of the CIB
+	cookieFallbackCib = "cib"
+)
+
+// checkCookieFallback returns an error if the cookie
+// fallback isn't known.
+func checkCookieFallback(fallback string) error {
+	switch fallback {
+	case cookieFallbackBasic, cookieFallbackReject, cookieFallbackCib:
+		return nil
+	}
+	return fmt.Errorf("invalid cookie fallback %q (must be basic, reject or cib)", fallback)
+}
+
+// Authentication policies of a listener.
+const (
+	authHawk       = "hawk"
+	authBasic      = "basic"
+	authClientCert = "client-cert"
+)
+
+type contextKey string
+
+// listenerContextKey holds the *ConfigListener that
+// accepted a request.
+const listenerContextKey = contextKey("listener")
+
+// traceContextKey holds the *span of the current
+// operation, when tracing is enabled.
+const traceContextKey = contextKey("trace")
+
+// authUserHeader carries the identity of a user
+// authenticated by an upstream SSO proxy.
+const authUserHeader = "X-Authenticated-User"
+
 // checkHawkAuthMethods
 //
-// Validates a HTTP request, returning true
-// if it's good.
+// Validates a HTTP request, returning the
+// name of the user and true if it's good.
 // Current methods:
+// * Identity asserted by a trusted SSO proxy
 // * Hawk attrd cookie
 // * Basic Auth (user/passwd)
+// * TLS client certificate
+//
+// Which of these are accepted depends on the auth
+// policy of the listener the request arrived on.
 //
 // Future methods?
 // * API key?
 
-func checkHawkAuthMethods(r *http.Request) bool {
+func (auth *hawkAuth) checkHawkAuthMethods(r *http.Request) (string, bool, error) {
+	policy := authHawk
+	if l, ok := r.Context().Value(listenerContextKey).(*ConfigListener); ok {
+		policy = l.Auth
+	}
+	switch policy {
+	case authClientCert:
+		// the handshake already verified the certificate
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return "", false, nil
+		}
+		user := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		log.Printf("Client certificate authenticated %v", user)
+		return user, true, nil
+	case authBasic:
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			return "", false, nil
+		}
+		valid, err := auth.checkBasicAuth(r.Context(), user, pass)
+		return user, valid, err
+	}
+	// Try identity asserted by a trusted proxy
+	if auth.headerProxies != nil {
+		if proxyUser := r.Header.Get(authUserHeader); proxyUser != "" {
+			if !auth.headerProxies.trusts(r.RemoteAddr) {
+				log.Printf("Rejected %s header from untrusted peer %s", authUserHeader, r.RemoteAddr)
+				return "", false, nil
+			}
+			log.Printf("Proxy authenticated user %v", proxyUser)
+			return proxyUser, true, nil
+		}
+	}
+	// Try bearer token
+	if token, ok := bearerToken(r); ok {
+		if user, ok := auth.tokens.check(token); ok {
+			log.Printf("Valid bearer token for %v", user)
+			return user, true, nil
+		}
+	}
 	// Try hawk attrd cookie
 	var user string
 	var session string
@@ -86,53 +284,219 @@ func checkHawkAuthMethods(r *http.Request) bool {
 		}
 	}
 	if user != "" && session != "" {
-		cmd := exec.Command("/usr/sbin/attrd_updater", "-R", "-Q", "-A", "-n", fmt.Sprintf("hawk_session_%v", user))
-		if cmd != nil {
-			out, _ := cmd.StdoutPipe()
-			cmd.Start()
-			// for each line, look for value="..."
-			// if ... == sessioncookie, then OK
-			scanner := bufio.NewScanner(out)
-			tomatch := fmt.Sprintf("value=\"%v\"", session)
-			for scanner.Scan() {
-				l := scanner.Text()
-				if strings.Contains(l, tomatch) {
-					log.Printf("Valid session cookie for %v", user)
-					return true
+		ctx, span := startSpan(r.Context(), "attrd_updater")
+		ctx, cancel := auth.execContext(ctx)
+		valid, err := checkSessionCookie(ctx, user, session)
+		cancel()
+		span.setAttr("auth.user", user)
+		span.setError(err)
+		span.finish()
+		if err == errAuthTimeout {
+			return "", false, err
+		}
+		if err == errNoAttrdUpdater {
+			cookieValidatorMissing.inc()
+			warnNoAttrdUpdater.Do(func() {
+				log.Printf("%s not found, session cookies can't be validated (cookie_fallback is %s)", attrdUpdater, auth.cookieFallback)
+			})
+			switch auth.cookieFallback {
+			case cookieFallbackReject:
+				return "", false, nil
+			case cookieFallbackCib:
+				// a session that doesn't match is a failed
+				// attempt, for the lockouts, rather than a
+				// reason to try basic auth
+				if auth.sessions == nil || !checkCibSession(auth.sessions(user), session) {
+					return "", false, nil
 				}
+				valid = true
 			}
-			cmd.Wait()
+		}
+		if valid {
+			log.Printf("Valid session cookie for %v", user)
+			return user, true, nil
 		}
 	}
 	user, pass, ok := r.BasicAuth()
 	if !ok {
-		return false
+		return "", false, nil
+	}
+	valid, err := auth.checkBasicAuth(r.Context(), user, pass)
+	if !valid {
+		return "", false, err
+	}
+	return user, true, nil
+}
+
+// isAdmin returns true if the authenticated user
+// may access the /admin endpoints.
+func (auth *hawkAuth) isAdmin(user string) bool {
+	return user != "" && auth.admins[user]
+}
+
+// authCommandDuration times the external commands
+// used to validate credentials.
+var authCommandDuration = newHistogramVec("hawk_auth_command_duration_seconds",
+	"Duration of external authentication commands.",
+	defaultDurationBuckets, "command", "outcome")
+
+func observeAuthCommand(command string, start time.Time, outcome string) {
+	authCommandDuration.observe(time.Since(start).Seconds(), command, outcome)
+}
+
+// The commands validating credentials, variables so
+// that the tests can replace them.
+var (
+	attrdUpdater = "/usr/sbin/attrd_updater"
+	hawkChkpwd   = "/usr/sbin/hawk_chkpwd"
+)
+
+var errNoAttrdUpdater = errors.New(attrdUpdater + " not found")
+
+// cookieValidatorMissing counts the session cookies
+// that couldn't be validated for lack of attrd_updater.
+var cookieValidatorMissing = newCounterVec("hawk_auth_cookie_validator_missing_total",
+	"Session cookies that couldn't be checked because attrd_updater is missing.")
+
+var warnNoAttrdUpdater sync.Once
+
+// errAuthTimeout is returned when an authentication
+// command doesn't complete within the exec timeout.
+var errAuthTimeout = errors.New("Authentication timed out, try again later.")
+
+const defaultAuthExecTimeout = 5
+
+// execContext returns the context to run an
+// authentication command in, bounded by the exec
+// timeout if set.
+func (auth *hawkAuth) execContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if auth.execTimeout > 0 {
+		return context.WithTimeout(ctx, auth.execTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// execError returns errAuthTimeout if the command
+// context of an authentication command expired, and
+// the error of the request context if it is done.
+func execError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return errAuthTimeout
+	}
+	return ctx.Err()
+}
+
+// checkSessionCookie
+//
+// Looks up the hawk session of the user in
+// attrd and compares it to the cookie. It returns
+// errNoAttrdUpdater if attrd_updater is missing, and
+// errAuthTimeout if it is killed for taking too long.
+func checkSessionCookie(ctx context.Context, user, session string) (bool, error) {
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, attrdUpdater, "-R", "-Q", "-A", "-n", fmt.Sprintf("hawk_session_%v", user))
+	out, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		observeAuthCommand("attrd_updater", start, "error")
+		if os.IsNotExist(err) {
+			return false, errNoAttrdUpdater
+		}
+		log.Printf("Failed to run attrd_updater: %v", err)
+		return false, err
 	}
-	if !checkBasicAuth(user, pass) {
-		return false
+	// Killing attrd_updater doesn't close the pipe if
+	// it left children behind, so close it to stop the
+	// scanner once the context is done.
+	scanned := make(chan struct{})
+	defer close(scanned)
+	go func() {
+		select {
+		case <-ctx.Done():
+			out.Close()
+		case <-scanned:
+		}
+	}()
+	// for each line, look for value="..."
+	// if ... == sessioncookie, then OK
+	valid := false
+	scanner := bufio.NewScanner(out)
+	tomatch := fmt.Sprintf("value=\"%v\"", session)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), tomatch) {
+			valid = true
+		}
+	}
+	cmd.Wait()
+	if err := execError(ctx); err != nil {
+		if err == errAuthTimeout {
+			observeAuthCommand("attrd_updater", start, "timeout")
+			log.Printf("attrd_updater timed out checking the session of %v", user)
+		} else {
+			observeAuthCommand("attrd_updater", start, "error")
+		}
+		return false, err
+	}
+	if valid {
+		observeAuthCommand("attrd_updater", start, "success")
+	} else {
+		observeAuthCommand("attrd_updater", start, "failure")
 	}
-	return true
+	return valid, nil
+}
+
+// checkCibSession returns true if session is one of
+// the sessions of the user in the CIB, which the CIB
+// fetcher collects from each update so that requests
+// don't parse it. They are all compared in constant
+// time.
+func checkCibSession(sessions []string, session string) bool {
+	match := 0
+	for _, s := range sessions {
+		match |= subtle.ConstantTimeCompare([]byte(s), []byte(session))
+	}
+	return match == 1 && session != ""
 }
 
 // checkBasicAuth
 //
 // Does HTTP Basic Auth checking against
 // a system user/pass with some help
-// from /usr/sbin/hawk_chkpwd
-func checkBasicAuth(user, pass string) bool {
+// from /usr/sbin/hawk_chkpwd. It returns
+// errAuthTimeout if hawk_chkpwd is killed for taking
+// too long.
+func checkBasicAuth(ctx context.Context, user, pass string) (bool, error) {
 	// /usr/sbin/hawk_chkpwd passwd <user>
 	// write password
 	// close
-	cmd := exec.Command("/usr/sbin/hawk_chkpwd", "passwd", user)
+	cmd := exec.CommandContext(ctx, hawkChkpwd, "passwd", user)
 	if cmd == nil {
-		log.Print("Authorization failed: /usr/sbin/hawk_chkpwd not found")
-		return false
+		log.Printf("Authorization failed: %s not found", hawkChkpwd)
+		return false, nil
 	}
 	cmd.Stdin = strings.NewReader(pass)
+	start := time.Now()
 	err := cmd.Run()
+	if ctxErr := execError(ctx); ctxErr != nil {
+		if ctxErr == errAuthTimeout {
+			observeAuthCommand("hawk_chkpwd", start, "timeout")
+			log.Printf("Authorization failed: hawk_chkpwd timed out for %v", user)
+		} else {
+			observeAuthCommand("hawk_chkpwd", start, "error")
+		}
+		return false, ctxErr
+	}
 	if err != nil {
 		log.Printf("Authorization failed: %v", err)
-		return false
+		if _, ok := err.(*exec.ExitError); ok {
+			observeAuthCommand("hawk_chkpwd", start, "failure")
+		} else {
+			observeAuthCommand("hawk_chkpwd", start, "error")
+		}
+		return false, nil
 	}
-	return true
+	observeAuthCommand("hawk_chkpwd", start, "success")
+	return true, nil
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// viewCache
+//
+// Caches the JSON rendering of the derived API views
+// (all nodes, resources, constraints and the cluster
+// configuration) for the current CIB. Parsing a large
+// CIB is CPU-bound, so after each update the views are
+// rebuilt in parallel by a bounded number of workers,
+// and the first request to each endpoint is served
+// from the cache rather than parsing the CIB itself.
+//
+// A view with a TTL is kept across CIB updates until
+// it is TTL old, and then rendered again from the
+// latest CIB the next time it's requested. With no TTL
+// (or 0), a view is rendered again on every change.
+//
+// Each view remembers the hash of the CIB it was
+// rendered from, so that the API only serves it along
+// with that CIB's X-Cib-Hash; a view that is older,
+// within its TTL or not yet rendered again after an
+// update, is left for the handler to render from the
+// request's own snapshot.
+
+var derivedViews = []string{"nodes", "resources", "cluster", "constraints", "properties"}
+
+type cachedView struct {
+	data       []byte
+	hash       string
+	rendered   time.Time
+	generation uint64
+}
+
+type viewCache struct {
+	workers    int
+	ttls       map[string]time.Duration
+	lock       sync.Mutex
+	generation uint64
+	cib        string
+	hash       string
+	views      map[string]cachedView
+}
+
+func newViewCache(workers int, ttls map[string]time.Duration) *viewCache {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &viewCache{
+		workers: workers,
+		ttls:    ttls,
+		views:   make(map[string]cachedView),
+	}
+}
+
+// parseViewTTLs converts the configured TTLs, in
+// seconds, checking that they name derived views.
+func parseViewTTLs(ttls map[string]int) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration, len(ttls))
+	for view, secs := range ttls {
+		known := false
+		for _, v := range derivedViews {
+			known = known || v == view
+		}
+		if !known {
+			return nil, fmt.Errorf("Can't set a cache TTL for %s (must be one of %s)", view, strings.Join(derivedViews, "|"))
+		}
+		if secs < 0 {
+			return nil, fmt.Errorf("Invalid cache TTL for %s: %d", view, secs)
+		}
+		durations[view] = time.Duration(secs) * time.Second
+	}
+	return durations, nil
+}
+
+// update drops the views of the previous CIB, except
+// those still within their TTL, and starts rendering
+// the views for the new one.
+func (vc *viewCache) update(cib_data string, hash string) {
+	vc.lock.Lock()
+	vc.generation++
+	generation := vc.generation
+	vc.cib, vc.hash = cib_data, hash
+	var queue []string
+	for _, view := range derivedViews {
+		if cached, ok := vc.views[view]; ok && time.Since(cached.rendered) < vc.ttls[view] {
+			continue
+		}
+		delete(vc.views, view)
+		queue = append(queue, view)
+	}
+	vc.lock.Unlock()
+
+	views := make(chan string, len(queue))
+	for _, view := range queue {
+		views <- view
+	}
+	close(views)
+
+	workers := vc.workers
+	if workers > len(queue) {
+		workers = len(queue)
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for view := range views {
+				data, err := renderView(context.Background(), cib_data, view)
+				if err != nil {
+					log.Errorf("Failed to render %s view: %s", view, err)
+					continue
+				}
+				vc.store(view, generation, data)
+			}
+		}()
+	}
+}
+
+func (vc *viewCache) store(view string, generation uint64, data []byte) {
+	vc.lock.Lock()
+	defer vc.lock.Unlock()
+	// a newer CIB may have arrived meanwhile
+	if vc.generation == generation {
+		vc.views[view] = cachedView{data: data, hash: vc.hash, rendered: time.Now(), generation: generation}
+	}
+}
+
+// get returns the rendered view, if it's ready. A
+// view kept past its TTL is rendered again first, for
+// the request in ctx.
+func (vc *viewCache) get(ctx context.Context, view string) ([]byte, bool) {
+	data, _, ok := vc.lookup(ctx, view)
+	return data, ok
+}
+
+// getCib returns the rendered view only if it was
+// rendered from the CIB with the given hash.
+func (vc *viewCache) getCib(ctx context.Context, view string, hash string) ([]byte, bool) {
+	data, from, ok := vc.lookup(ctx, view)
+	return data, ok && hash != "" && from == hash
+}
+
+// lookup returns the rendered view and the hash of the
+// CIB it was rendered from.
+func (vc *viewCache) lookup(ctx context.Context, view string) ([]byte, string, bool) {
+	vc.lock.Lock()
+	cached, ok := vc.views[view]
+	expired := ok && cached.generation != vc.generation && time.Since(cached.rendered) >= vc.ttls[view]
+	cib_data, hash, generation := vc.cib, vc.hash, vc.generation
+	vc.lock.Unlock()
+	if !expired {
+		return cached.data, cached.hash, ok
+	}
+	data, err := renderView(ctx, cib_data, view)
+	if err != nil {
+		log.Errorf("Failed to render %s view: %s", view, err)
+		return nil, "", false
+	}
+	vc.store(view, generation, data)
+	return data, hash, true
+}
+
+var errNoCib = errors.New("The CIB is not available yet.")
+
+// view returns a rendered view of the CIB in snap,
+// from the cache if it was rendered from that CIB.
+func (handler *routeHandler) view(ctx context.Context, view string, snap cibSnapshot) ([]byte, error) {
+	if data, ok := handler.views.getCib(ctx, view, snap.hash); ok {
+		return data, nil
+	}
+	if snap.xmldoc == "" {
+		return nil, errNoCib
+	}
+	return renderView(ctx, snap.xmldoc, view)
+}
+
+// renderView renders the same JSON as the API
+// handlers do for the listing of a whole section,
+// within the parse limits.
+func renderView(ctx context.Context, cib_data string, view string) ([]byte, error) {
+	if view == "properties" {
+		return renderProperties(ctx, cib_data)
+	}
+	var cib Cib
+	err := unmarshalCib(ctx, cib_data, &cib)
+	if err != nil {
+		return nil, err
+	}
+	if cib.Configuration == nil {
+		cib.Configuration = &Configuration{}
+	}
+	cib.Configuration.URLType = view
+	switch view {
+	case "nodes":
+		if cib.Configuration.Nodes == nil {
+			cib.Configuration.Nodes = &Nodes{}
+		}
+		cib.Configuration.Nodes.URLType = "all"
+	case "resources":
+		if cib.Configuration.Resources == nil {
+			cib.Configuration.Resources = &Resources{}
+		}
+		cib.Configuration.Resources.URLType = "all"
+	case "constraints":
+		if cib.Configuration.Constraints == nil {
+			cib.Configuration.Constraints = &Constraints{}
+		}
+		cib.Configuration.Constraints.URLType = "all"
+	}
+	return json.Marshal(&cib)
+}
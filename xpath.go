@@ -0,0 +1,667 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// XPath
+//
+// GET /api/v1/cib?xpath=<expression> returns only the
+// elements of the cached CIB matching the expression,
+// wrapped in an <xpath-query> element, so that tools
+// can read a single resource or node without fetching
+// the whole document. The CIB is parsed into a tree
+// once per version, and never queried from Pacemaker.
+//
+// Only the subset of XPath 1.0 that is useful on a CIB
+// is implemented: absolute and relative location paths
+// with / and //, name tests and *, . and .., and
+// predicates made of positions, @attribute and relative
+// paths (optionally ending in /@attribute), compared to
+// string or number literals with = and !=, combined
+// with and, or, not() and parentheses. Expressions can
+// be joined with |. They must select elements: an
+// attribute as the last step is only allowed inside
+// predicates. Axes other than the abbreviated ones,
+// other functions and namespaces are not supported.
+
+type xmlNode struct {
+	// name is empty for the document and text nodes
+	name     string
+	attrs    []xml.Attr
+	text     string
+	isText   bool
+	parent   *xmlNode
+	children []*xmlNode
+	order    int
+}
+
+// parseXMLTree parses an XML document into a tree,
+// keeping elements, attributes and character data.
+func parseXMLTree(r io.Reader) (*xmlNode, error) {
+	doc := &xmlNode{}
+	current := doc
+	order := 1
+	decoder := xml.NewDecoder(r)
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name.Local, attrs: append([]xml.Attr(nil), t.Attr...), parent: current, order: order}
+			current.children = append(current.children, n)
+			current = n
+		case xml.EndElement:
+			current = current.parent
+		case xml.CharData:
+			if current != doc {
+				current.children = append(current.children, &xmlNode{text: string(t), isText: true, parent: current, order: order})
+			}
+		}
+		order++
+	}
+	return doc, nil
+}
+
+func (n *xmlNode) attr(name string) (string, bool) {
+	for _, a := range n.attrs {
+		if a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// stringValue returns the text contained in n.
+func (n *xmlNode) stringValue() string {
+	if n.isText {
+		return n.text
+	}
+	var text strings.Builder
+	for _, c := range n.children {
+		text.WriteString(c.stringValue())
+	}
+	return text.String()
+}
+
+func attrName(a xml.Attr) string {
+	if a.Name.Space == "xmlns" {
+		return "xmlns:" + a.Name.Local
+	}
+	return a.Name.Local
+}
+
+// writeXML serializes n and its descendants. The
+// document node has no tag of its own, so only its
+// children are written.
+func (n *xmlNode) writeXML(buf *bytes.Buffer) {
+	if n.isText {
+		xml.EscapeText(buf, []byte(n.text))
+		return
+	}
+	if n.name == "" {
+		for _, c := range n.children {
+			c.writeXML(buf)
+		}
+		return
+	}
+	buf.WriteString("<" + n.name)
+	for _, a := range n.attrs {
+		buf.WriteString(" " + attrName(a) + `="`)
+		xml.EscapeText(buf, []byte(a.Value))
+		buf.WriteString(`"`)
+	}
+	if len(n.children) == 0 {
+		buf.WriteString("/>")
+		return
+	}
+	buf.WriteString(">")
+	for _, c := range n.children {
+		c.writeXML(buf)
+	}
+	buf.WriteString("</" + n.name + ">")
+}
+
+// descendantsOrSelf returns the elements in n,
+// including n itself, in document order.
+func (n *xmlNode) descendantsOrSelf() []*xmlNode {
+	nodes := []*xmlNode{n}
+	for _, c := range n.children {
+		if !c.isText {
+			nodes = append(nodes, c.descendantsOrSelf()...)
+		}
+	}
+	return nodes
+}
+
+// Location steps
+const (
+	xpathChild = iota
+	xpathSelf
+	xpathParent
+	xpathAttr
+)
+
+type xpathStep struct {
+	// descendant is set for steps following //
+	descendant bool
+	kind       int
+	name       string
+	preds      []*xpathCond
+}
+
+type xpathPath struct {
+	absolute bool
+	steps    []xpathStep
+}
+
+type xpathOperand struct {
+	path    *xpathPath
+	literal string
+	number  float64
+	kind    int
+}
+
+// Operand kinds
+const (
+	xpathPathOperand = iota
+	xpathLiteral
+	xpathNumber
+)
+
+type xpathCond struct {
+	// op is or, and, not, =, != or value (a single
+	// operand: a path that must exist, or a position)
+	op          string
+	left, right *xpathCond
+	a, b        xpathOperand
+}
+
+type xpathParser struct {
+	src string
+	pos int
+}
+
+func (p *xpathParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at offset %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *xpathParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *xpathParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *xpathParser) lookingAt(s string) bool {
+	p.skipSpace()
+	return strings.HasPrefix(p.src[p.pos:], s)
+}
+
+func isXPathNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(!first && (c == '-' || c == '.' || (c >= '0' && c <= '9')))
+}
+
+func (p *xpathParser) name() (string, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.src) && isXPathNameChar(p.src[p.pos], p.pos == start) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a name")
+	}
+	name := p.src[start:p.pos]
+	if p.lookingAt("::") {
+		return "", fmt.Errorf("the %s axis is not supported", name)
+	}
+	if p.peek() == ':' {
+		return "", fmt.Errorf("namespaces are not supported")
+	}
+	return name, nil
+}
+
+// parseXPath parses a union of location paths.
+func parseXPath(src string) ([]*xpathPath, error) {
+	p := &xpathParser{src: src}
+	var paths []*xpathPath
+	for {
+		path, err := p.parsePath(true)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+		if p.peek() != '|' {
+			break
+		}
+		p.pos++
+	}
+	if p.peek() != 0 {
+		return nil, p.errorf("unexpected %q", p.src[p.pos])
+	}
+	for _, path := range paths {
+		if n := len(path.steps); n > 0 && path.steps[n-1].kind == xpathAttr {
+			return nil, fmt.Errorf("the expression must select elements, not attributes")
+		}
+	}
+	return paths, nil
+}
+
+func (p *xpathParser) parsePath(allowAbsolute bool) (*xpathPath, error) {
+	path := &xpathPath{}
+	descendant := false
+	if allowAbsolute && p.peek() == '/' {
+		path.absolute = true
+		p.pos++
+		if p.peek() == '/' {
+			p.pos++
+			descendant = true
+		} else if c := p.peek(); c == 0 || c == '|' {
+			// just the document
+			return path, nil
+		}
+	}
+	for {
+		step, err := p.parseStep()
+		if err != nil {
+			return nil, err
+		}
+		step.descendant = descendant
+		path.steps = append(path.steps, step)
+		if p.peek() != '/' {
+			return path, nil
+		}
+		if step.kind == xpathAttr {
+			return nil, p.errorf("attributes have no children")
+		}
+		p.pos++
+		descendant = false
+		if p.peek() == '/' {
+			p.pos++
+			descendant = true
+		}
+	}
+}
+
+func (p *xpathParser) parseStep() (xpathStep, error) {
+	var step xpathStep
+	switch {
+	case p.lookingAt(".."):
+		p.pos += 2
+		step.kind = xpathParent
+		return step, nil
+	case p.lookingAt("."):
+		p.pos++
+		step.kind = xpathSelf
+		return step, nil
+	case p.peek() == '@':
+		p.pos++
+		step.kind = xpathAttr
+	default:
+		step.kind = xpathChild
+	}
+	if p.peek() == '*' {
+		p.pos++
+		step.name = "*"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return step, err
+		}
+		if p.peek() == '(' {
+			return step, fmt.Errorf("%s() is not supported here", name)
+		}
+		step.name = name
+	}
+	for step.kind == xpathChild && p.peek() == '[' {
+		p.pos++
+		cond, err := p.parseOr()
+		if err != nil {
+			return step, err
+		}
+		if p.peek() != ']' {
+			return step, p.errorf("expected ']'")
+		}
+		p.pos++
+		step.preds = append(step.preds, cond)
+	}
+	return step, nil
+}
+
+// keyword returns true and skips word if it comes next
+// as a whole word.
+func (p *xpathParser) keyword(word string) bool {
+	if !p.lookingAt(word) {
+		return false
+	}
+	end := p.pos + len(word)
+	if end < len(p.src) && isXPathNameChar(p.src[end], false) {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func (p *xpathParser) parseOr() (*xpathCond, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &xpathCond{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *xpathParser) parseAnd() (*xpathCond, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &xpathCond{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *xpathParser) parseUnary() (*xpathCond, error) {
+	save := p.pos
+	if p.keyword("not") && p.peek() == '(' {
+		p.pos++
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected ')'")
+		}
+		p.pos++
+		return &xpathCond{op: "not", left: cond}, nil
+	}
+	p.pos = save
+	if p.peek() == '(' {
+		p.pos++
+		cond, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected ')'")
+		}
+		p.pos++
+		return cond, nil
+	}
+	a, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	cond := &xpathCond{op: "value", a: a}
+	if p.lookingAt("!=") {
+		p.pos += 2
+		cond.op = "!="
+	} else if p.peek() == '=' {
+		p.pos++
+		cond.op = "="
+	} else {
+		return cond, nil
+	}
+	if cond.b, err = p.parseOperand(); err != nil {
+		return nil, err
+	}
+	return cond, nil
+}
+
+func (p *xpathParser) parseOperand() (xpathOperand, error) {
+	var op xpathOperand
+	switch c := p.peek(); {
+	case c == '\'' || c == '"':
+		end := strings.IndexByte(p.src[p.pos+1:], c)
+		if end < 0 {
+			return op, p.errorf("unterminated string")
+		}
+		op.kind, op.literal = xpathLiteral, p.src[p.pos+1:p.pos+1+end]
+		p.pos += end + 2
+	case c >= '0' && c <= '9':
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] == '.' || (p.src[p.pos] >= '0' && p.src[p.pos] <= '9')) {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return op, p.errorf("invalid number")
+		}
+		op.kind, op.number = xpathNumber, n
+	case c == '/':
+		return op, p.errorf("absolute paths are not supported in predicates")
+	default:
+		path, err := p.parsePath(false)
+		if err != nil {
+			return op, err
+		}
+		op.kind, op.path = xpathPathOperand, path
+	}
+	return op, nil
+}
+
+// evalSteps applies steps to the context nodes, and
+// returns the resulting elements in document order.
+func evalSteps(contexts []*xmlNode, steps []xpathStep) []*xmlNode {
+	for _, step := range steps {
+		if step.kind == xpathAttr {
+			break
+		}
+		seen := make(map[*xmlNode]bool)
+		var next []*xmlNode
+		for _, c := range contexts {
+			bases := []*xmlNode{c}
+			if step.descendant {
+				bases = c.descendantsOrSelf()
+			}
+			for _, b := range bases {
+				for _, n := range step.candidates(b) {
+					if !seen[n] {
+						seen[n] = true
+						next = append(next, n)
+					}
+				}
+			}
+		}
+		sort.Slice(next, func(i, j int) bool { return next[i].order < next[j].order })
+		contexts = next
+	}
+	return contexts
+}
+
+// candidates returns the nodes selected by step from
+// node, filtered by its predicates.
+func (step *xpathStep) candidates(node *xmlNode) []*xmlNode {
+	var nodes []*xmlNode
+	switch step.kind {
+	case xpathSelf:
+		nodes = []*xmlNode{node}
+	case xpathParent:
+		if node.parent != nil {
+			nodes = []*xmlNode{node.parent}
+		}
+	case xpathChild:
+		for _, c := range node.children {
+			if !c.isText && (step.name == "*" || c.name == step.name) {
+				nodes = append(nodes, c)
+			}
+		}
+	}
+	for _, pred := range step.preds {
+		var kept []*xmlNode
+		for i, n := range nodes {
+			if pred.matches(n, i+1) {
+				kept = append(kept, n)
+			}
+		}
+		nodes = kept
+	}
+	return nodes
+}
+
+// values returns the string values the operand
+// evaluates to for node.
+func (op *xpathOperand) values(node *xmlNode) []string {
+	switch op.kind {
+	case xpathLiteral:
+		return []string{op.literal}
+	case xpathNumber:
+		return []string{strconv.FormatFloat(op.number, 'f', -1, 64)}
+	}
+	nodes := evalSteps([]*xmlNode{node}, op.path.steps)
+	var values []string
+	last := op.path.steps[len(op.path.steps)-1]
+	for _, n := range nodes {
+		if last.kind != xpathAttr {
+			values = append(values, n.stringValue())
+			continue
+		}
+		for _, a := range n.attrs {
+			if last.name == "*" || a.Name.Local == last.name {
+				values = append(values, a.Value)
+			}
+		}
+	}
+	return values
+}
+
+func xpathEqual(a, b string, numeric bool) bool {
+	if numeric {
+		x, errx := strconv.ParseFloat(strings.TrimSpace(a), 64)
+		y, erry := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		return errx == nil && erry == nil && x == y
+	}
+	return a == b
+}
+
+func (cond *xpathCond) matches(node *xmlNode, position int) bool {
+	switch cond.op {
+	case "or":
+		return cond.left.matches(node, position) || cond.right.matches(node, position)
+	case "and":
+		return cond.left.matches(node, position) && cond.right.matches(node, position)
+	case "not":
+		return !cond.left.matches(node, position)
+	case "value":
+		switch cond.a.kind {
+		case xpathNumber:
+			return float64(position) == cond.a.number
+		case xpathLiteral:
+			return cond.a.literal != ""
+		}
+		return len(cond.a.values(node)) > 0
+	}
+	numeric := cond.a.kind == xpathNumber || cond.b.kind == xpathNumber
+	for _, x := range cond.a.values(node) {
+		for _, y := range cond.b.values(node) {
+			if xpathEqual(x, y, numeric) == (cond.op == "=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// queryXPath returns the elements of the document
+// matching any of the paths, in document order.
+func queryXPath(doc *xmlNode, paths []*xpathPath) []*xmlNode {
+	seen := make(map[*xmlNode]bool)
+	var result []*xmlNode
+	for _, path := range paths {
+		for _, n := range evalSteps([]*xmlNode{doc}, path.steps) {
+			if !seen[n] {
+				seen[n] = true
+				result = append(result, n)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].order < result[j].order })
+	return result
+}
+
+// xmlTreeCache holds the tree of the latest CIB that
+// was queried.
+type xmlTreeCache struct {
+	lock sync.Mutex
+	hash string
+	doc  *xmlNode
+}
+
+func (c *xmlTreeCache) get(ctx context.Context, snap cibSnapshot) (*xmlNode, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.hash == snap.hash && c.doc != nil {
+		return c.doc, nil
+	}
+	if err := cibParses.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer cibParses.release()
+	doc, err := parseXMLTree(strings.NewReader(snap.xmldoc))
+	if err != nil {
+		return nil, err
+	}
+	c.hash, c.doc = snap.hash, doc
+	return doc, nil
+}
+
+// serveCibXPath responds with the elements of the CIB
+// matching expr.
+func (handler *routeHandler) serveCibXPath(w http.ResponseWriter, r *http.Request, snap cibSnapshot, expr string) bool {
+	paths, err := parseXPath(expr)
+	if err != nil {
+		httpJSONError(w, fmt.Sprintf("Invalid XPath expression: %s", err), http.StatusBadRequest)
+		return true
+	}
+	if snap.xmldoc == "" {
+		httpJSONError(w, errNoCib.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	doc, err := handler.xpath.get(r.Context(), snap)
+	if err != nil {
+		return parseFailed(w, err)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("<xpath-query>")
+	for _, n := range queryXPath(doc, paths) {
+		n.writeXML(&buf)
+	}
+	buf.WriteString("</xpath-query>\n")
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(buf.Bytes())
+	return true
+}